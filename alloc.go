@@ -0,0 +1,17 @@
+package brotli
+
+// AllocHook, if not nil, is called with the size in bytes and the purpose
+// of each of the large allocations that Writers and Readers make, to help
+// find allocation hotspots. The purposes are "encoder window", "decoder
+// window", "hash table", "output buffer" (for compressed data), and "input
+// buffer" (for compressed data being decoded). Set it before any Writer or
+// Reader is in use; it is called from whichever goroutines are using them,
+// so it must be safe for concurrent use.
+var AllocHook func(size int, purpose string)
+
+// reportAlloc calls AllocHook, if it is set.
+func reportAlloc(size int, purpose string) {
+	if AllocHook != nil {
+		AllocHook(size, purpose)
+	}
+}
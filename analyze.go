@@ -0,0 +1,108 @@
+package brotli
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// StreamInfo describes an encoded stream, as found by AnalyzeStream.
+type StreamInfo struct {
+	// MaxDistance is the longest back-reference distance that the stream
+	// uses, not counting references to the built-in dictionary. A window
+	// of w bits covers distances up to 1<<w - 16, so a stream may be
+	// encoded again with a smaller window than it declares (see
+	// WriterOptions.LGWin) without losing any of its matches.
+	MaxDistance int
+	// WindowBits is the base 2 logarithm of the window size that the
+	// stream declares, from 10 to 24.
+	WindowBits int
+	// Metablocks is the number of metablocks, including empty and metadata
+	// ones.
+	Metablocks int
+	// Stored reports whether any metablock is uncompressed.
+	Stored bool
+}
+
+// AnalyzeStream decodes src, which must be a complete stream without a
+// custom dictionary, to describe how it was encoded.
+func AnalyzeStream(src []byte) (StreamInfo, error) {
+	var info StreamInfo
+	r := NewReader(bytes.NewReader(src))
+	r.traceCopy = func(distance, length int, dictionary bool) {
+		if !dictionary && distance > info.MaxDistance {
+			info.MaxDistance = distance
+		}
+	}
+	r.traceUncompressed = func() { info.Stored = true }
+	_, err := io.Copy(ioutil.Discard, r)
+	if err == nil && r.state != stateDone {
+		err = io.ErrUnexpectedEOF
+	}
+	info.WindowBits = r.stats.WindowBits
+	info.Metablocks = r.stats.Metablocks
+	return info, err
+}
+
+// DecompressedSize returns the exact decompressed size of src, a complete
+// stream without a custom dictionary, such as for rejecting an oversized
+// payload before decoding it into memory. The stream's metablock headers
+// only give the sizes of the metablocks that are reached, and a compressed
+// metablock can only be skipped by decoding it, so DecompressedSize decodes
+// the whole stream, and costs as much time as decoding it; but the output
+// is discarded as it is produced, so the memory used is bounded by the
+// stream's window. A size hint at the start of the stream (see
+// WriterOptions.EmitSizeHint) is not used, since it comes from the stream
+// itself and may be wrong; Reader.SizeHint reports it after the first Read.
+func DecompressedSize(src []byte) (int64, error) {
+	r := NewReader(bytes.NewReader(src))
+	var buf [4096]byte
+	var size int64
+	for {
+		n, err := r.Read(buf[:])
+		size += int64(n)
+		if err == io.EOF {
+			if r.state != stateDone {
+				return size, io.ErrUnexpectedEOF
+			}
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+// DictStats describes the use of brotli's built-in static dictionary by a
+// stream, as found by AnalyzeDictionaryUsage.
+type DictStats struct {
+	// References is the number of copies from the static dictionary.
+	References int
+	// Transformed is the number of those that apply a transform to the
+	// word, such as capitalizing it or adding a suffix, rather than copy
+	// it as it is.
+	Transformed int
+	// WordBytes is the total length of the words referred to, before any
+	// transforms.
+	WordBytes int
+}
+
+// AnalyzeDictionaryUsage decodes src, which must be a complete stream
+// without a custom dictionary, and counts its references to the static
+// dictionary, such as for understanding how well text compresses.
+func AnalyzeDictionaryUsage(src []byte) (DictStats, error) {
+	var stats DictStats
+	r := NewReader(bytes.NewReader(src))
+	r.traceDictionary = func(wordLength int, transformed bool) {
+		stats.References++
+		stats.WordBytes += wordLength
+		if transformed {
+			stats.Transformed++
+		}
+	}
+	_, err := io.Copy(ioutil.Discard, r)
+	if err == nil && r.state != stateDone {
+		err = io.ErrUnexpectedEOF
+	}
+	return stats, err
+}
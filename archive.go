@@ -0,0 +1,276 @@
+//go:build go1.16
+// +build go1.16
+
+package brotli
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// An archive, as written by CompressFS, is the concatenation of each file's
+// contents compressed as a separate brotli stream, followed by an index,
+// the length of the index (8 bytes, big-endian), and archiveMagic.
+// The index is a sequence of entries, each consisting of the file's path,
+// its uncompressed size, and the offset and length of its compressed data,
+// all as uvarints except the path, which is a uvarint length followed by
+// the path itself.
+const archiveMagic = "BRA1"
+
+const archiveTrailerSize = 8 + len(archiveMagic)
+
+var errInvalidArchive = errors.New("brotli: invalid archive")
+
+type archiveEntry struct {
+	name   string
+	size   int64
+	offset int64
+	length int64
+}
+
+// CompressFS walks fsys and writes an archive of all its regular files to
+// w, compressing each file separately with the given options. The archive
+// can be read with OpenArchive. Empty directories are not recorded.
+func CompressFS(fsys fs.FS, w io.Writer, options WriterOptions) error {
+	cw := &countingWriter{w: w}
+	bw := NewWriterOptions(cw, options)
+	var index []archiveEntry
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		e := archiveEntry{name: name, offset: cw.n}
+		bw.Reset(cw)
+		if e.size, err = io.Copy(bw, f); err != nil {
+			return err
+		}
+		if err := bw.Close(); err != nil {
+			return err
+		}
+		e.length = cw.n - e.offset
+		index = append(index, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, e := range index {
+		buf = appendUvarint(buf, uint64(len(e.name)))
+		buf = append(buf, e.name...)
+		buf = appendUvarint(buf, uint64(e.size))
+		buf = appendUvarint(buf, uint64(e.offset))
+		buf = appendUvarint(buf, uint64(e.length))
+	}
+	var trailer [archiveTrailerSize]byte
+	binary.BigEndian.PutUint64(trailer[:8], uint64(len(buf)))
+	copy(trailer[8:], archiveMagic)
+	buf = append(buf, trailer[:]...)
+	_, err = cw.Write(buf)
+	return err
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// OpenArchive returns a file system serving the files in the archive of
+// the given size read from r, decompressing them as they are read.
+func OpenArchive(r io.ReaderAt, size int64) (fs.FS, error) {
+	if size < int64(archiveTrailerSize) {
+		return nil, errInvalidArchive
+	}
+	var trailer [archiveTrailerSize]byte
+	if _, err := r.ReadAt(trailer[:], size-int64(archiveTrailerSize)); err != nil {
+		return nil, err
+	}
+	if string(trailer[8:]) != archiveMagic {
+		return nil, errInvalidArchive
+	}
+	indexLen := binary.BigEndian.Uint64(trailer[:8])
+	if indexLen > uint64(size-int64(archiveTrailerSize)) {
+		return nil, errInvalidArchive
+	}
+	indexOffset := size - int64(archiveTrailerSize) - int64(indexLen)
+	br := bufio.NewReader(io.NewSectionReader(r, indexOffset, int64(indexLen)))
+
+	a := &archive{r: r, files: make(map[string]*archiveEntry), dirs: make(map[string][]fs.DirEntry)}
+	a.dirs["."] = nil
+	for {
+		nameLen, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || nameLen > indexLen {
+			return nil, errInvalidArchive
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, errInvalidArchive
+		}
+		e := &archiveEntry{name: string(name)}
+		for _, v := range []*int64{&e.size, &e.offset, &e.length} {
+			x, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, errInvalidArchive
+			}
+			*v = int64(x)
+		}
+		if !fs.ValidPath(e.name) || e.name == "." || e.offset < 0 || e.length < 0 || e.offset+e.length > indexOffset {
+			return nil, errInvalidArchive
+		}
+		if _, dup := a.files[e.name]; dup {
+			return nil, errInvalidArchive
+		}
+		a.files[e.name] = e
+		a.addToDir(e.name, fileInfo{name: path.Base(e.name), size: e.size})
+	}
+	for name, entries := range a.dirs {
+		if _, ok := a.files[name]; ok {
+			return nil, errInvalidArchive
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return a, nil
+}
+
+// archive implements fs.FS for an archive opened by OpenArchive.
+type archive struct {
+	r     io.ReaderAt
+	files map[string]*archiveEntry
+	dirs  map[string][]fs.DirEntry
+}
+
+// addToDir records an entry in the directory containing name, creating the
+// parent directories as needed.
+func (a *archive) addToDir(name string, info fileInfo) {
+	dir := path.Dir(name)
+	entries, exists := a.dirs[dir]
+	a.dirs[dir] = append(entries, info)
+	if !exists && dir != "." {
+		a.addToDir(dir, fileInfo{name: path.Base(dir), dir: true})
+	}
+}
+
+func (a *archive) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if e, ok := a.files[name]; ok {
+		return &archiveFile{
+			info: fileInfo{name: path.Base(name), size: e.size},
+			r:    NewReader(io.NewSectionReader(a.r, e.offset, e.length)),
+		}, nil
+	}
+	if entries, ok := a.dirs[name]; ok {
+		return &archiveDir{info: fileInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// fileInfo implements both fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi fileInfo) Name() string               { return fi.name }
+func (fi fileInfo) Size() int64                { return fi.size }
+func (fi fileInfo) ModTime() time.Time         { return time.Time{} }
+func (fi fileInfo) IsDir() bool                { return fi.dir }
+func (fi fileInfo) Sys() interface{}           { return nil }
+func (fi fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type archiveFile struct {
+	info fileInfo
+	r    *Reader
+	read int64 // bytes returned so far
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *archiveFile) Close() error               { return nil }
+
+// Read fails with ErrSizeMismatch if the file's data doesn't have the size
+// recorded in the index, and with io.ErrUnexpectedEOF if its stream is
+// truncated.
+func (f *archiveFile) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.read += int64(n)
+	if f.read > f.info.size {
+		return n, ErrSizeMismatch
+	}
+	if err == io.EOF {
+		if f.r.state != stateDone {
+			return n, io.ErrUnexpectedEOF
+		}
+		if f.read != f.info.size {
+			return n, ErrSizeMismatch
+		}
+	}
+	return n, err
+}
+
+type archiveDir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+	pos     int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n <= 0 {
+		d.pos = len(d.entries)
+		return append([]fs.DirEntry(nil), rest...), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.pos += n
+	return append([]fs.DirEntry(nil), rest[:n]...), nil
+}
@@ -0,0 +1,71 @@
+//go:build go1.16
+// +build go1.16
+
+package brotli
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestArchive(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":        {Data: []byte(strings.Repeat("<p>Hello, world!</p>\n", 100))},
+		"empty.txt":         {Data: nil},
+		"css/site.css":      {Data: []byte("body { margin: 0; }\n")},
+		"js/lib/app.min.js": {Data: []byte(strings.Repeat("console.log(1);", 50))},
+	}
+
+	var buf bytes.Buffer
+	if err := CompressFS(fsys, &buf, WriterOptions{Quality: 5}); err != nil {
+		t.Fatalf("CompressFS: %v", err)
+	}
+	archive, err := OpenArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("OpenArchive: %v", err)
+	}
+	for name, f := range fsys {
+		got, err := fs.ReadFile(archive, name)
+		if err != nil {
+			t.Errorf("ReadFile(%q): %v", name, err)
+		} else if !bytes.Equal(got, f.Data) {
+			t.Errorf("ReadFile(%q) = %q, want %q", name, got, f.Data)
+		}
+	}
+	if err := fstest.TestFS(archive, "index.html", "empty.txt", "css/site.css", "js/lib/app.min.js"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := OpenArchive(bytes.NewReader(buf.Bytes()[1:]), int64(buf.Len()-1)); err == nil {
+		t.Error("OpenArchive succeeded on a truncated archive")
+	}
+}
+
+func TestArchiveFileRead(t *testing.T) {
+	content := []byte(strings.Repeat("archived file ", 100))
+	compressed, err := Encode(content, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name       string
+		compressed []byte
+		size       int64
+		err        error
+	}{
+		{"intact", compressed, int64(len(content)), nil},
+		{"truncated", compressed[:len(compressed)-2], int64(len(content)), io.ErrUnexpectedEOF},
+		{"longer than recorded", compressed, int64(len(content)) - 1, ErrSizeMismatch},
+		{"shorter than recorded", compressed, int64(len(content)) + 1, ErrSizeMismatch},
+	} {
+		f := &archiveFile{info: fileInfo{name: "f", size: test.size}, r: NewReader(bytes.NewReader(test.compressed))}
+		if _, err := ioutil.ReadAll(f); err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
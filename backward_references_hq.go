@@ -67,6 +67,7 @@ type zopfliCostModel struct {
 	literal_costs_          []float32
 	min_cost_cmd_           float32
 	num_bytes_              uint
+	custom                  CostModel /* replaces the costs, if not nil */
 }
 
 func initZopfliCostModel(self *zopfliCostModel, dist *distanceParams, num_bytes uint) {
@@ -176,6 +177,9 @@ func zopfliCostModelSetFromCommands(self *zopfliCostModel, position uint, ringbu
 			literal_carry -= literal_costs[i+1] - literal_costs[i]
 		}
 	}
+	if self.custom != nil {
+		zopfliCostModelSetCustom(self, position, ringbuffer, ringbuffer_mask)
+	}
 }
 
 func zopfliCostModelSetFromLiteralCosts(self *zopfliCostModel, position uint, ringbuffer []byte, ringbuffer_mask uint) {
@@ -202,6 +206,9 @@ func zopfliCostModelSetFromLiteralCosts(self *zopfliCostModel, position uint, ri
 	}
 
 	self.min_cost_cmd_ = float32(fastLog2(11))
+	if self.custom != nil {
+		zopfliCostModelSetCustom(self, position, ringbuffer, ringbuffer_mask)
+	}
 }
 
 func zopfliCostModelGetCommandCost(self *zopfliCostModel, cmdcode uint16) float32 {
@@ -444,6 +451,9 @@ func updateNodes(num_bytes uint, block_start uint, pos uint, ringbuffer []byte,
 						tmp = dist_cost
 					}
 					var cost float32 = tmp + float32(getCopyExtra(copycode)) + zopfliCostModelGetCommandCost(model, cmdcode)
+					if model.custom != nil {
+						cost = base_cost + model.custom.CopyCost(int(l), int(backward))
+					}
 					if cost < nodes[pos+l].u.cost {
 						updateZopfliNode(nodes, pos, start, l, l, backward, j+1, cost)
 						result = brotli_max_size_t(result, l)
@@ -499,6 +509,9 @@ func updateNodes(num_bytes uint, block_start uint, pos uint, ringbuffer []byte,
 					var copycode uint16 = getCopyLengthCode(len_code)
 					var cmdcode uint16 = combineLengthCodes(inscode, copycode, false)
 					var cost float32 = dist_cost + float32(getCopyExtra(copycode)) + zopfliCostModelGetCommandCost(model, cmdcode)
+					if model.custom != nil {
+						cost = base_cost + model.custom.CopyCost(int(len), int(dist))
+					}
 					if cost < nodes[pos+len].u.cost {
 						updateZopfliNode(nodes, pos, start, uint(len), len_code, dist, 0, cost)
 						if len > result {
@@ -639,6 +652,7 @@ func zopfliComputeShortestPath(num_bytes uint, position uint, ringbuffer []byte,
 	nodes[0].length = 0
 	nodes[0].u.cost = 0
 	initZopfliCostModel(&model, &params.dist, num_bytes)
+	model.custom = params.cost_model
 	zopfliCostModelSetFromLiteralCosts(&model, position, ringbuffer, ringbuffer_mask)
 	initStartPosQueue(&queue)
 	for i = 0; i+hasher.HashTypeLength()-1 < num_bytes; i++ {
@@ -773,7 +787,8 @@ func createHqZopfliBackwardReferences(num_bytes uint, position uint, ringbuffer
 	orig_num_commands = len(*commands)
 	nodes = make([]zopfliNode, (num_bytes + 1))
 	initZopfliCostModel(&model, &params.dist, num_bytes)
-	for i = 0; i < 2; i++ {
+	model.custom = params.cost_model
+	for i = 0; i < uint(hqZopfliIterations(params)); i++ {
 		initZopfliNodes(nodes, num_bytes+1)
 		if i == 0 {
 			zopfliCostModelSetFromLiteralCosts(&model, position, ringbuffer, ringbuffer_mask)
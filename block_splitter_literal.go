@@ -407,12 +407,7 @@ func splitByteVectorLiteral(data []byte, length uint, literals_per_histogram uin
 		var cost []float64 = make([]float64, num_histograms)
 		var switch_signal []byte = make([]byte, (length * bitmaplen))
 		var new_id []uint16 = make([]uint16, num_histograms)
-		var iters uint
-		if params.quality < hqZopflificationQuality {
-			iters = 3
-		} else {
-			iters = 10
-		}
+		var iters uint = blockSplitIterations(params)
 		/* Find a good path through literals with the good entropy codes. */
 
 		var i uint
@@ -8,13 +8,21 @@ package brotli
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -252,6 +260,50 @@ func TestEncoderFlush(t *testing.T) {
 	}
 }
 
+func TestEncoderFlushAllQualities(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 450000)
+	rand.New(rand.NewSource(0)).Read(random)
+
+	for quality := BestSpeed; quality <= BestCompression; quality++ {
+		for _, size := range []int{1, 2, 3, 17, 1000, 65535, 65536, 65537, 150000} {
+			for name, content := range map[string][]byte{"text": opticks, "random": random} {
+				var out bytes.Buffer
+				w := NewWriterOptions(&out, WriterOptions{Quality: quality})
+				var written []byte
+				// Flush after each of a few pieces, and check each time
+				// that everything written so far can be decoded.
+				for i := 0; i < 3; i++ {
+					piece := content[i*size : (i+1)*size]
+					if _, err := w.Write(piece); err != nil {
+						t.Fatal(err)
+					}
+					if err := w.Flush(); err != nil {
+						t.Fatal(err)
+					}
+					written = append(written, piece...)
+
+					r := NewReader(bytes.NewReader(out.Bytes()))
+					got := make([]byte, len(written)+1)
+					n, err := io.ReadFull(r, got)
+					if err != io.ErrUnexpectedEOF && err != io.EOF {
+						t.Fatalf("quality %d, %s, size %d, piece %d: %v", quality, name, size, i, err)
+					}
+					if !bytes.Equal(got[:n], written) {
+						t.Fatalf("quality %d, %s, size %d, piece %d: decoded %d bytes after Flush, want %d", quality, name, size, i, n, len(written))
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
 type readerWithTimeout struct {
 	io.Reader
 }
@@ -361,6 +413,27 @@ func TestReader(t *testing.T) {
 			got, len(content))
 	}
 
+	// Reset must also discard input that was buffered but not yet decoded,
+	// whatever the window size.
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lgwin := range []int{16, 24} {
+		encoded, _ := Encode(opticks, WriterOptions{Quality: 5, LGWin: lgwin})
+		r.Reset(bytes.NewReader(encoded))
+		if _, err := r.Read(make([]byte, 10)); err != nil {
+			t.Fatalf("LGWin %d: Read: %v", lgwin, err)
+		}
+		r.Reset(bytes.NewReader(encoded))
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("LGWin %d: after partial read and Reset: ReadAll: %v", lgwin, err)
+		}
+		if !bytes.Equal(got, opticks) {
+			t.Errorf("LGWin %d: after partial read and Reset: output doesn't match input", lgwin)
+		}
+	}
 }
 
 func TestDecode(t *testing.T) {
@@ -553,3 +626,4206 @@ func BenchmarkDecodeLevels(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkEncodeResetBuffer(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		dst  func(*bytes.Buffer) io.Writer
+	}{
+		// A *bytes.Buffer gets presized by Reset.
+		{"Buffer", func(buf *bytes.Buffer) io.Writer { return buf }},
+		// Hiding the concrete type disables the presizing.
+		{"Writer", func(buf *bytes.Buffer) io.Writer { return struct{ io.Writer }{buf} }},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			w := NewWriterLevel(ioutil.Discard, 5)
+			w.Write(opticks)
+			w.Close()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(opticks)))
+			for i := 0; i < b.N; i++ {
+				buf := new(bytes.Buffer)
+				w.Reset(test.dst(buf))
+				w.Write(opticks)
+				w.Close()
+			}
+		})
+	}
+}
+
+func TestWriterFinishMetablock(t *testing.T) {
+	parts := [][]byte{
+		[]byte("<html><body>"),
+		bytes.Repeat([]byte("<H1>Hello world</H1>"), 100),
+		[]byte("</body></html>"),
+	}
+	var out bytes.Buffer
+	w := NewWriterOptions(&out, WriterOptions{Quality: 5})
+	for i, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.FinishMetablock(i == len(parts)-1); err != nil {
+			t.Fatalf("FinishMetablock(%v): %v", i == len(parts)-1, err)
+		}
+	}
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Errorf("No error from Write after FinishMetablock(true)")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := checkCompressedData(out.Bytes(), bytes.Join(parts, nil)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderWindowBuffer(t *testing.T) {
+	const lgWin = 16
+	input := make([]byte, 4<<lgWin)
+	rand.New(rand.NewSource(0)).Read(input)
+	encoded, err := Encode(input, WriterOptions{Quality: 5, LGWin: lgWin})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	window := make([]byte, 1<<lgWin+64)
+	r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{WindowBuffer: window})
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(decoded, input) {
+		t.Fatal("Decoded output doesn't match input")
+	}
+	// The last window of output should have been decoded into the buffer.
+	if !bytes.Equal(window[:1<<lgWin], input[len(input)-1<<lgWin:]) {
+		t.Error("WindowBuffer was not used as the ring buffer")
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	content := bytes.Repeat([]byte("hello world!"), 10000)
+	body, err := RequestBody(bytes.NewReader(content), WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatalf("RequestBody: %v", err)
+	}
+	encoded, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := body.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := checkCompressedData(encoded, content); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := RequestBody(bytes.NewReader(content), WriterOptions{Quality: 12}); err == nil {
+		t.Error("No error from RequestBody with Quality 12")
+	}
+}
+
+func TestWriterMatchStats(t *testing.T) {
+	content := bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 1000)
+	var out bytes.Buffer
+	w := NewWriterOptions(&out, WriterOptions{Quality: 5, CollectStats: true})
+	w.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	st := w.MatchStats()
+	if st.Literals+st.CopiedBytes != len(content) {
+		t.Errorf("Literals+CopiedBytes = %d, want %d", st.Literals+st.CopiedBytes, len(content))
+	}
+	if ratio := float64(st.CopiedBytes) / float64(len(content)); ratio < 0.9 {
+		t.Errorf("copy ratio = %.3f, want at least 0.9 (stats: %+v)", ratio, st)
+	}
+	if st.AverageMatchLength() < 100 {
+		t.Errorf("AverageMatchLength() = %v, want at least 100", st.AverageMatchLength())
+	}
+
+	w.Reset(ioutil.Discard)
+	if st := w.MatchStats(); st.Copies != 0 || st.Literals != 0 {
+		t.Errorf("MatchStats after Reset = %+v, want zero", st)
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte(nil), 5)
+	f.Add([]byte("A"), 0)
+	f.Add([]byte("<html><body><H1>Hello world</H1></body></html>"), 11)
+	f.Add(bytes.Repeat([]byte("hello world!"), 100), 1)
+	f.Fuzz(func(t *testing.T, data []byte, quality int) {
+		if quality < BestSpeed || quality > BestCompression {
+			t.Skip()
+		}
+		if err := RoundTrip(data, WriterOptions{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestWriterAbortIfLarger(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(random)
+	text := bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 100)
+
+	for _, level := range []int{0, 1, 5, 11} {
+		options := WriterOptions{Quality: level, AbortIfLarger: true}
+		if _, err := Encode(random, options); err != ErrNotCompressible {
+			t.Errorf("level %d: Encode(random data) returned error %v, want ErrNotCompressible", level, err)
+		}
+		encoded, err := Encode(text, options)
+		if err != nil {
+			t.Errorf("level %d: Encode(text) returned error %v", level, err)
+		}
+		if err := checkCompressedData(encoded, text); err != nil {
+			t.Errorf("level %d: %v", level, err)
+		}
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	content := bytes.Repeat([]byte("hello world!"), 10000)
+	encoded, _ := Encode(content, WriterOptions{Quality: 5})
+
+	dst := make([]byte, 0, len(content))
+	decoded, err := DecodeInto(dst, encoded)
+	if err != nil {
+		t.Fatalf("DecodeInto: %v", err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Fatal("DecodeInto output doesn't match input")
+	}
+	if &decoded[0] != &dst[:1][0] {
+		t.Error("DecodeInto reallocated a correctly pre-sized dst")
+	}
+
+	prefix := []byte("prefix: ")
+	decoded, err = DecodeInto(prefix, encoded)
+	if err != nil {
+		t.Fatalf("DecodeInto with small dst: %v", err)
+	}
+	if !bytes.Equal(decoded, append(prefix, content...)) {
+		t.Error("DecodeInto with small dst: output doesn't match input")
+	}
+
+	if _, err := DecodeInto(nil, append(encoded, 0)); err == nil {
+		t.Error("Expected 'excessive input' error")
+	}
+	if _, err := DecodeInto(nil, encoded[:len(encoded)-1]); err == nil {
+		t.Error("Expected error for truncated input")
+	}
+}
+
+func TestDecodeIntoAllocs(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, quality := range []int{1, 5, 11} {
+		encoded, err := Encode(opticks, WriterOptions{Quality: quality})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := make([]byte, 0, len(opticks))
+		allocs := testing.AllocsPerRun(10, func() {
+			decoded, err := DecodeInto(dst, encoded)
+			if err != nil || len(decoded) != len(opticks) {
+				t.Fatalf("quality %d: DecodeInto returned %d bytes, %v", quality, len(decoded), err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("quality %d: DecodeInto into a pre-sized dst made %v allocations, want 0", quality, allocs)
+		}
+	}
+}
+
+func BenchmarkEncodeOutputSizeHint(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	encoded, err := Encode(opticks, WriterOptions{Quality: 5})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, hint := range []int{0, len(encoded)} {
+		b.Run(fmt.Sprint("hint=", hint), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(opticks)))
+			for i := 0; i < b.N; i++ {
+				buf := new(bytes.Buffer)
+				w := NewWriterOptions(buf, WriterOptions{Quality: 5, OutputSizeHint: hint})
+				// Flushing progressively larger pieces makes the staging
+				// buffer grow repeatedly without a hint.
+				data := opticks
+				for n := 1024; len(data) > 0; n *= 2 {
+					if n > len(data) {
+						n = len(data)
+					}
+					w.Write(data[:n])
+					w.Flush()
+					data = data[n:]
+				}
+				w.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeBuiltinDictionary(b *testing.B) {
+	// Binary records: a counter, a timestamp, and a noisy reading.
+	rnd := rand.New(rand.NewSource(1))
+	var data []byte
+	var record [16]byte
+	for i := 0; len(data) < 1<<20; i++ {
+		binary.LittleEndian.PutUint32(record[0:], uint32(i))
+		binary.LittleEndian.PutUint64(record[4:], uint64(1600000000+i*60))
+		binary.LittleEndian.PutUint32(record[12:], 1000+rnd.Uint32()%64)
+		data = append(data, record[:]...)
+	}
+
+	for _, disable := range []bool{false, true} {
+		b.Run(fmt.Sprint("disabled=", disable), func(b *testing.B) {
+			options := WriterOptions{Quality: 5, DisableBuiltinDictionary: disable}
+			b.SetBytes(int64(len(data)))
+			var size int
+			for i := 0; i < b.N; i++ {
+				encoded, err := Encode(data, options)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(encoded)
+			}
+			b.ReportMetric(float64(size), "bytes")
+		})
+	}
+}
+
+func BenchmarkEncodeExtraOptimize(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, extra := range []bool{false, true} {
+		options := WriterOptions{Quality: BestCompression, ExtraOptimize: extra}
+		buf := new(bytes.Buffer)
+		w := NewWriterOptions(buf, options)
+		w.Write(opticks)
+		w.Close()
+		b.Run(fmt.Sprintf("%v", extra), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(opticks))/float64(buf.Len()), "ratio")
+			b.SetBytes(int64(len(opticks)))
+			for i := 0; i < b.N; i++ {
+				w.Reset(ioutil.Discard)
+				w.Write(opticks)
+				w.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkEncodeBlockSplitPasses compresses the package's own source code,
+// the closest thing in the repository to a static JavaScript bundle.
+func BenchmarkEncodeBlockSplitPasses(b *testing.B) {
+	var source []byte
+	for _, name := range []string{"encode.go", "decode.go", "writer.go", "reader.go", "metablock.go"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		source = append(source, data...)
+	}
+
+	for _, passes := range []int{1, 3, 10, 30, 100} {
+		options := WriterOptions{Quality: BestCompression, BlockSplitPasses: passes}
+		encoded, err := Encode(source, options)
+		if err != nil {
+			b.Fatal(err)
+		}
+		w := NewWriterOptions(ioutil.Discard, options)
+		b.Run(fmt.Sprint("passes=", passes), func(b *testing.B) {
+			b.ReportMetric(float64(len(encoded)), "bytes")
+			b.SetBytes(int64(len(source)))
+			for i := 0; i < b.N; i++ {
+				w.Reset(ioutil.Discard)
+				w.Write(source)
+				w.Close()
+			}
+		})
+	}
+}
+
+func TestWriterBlockSplitPasses(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RoundTrip(opticks[:100000], WriterOptions{Quality: 9, BlockSplitPasses: 10}); err != nil {
+		t.Error(err)
+	}
+	for _, passes := range []int{-1, 101} {
+		if err := checkOptions(WriterOptions{BlockSplitPasses: passes}); err != errInvalidBlockSplitPasses {
+			t.Errorf("checkOptions(BlockSplitPasses: %d) = %v, want %v", passes, err, errInvalidBlockSplitPasses)
+		}
+	}
+}
+
+func TestWriterExtraOptimize(t *testing.T) {
+	content := bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 100)
+	if err := RoundTrip(content, WriterOptions{Quality: BestCompression, ExtraOptimize: true}); err != nil {
+		t.Error(err)
+	}
+}
+
+// fakeCompressor records the calls made to it instead of compressing.
+type fakeCompressor struct {
+	dst     io.Writer
+	written bytes.Buffer
+	flushes int
+	closed  bool
+}
+
+func (c *fakeCompressor) Write(p []byte) (int, error) { return c.written.Write(p) }
+func (c *fakeCompressor) Flush() error                { c.flushes++; return nil }
+func (c *fakeCompressor) Close() error                { c.closed = true; return nil }
+func (c *fakeCompressor) Reset(dst io.Writer)         { *c = fakeCompressor{dst: dst} }
+
+func TestCompressorInterface(t *testing.T) {
+	// writeMessages is the kind of code that benefits from accepting a
+	// Compressor rather than a *Writer.
+	writeMessages := func(c Compressor, dst io.Writer, messages []string) error {
+		c.Reset(dst)
+		for _, m := range messages {
+			if _, err := io.WriteString(c, m); err != nil {
+				return err
+			}
+			if err := c.Flush(); err != nil {
+				return err
+			}
+		}
+		return c.Close()
+	}
+	messages := []string{"first", "second", "third"}
+
+	fake := new(fakeCompressor)
+	if err := writeMessages(fake, ioutil.Discard, messages); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.written.String(); got != "firstsecondthird" || fake.flushes != 3 || !fake.closed {
+		t.Errorf("fake compressor got %q, %d flushes, closed=%v", got, fake.flushes, fake.closed)
+	}
+
+	var out bytes.Buffer
+	if err := writeMessages(NewWriter(nil), &out, messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCompressedData(out.Bytes(), []byte("firstsecondthird")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterAutoFlushBytes(t *testing.T) {
+	const flushBytes = 1000
+	input := make([]byte, 5500)
+	rand.New(rand.NewSource(0)).Read(input)
+	var out bytes.Buffer
+	w := NewWriterOptions(&out, WriterOptions{Quality: 5, AutoFlushBytes: flushBytes})
+
+	// Write in pieces that don't line up with the flush boundaries.
+	for written := 0; written < len(input); {
+		end := written + 700
+		if end > len(input) {
+			end = len(input)
+		}
+		if _, err := w.Write(input[written:end]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		written = end
+
+		// Everything up to the last boundary must be decodable already.
+		boundary := written / flushBytes * flushBytes
+		got := make([]byte, boundary)
+		if _, err := io.ReadFull(NewReader(bytes.NewReader(out.Bytes())), got); err != nil {
+			t.Fatalf("after writing %d bytes: reading %d bytes from %d bytes of output: %v", written, boundary, out.Len(), err)
+		}
+		if !bytes.Equal(got, input[:boundary]) {
+			t.Fatalf("after writing %d bytes: decoded output doesn't match input", written)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := checkCompressedData(out.Bytes(), input); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterRatio(t *testing.T) {
+	content := bytes.Repeat([]byte("hello world!"), 10000)
+	var out bytes.Buffer
+	w := NewWriterOptions(&out, WriterOptions{Quality: 5})
+	if r := w.Ratio(); r != 0 {
+		t.Errorf("Ratio() before writing = %v, want 0", r)
+	}
+	w.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	want := float64(out.Len()) / float64(len(content))
+	if r := w.Ratio(); r != want || r > 0.01 {
+		t.Errorf("Ratio() = %v, want %v (and < 0.01)", r, want)
+	}
+}
+
+// slowReaderAt counts calls to ReadAt, and delays each of them as if it were
+// a request to a remote object store.
+type slowReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (s *slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.reads++
+	time.Sleep(time.Millisecond)
+	return s.r.ReadAt(p, off)
+}
+
+func TestNewReaderAt(t *testing.T) {
+	input := make([]byte, 500000)
+	rand.New(rand.NewSource(0)).Read(input)
+	encoded, _ := Encode(input, WriterOptions{Quality: 5})
+
+	plain := &slowReaderAt{r: bytes.NewReader(encoded)}
+	if _, err := ioutil.ReadAll(NewReader(io.NewSectionReader(plain, 0, int64(len(encoded))))); err != nil {
+		t.Fatalf("ReadAll from NewReader: %v", err)
+	}
+
+	prefetching := &slowReaderAt{r: bytes.NewReader(encoded)}
+	decoded, err := ioutil.ReadAll(NewReaderAt(prefetching, int64(len(encoded)), 256<<10))
+	if err != nil {
+		t.Fatalf("ReadAll from NewReaderAt: %v", err)
+	}
+	if !bytes.Equal(decoded, input) {
+		t.Fatal("NewReaderAt: decoded output doesn't match input")
+	}
+	if prefetching.reads >= plain.reads {
+		t.Errorf("NewReaderAt made %d calls to ReadAt; NewReader made %d", prefetching.reads, plain.reads)
+	}
+}
+
+func TestWriterCompactEnd(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(0)).Read(random)
+	for _, input := range [][]byte{[]byte("A"), []byte("hello"), random} {
+		for _, level := range []int{2, 5, 11} {
+			encoded, err := Encode(input, WriterOptions{Quality: level, LGWin: 22, CompactEnd: true})
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if err := checkCompressedData(encoded, input); err != nil {
+				t.Errorf("level %d, %d bytes: %v", level, len(input), err)
+			}
+			// LGWin 22 is encoded in 4 bits; the next bit is ISLAST
+			// for the first (and only) metablock.
+			if encoded[0]&0x10 == 0 {
+				t.Errorf("level %d, %d bytes: first metablock is not the last one: % x", level, len(input), encoded)
+			}
+		}
+	}
+}
+
+func TestChunkedFramed(t *testing.T) {
+	const chunkSize = 1000
+	input := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100))
+
+	var framed bytes.Buffer
+	fw := NewChunkedFramedWriter(&framed, chunkSize, WriterOptions{Quality: 5})
+	if _, err := fw.Write(input); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	decoded, err := ioutil.ReadAll(NewChunkedFramedReader(bytes.NewReader(framed.Bytes())))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(decoded, input) {
+		t.Fatalf("decoded %d bytes, want %d", len(decoded), len(input))
+	}
+
+	// Find the third and fifth records and corrupt their compressed data.
+	data := framed.Bytes()
+	var offsets []int
+	offset := 0
+	for i := 0; i < 5; i++ {
+		offsets = append(offsets, offset)
+		offset += 12 + int(binary.BigEndian.Uint32(data[offset:]))
+	}
+	offset = offsets[2]
+	corrupt := append([]byte(nil), data...)
+	corrupt[offsets[2]+14] ^= 0x55
+	corrupt[offsets[4]+14] ^= 0x55
+
+	decoded, err = ioutil.ReadAll(NewChunkedFramedReader(bytes.NewReader(corrupt)))
+	chunkErr, ok := err.(*ChunkError)
+	if !ok {
+		t.Fatalf("ReadAll returned %v, want a *ChunkError", err)
+	}
+	if chunkErr.Offset != int64(offset) || chunkErr.DataOffset != 2*chunkSize {
+		t.Errorf("error at offset %d (data offset %d), want %d (%d)", chunkErr.Offset, chunkErr.DataOffset, offset, 2*chunkSize)
+	}
+	if !bytes.Equal(decoded, input[:2*chunkSize]) {
+		t.Errorf("got %d bytes before the error, want %d", len(decoded), 2*chunkSize)
+	}
+
+	// After skipping the corrupt chunk, the later ones still decode.
+	fr := NewChunkedFramedReader(bytes.NewReader(corrupt))
+	if err := fr.SkipChunk(); err == nil {
+		t.Error("SkipChunk succeeded before any error")
+	}
+	decoded = nil
+	var skipped, skippedData []int64
+	for {
+		buf := make([]byte, 512)
+		n, err := fr.Read(buf)
+		decoded = append(decoded, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if chunkErr, ok := err.(*ChunkError); ok {
+			skipped = append(skipped, chunkErr.Offset)
+			skippedData = append(skippedData, chunkErr.DataOffset)
+			if err := fr.SkipChunk(); err != nil {
+				t.Fatalf("SkipChunk: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(skipped) != fmt.Sprint([]int{offsets[2], offsets[4]}) {
+		t.Errorf("skipped chunks at %v, want %v", skipped, []int{offsets[2], offsets[4]})
+	}
+	// The second skipped chunk's data offset still counts the first one.
+	if fmt.Sprint(skippedData) != fmt.Sprint([]int{2 * chunkSize, 4 * chunkSize}) {
+		t.Errorf("skipped chunks at data offsets %v, want %v", skippedData, []int{2 * chunkSize, 4 * chunkSize})
+	}
+	want := append(append([]byte(nil), input[:2*chunkSize]...), input[3*chunkSize:4*chunkSize]...)
+	if !bytes.Equal(decoded, want) {
+		t.Errorf("got %d bytes around the skipped chunk, want %d", len(decoded), len(want))
+	}
+
+	fr = NewChunkedFramedReader(bytes.NewReader(data[:len(data)-1]))
+	_, err = ioutil.ReadAll(fr)
+	if _, ok := err.(*ChunkError); !ok {
+		t.Errorf("truncated stream: got %v, want a *ChunkError", err)
+	}
+	if skipErr := fr.SkipChunk(); skipErr != err {
+		t.Errorf("SkipChunk after a truncated chunk returned %v, want %v", skipErr, err)
+	}
+}
+
+func TestTranscodeGzip(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(input)
+	zw.Close()
+
+	var out bytes.Buffer
+	if err := TranscodeGzip(&out, bytes.NewReader(gz.Bytes()), WriterOptions{Quality: 5}); err != nil {
+		t.Fatalf("TranscodeGzip: %v", err)
+	}
+	if err := checkCompressedData(out.Bytes(), input); err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated gzip stream should be reported as a gzip problem.
+	err = TranscodeGzip(ioutil.Discard, bytes.NewReader(gz.Bytes()[:gz.Len()/2]), WriterOptions{Quality: 5})
+	if _, ok := err.(*GzipError); !ok {
+		t.Errorf("truncated input: got %v, want a *GzipError", err)
+	}
+
+	// Output errors are passed through unchanged.
+	err = TranscodeGzip(errorWriter{}, bytes.NewReader(gz.Bytes()), WriterOptions{Quality: 5})
+	if err != errWriteFailed {
+		t.Errorf("failing output: got %v, want %v", err, errWriteFailed)
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+type errorWriter struct{}
+
+func (errorWriter) Write(p []byte) (int, error) { return 0, errWriteFailed }
+
+type errorReader struct{}
+
+var errReadFailed = errors.New("read failed")
+
+func (errorReader) Read(p []byte) (int, error) { return 0, errReadFailed }
+
+func TestWriterReuseEntropyCodes(t *testing.T) {
+	messages := make([][]byte, 50)
+	rnd := rand.New(rand.NewSource(0))
+	for i := range messages {
+		var buf bytes.Buffer
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&buf, `{"id":%d,"user":"u%d","score":%d,"tags":["a%d","b%d"]}`+"\n", rnd.Intn(100000), rnd.Intn(1000), rnd.Intn(100), rnd.Intn(10), rnd.Intn(10))
+		}
+		messages[i] = buf.Bytes()
+	}
+
+	total := func(reuse bool) int {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, WriterOptions{Quality: 0, ReuseEntropyCodes: reuse})
+		n := 0
+		for _, m := range messages {
+			buf.Reset()
+			w.Reset(&buf)
+			w.Write(m)
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			// Each stream must still decode on its own.
+			if err := checkCompressedData(buf.Bytes(), m); err != nil {
+				t.Fatal(err)
+			}
+			n += buf.Len()
+		}
+		return n
+	}
+
+	without, with := total(false), total(true)
+	t.Logf("%d bytes without reuse, %d bytes with reuse", without, with)
+	if with >= without {
+		t.Errorf("reusing entropy codes didn't help: %d bytes, vs %d without", with, without)
+	}
+}
+
+// streamWindowBits returns the LGWin declared in the header of a brotli
+// stream.
+func streamWindowBits(encoded []byte) int {
+	b := uint(encoded[0]) | uint(encoded[1])<<8
+	if b&1 == 0 {
+		return 16
+	}
+	if n := b >> 1 & 7; n != 0 {
+		return 17 + int(n)
+	}
+	if m := b >> 4 & 7; m != 0 {
+		return 8 + int(m)
+	}
+	return 17
+}
+
+func TestWriterAutoWindow(t *testing.T) {
+	for _, test := range []struct {
+		size  int
+		auto  bool
+		flush bool
+		want  int
+	}{
+		{0, true, false, 10},
+		{100, true, false, 10},
+		{1<<10 - 16, true, false, 10},
+		{1<<10 - 15, true, false, 11},
+		{100000, true, false, 17},
+		{3 << 20, true, false, 22},
+		// Flushing commits to the default window before the end is known.
+		{100, true, true, 22},
+		// Without AutoWindow, the default window is used.
+		{100, false, false, 22},
+		{100000, false, false, 22},
+	} {
+		input := make([]byte, test.size)
+		rand.New(rand.NewSource(0)).Read(input)
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, WriterOptions{Quality: 5, AutoWindow: test.auto})
+		w.Write(input)
+		if test.flush {
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if got := streamWindowBits(buf.Bytes()); got != test.want {
+			t.Errorf("%d bytes (auto=%v, flush=%v): LGWin %d, want %d", test.size, test.auto, test.flush, got, test.want)
+		}
+		if err := checkCompressedData(buf.Bytes(), input); err != nil {
+			t.Errorf("%d bytes: %v", test.size, err)
+		}
+	}
+}
+
+func TestReaderTimeout(t *testing.T) {
+	// A small stream that expands enormously is the kind of input that
+	// Timeout defends against.
+	var encoded bytes.Buffer
+	w := NewWriterOptions(&encoded, WriterOptions{Quality: 1})
+	zeros := make([]byte, 1<<20)
+	for i := 0; i < 256; i++ {
+		w.Write(zeros)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r := NewReaderOptions(bytes.NewReader(encoded.Bytes()), ReaderOptions{Timeout: 10 * time.Millisecond})
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != ErrTimeout {
+		t.Fatalf("Copy returned %v after %d bytes, want ErrTimeout", err, n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("decoding took %v to time out", elapsed)
+	}
+
+	// With a generous deadline, the stream decodes fine.
+	r = NewReaderOptions(bytes.NewReader(encoded.Bytes()), ReaderOptions{Timeout: time.Minute})
+	if n, err := io.Copy(ioutil.Discard, r); err != nil || n != 256<<20 {
+		t.Errorf("Copy = %d, %v; want %d, nil", n, err, 256<<20)
+	}
+}
+
+func TestOptionsBuilder(t *testing.T) {
+	got, err := Options().Quality(9).Window(22).Mode(ModeText).Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if want := (WriterOptions{Quality: 9, LGWin: 22, Mode: ModeText}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Build() = %+v, want %+v", got, want)
+	}
+
+	for _, b := range []*OptionsBuilder{
+		Options().Quality(12),
+		Options().Window(9),
+		Options().Mode(Mode(3)),
+	} {
+		if _, err := b.Build(); err == nil {
+			t.Errorf("Build succeeded with invalid options %+v", b.options)
+		}
+	}
+}
+
+func TestWriterEmitSizeHint(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []WriterOptions{
+		{Quality: 5, EmitSizeHint: true},
+		{Quality: 1, LGWin: 22, EmitSizeHint: true},
+		{Quality: 5, EmitSizeHint: true, AbortIfLarger: true},
+	} {
+		encoded, err := Encode(input, options)
+		if err != nil {
+			t.Fatalf("%+v: Encode: %v", options, err)
+		}
+
+		r := NewReader(bytes.NewReader(encoded))
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("%+v: Read: %v", options, err)
+		}
+		if size, ok := r.SizeHint(); !ok || size != int64(len(input)) {
+			t.Errorf("%+v: SizeHint() = %d, %v; want %d, true", options, size, ok, len(input))
+		}
+
+		decoded, err := DecodeInto(nil, encoded)
+		if err != nil {
+			t.Fatalf("%+v: DecodeInto: %v", options, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("%+v: DecodeInto output doesn't match input", options)
+		}
+		if cap(decoded) != len(input) {
+			t.Errorf("%+v: DecodeInto allocated %d bytes, want exactly %d", options, cap(decoded), len(input))
+		}
+	}
+
+	// Without EmitSizeHint, there is no size hint.
+	encoded, _ := Encode(input, WriterOptions{Quality: 5})
+	r := NewReader(bytes.NewReader(encoded))
+	r.Read(make([]byte, 1))
+	if _, ok := r.SizeHint(); ok {
+		t.Error("SizeHint reported a size for a stream without a size hint")
+	}
+}
+
+func TestWriterGrowWindow(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := bytes.Repeat(opticks, 6)
+
+	for _, options := range []WriterOptions{
+		{Quality: 5, GrowWindow: true},
+		{Quality: 0, GrowWindow: true, LGWin: 20},
+	} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, options)
+		// Write in small pieces, as from a stream of unknown length.
+		for data := input; len(data) > 0; {
+			n := 10000
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				t.Fatalf("%+v: Write: %v", options, err)
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%+v: Close: %v", options, err)
+		}
+		encoded := buf.Bytes()
+
+		if got := streamWindowBits(encoded); options.Quality >= 2 && got != growWindowStart {
+			t.Errorf("%+v: first stream has LGWin %d, want %d", options, got, growWindowStart)
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Multistream: true}))
+		if err != nil {
+			t.Fatalf("%+v: ReadAll: %v", options, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("%+v: decoded %d bytes, which don't match the %d bytes of input", options, len(decoded), len(input))
+		}
+		if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(encoded))); err != errExcessiveInput {
+			t.Errorf("%+v: single-stream Reader returned %v, want %v", options, err, errExcessiveInput)
+		}
+	}
+}
+
+func TestDecodePrefix(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input = bytes.Repeat(input, 4)
+	encoded, _ := Encode(input, WriterOptions{Quality: 5})
+
+	prefix, err := DecodePrefix(encoded, 1024)
+	if err != nil {
+		t.Fatalf("DecodePrefix: %v", err)
+	}
+	if !bytes.Equal(prefix, input[:1024]) {
+		t.Errorf("DecodePrefix returned %d bytes that don't match the start of the input", len(prefix))
+	}
+
+	// Everything after what's needed for the prefix is ignored.
+	truncated := encoded[:len(encoded)/2]
+	if prefix, err := DecodePrefix(truncated, 1024); err != nil || !bytes.Equal(prefix, input[:1024]) {
+		t.Errorf("DecodePrefix of a truncated stream: %d bytes, %v", len(prefix), err)
+	}
+
+	// Asking for more than there is returns the whole stream.
+	small, _ := Encode([]byte("hello"), WriterOptions{Quality: 5})
+	if got, err := DecodePrefix(small, 1024); err != nil || string(got) != "hello" {
+		t.Errorf("DecodePrefix(small, 1024) = %q, %v; want \"hello\", nil", got, err)
+	}
+	if _, err := DecodePrefix(small[:len(small)-1], 1024); err != io.ErrUnexpectedEOF {
+		t.Errorf("DecodePrefix of a truncated small stream: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func BenchmarkDecodePrefix(b *testing.B) {
+	input, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	encoded, _ := Encode(input, WriterOptions{Quality: 5})
+	b.Run("Prefix", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			DecodePrefix(encoded, 1024)
+		}
+	})
+	b.Run("Full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			DecodeInto(nil, encoded)
+		}
+	})
+}
+
+func TestReaderLogger(t *testing.T) {
+	// Random data is stored uncompressed.
+	input := make([]byte, 10000)
+	rand.New(rand.NewSource(0)).Read(input)
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 5, LGWin: 16})
+	w.Write(input)
+	w.Flush()
+	w.Close()
+
+	var events []string
+	r := NewReaderOptions(&buf, ReaderOptions{Logger: func(event string) {
+		events = append(events, event)
+	}})
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	for _, want := range []string{
+		"window: 16 bits",
+		"uncompressed metablock: 10000 bytes",
+		"empty metablock",
+	} {
+		found := false
+		for _, e := range events {
+			found = found || e == want
+		}
+		if !found {
+			t.Errorf("missing event %q; got %q", want, events)
+		}
+	}
+}
+
+func TestEncodeWithInfo(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, test := range []struct {
+		name    string
+		content []byte
+		options WriterOptions
+		lgwin   int
+		stored  bool
+	}{
+		{"auto window", opticks[:20000], WriterOptions{Quality: 5}, 15, false},
+		{"fixed window", opticks, WriterOptions{Quality: 5, LGWin: 20}, 20, false},
+		{"fast", opticks[:20000], WriterOptions{Quality: 1}, 18, false},
+		{"fastest", opticks[:20000], WriterOptions{Quality: 0}, 18, false},
+		{"random", random, WriterOptions{Quality: 5}, 13, true},
+		{"random fast", random, WriterOptions{Quality: 1}, 18, true},
+		{"random fastest", random, WriterOptions{Quality: 0}, 18, true},
+		{"stored preferred", opticks[:20000], WriterOptions{Quality: 5, StoredPreferred: true}, 10, true},
+	} {
+		encoded, info, err := EncodeWithInfo(test.content, test.options)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := checkCompressedData(encoded, test.content); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if info.LGWin != test.lgwin {
+			t.Errorf("%s: LGWin = %d, want %d", test.name, info.LGWin, test.lgwin)
+		}
+		if got := streamWindowBits(encoded); got != info.LGWin {
+			t.Errorf("%s: stream has a window of %d bits, EncodeWithInfo reports %d", test.name, got, info.LGWin)
+		}
+		if info.Metablocks < 1 {
+			t.Errorf("%s: Metablocks = %d", test.name, info.Metablocks)
+		}
+		if info.Stored != test.stored {
+			t.Errorf("%s: Stored = %v, want %v", test.name, info.Stored, test.stored)
+		}
+	}
+
+	_, info, err := EncodeWithInfo(opticks, WriterOptions{Quality: 5, LGWin: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metablocks < 2 {
+		t.Errorf("%d bytes with a 64 KiB window: Metablocks = %d", len(opticks), info.Metablocks)
+	}
+	_, info, err = EncodeWithInfo(opticks, WriterOptions{Quality: 5, LGWin: 16, StoredPreferred: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metablocks < 2 || !info.Stored {
+		t.Errorf("%d bytes stored with a 64 KiB window: Metablocks = %d, Stored = %v", len(opticks), info.Metablocks, info.Stored)
+	}
+}
+
+func TestReaderExpectedSize(t *testing.T) {
+	content := bytes.Repeat([]byte("expected size "), 1000)
+	compressed, err := Encode(content, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		expected int64
+		err      error
+	}{
+		{int64(len(content)), nil},
+		{int64(len(content)) + 1, ErrSizeMismatch},
+		{int64(len(content)) - 1, ErrSizeMismatch},
+	} {
+		r := NewReaderOptions(bytes.NewReader(compressed), ReaderOptions{ExpectedSize: test.expected})
+		decoded, err := ioutil.ReadAll(r)
+		if err != test.err {
+			t.Errorf("ExpectedSize %d: got error %v, want %v", test.expected, err, test.err)
+		}
+		if test.err == nil && !bytes.Equal(decoded, content) {
+			t.Errorf("ExpectedSize %d: output doesn't match", test.expected)
+		}
+		if test.expected < int64(len(content)) && int64(len(decoded)) > test.expected+readBufSize {
+			t.Errorf("ExpectedSize %d: read %d bytes before failing", test.expected, len(decoded))
+		}
+	}
+
+	// A truncated stream falls short, too.
+	r := NewReaderOptions(bytes.NewReader(compressed[:len(compressed)/2]), ReaderOptions{ExpectedSize: int64(len(content))})
+	if _, err := ioutil.ReadAll(r); err != ErrSizeMismatch && err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got error %v, want ErrSizeMismatch", err)
+	}
+}
+
+func TestWriterMaxMetablockSize(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const max = 10000
+	for _, quality := range []int{0, 1, 5, 9, 11} {
+		encoded, err := Encode(content, WriterOptions{Quality: quality, MaxMetablockSize: max})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		total := 0
+		r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Logger: func(event string) {
+			var kind string
+			var size int
+			if _, err := fmt.Sscanf(event, "%s metablock: %d bytes", &kind, &size); err != nil || kind == "metadata" {
+				return
+			}
+			total += size
+			if size > max {
+				t.Errorf("quality %d: %s", quality, event)
+			}
+		}})
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, content) {
+			t.Fatalf("quality %d: decoded output doesn't match", quality)
+		}
+		if total != len(content) {
+			t.Errorf("quality %d: metablocks add up to %d bytes, want %d", quality, total, len(content))
+		}
+	}
+
+	if err := checkOptions(WriterOptions{MaxMetablockSize: 1<<24 + 1}); err != errInvalidMaxMetablockSize {
+		t.Errorf("checkOptions(MaxMetablockSize: 1<<24 + 1) = %v, want %v", err, errInvalidMaxMetablockSize)
+	}
+}
+
+func TestDeltaWriter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// Each message is a snapshot of 100 random readings, a few of which
+	// change from one message to the next.
+	readings := make([]uint32, 100)
+	for i := range readings {
+		readings[i] = rnd.Uint32()
+	}
+	var messages [][]byte
+	for i := 0; i < 20; i++ {
+		readings[rnd.Intn(len(readings))] = rnd.Uint32()
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "sample %d\n", i)
+		for sensor, v := range readings {
+			fmt.Fprintf(&sb, "probe-%02d=%08x\n", sensor, v)
+		}
+		messages = append(messages, []byte(sb.String()))
+	}
+
+	options := WriterOptions{Quality: 9}
+	var encoded [][]byte
+	var deltaSize, plainSize int
+	dw := NewDeltaWriter(nil, 0, options)
+	for _, msg := range messages {
+		var buf bytes.Buffer
+		dw.Reset(&buf)
+		if _, err := dw.Write(msg); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := dw.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		encoded = append(encoded, buf.Bytes())
+		deltaSize += buf.Len()
+
+		plain, err := Encode(msg, options)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		plainSize += len(plain)
+	}
+	t.Logf("%d messages: %d bytes with DeltaWriter, %d bytes without", len(messages), deltaSize, plainSize)
+	if deltaSize*4 > plainSize {
+		t.Errorf("DeltaWriter output is %d bytes, want less than a quarter of %d", deltaSize, plainSize)
+	}
+
+	dr := NewDeltaReader(bytes.NewReader(encoded[0]), 0, ReaderOptions{})
+	for i, msg := range messages {
+		if i > 0 {
+			if err := dr.Reset(bytes.NewReader(encoded[i])); err != nil {
+				t.Fatalf("Reset: %v", err)
+			}
+		}
+		got, err := ioutil.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("message %d: got %q, want %q", i, got, msg)
+		}
+	}
+
+	// Without the history, a later message doesn't decode.
+	if got, err := Decode(encoded[5]); err == nil && bytes.Equal(got, messages[5]) {
+		t.Errorf("message decoded without its dictionary")
+	}
+}
+
+func TestPrepareDictionaryHashBits(t *testing.T) {
+	// A 1 MiB dictionary of 64-byte records, and a message made of records
+	// picked from all over it.
+	const recordSize = 64
+	rnd := rand.New(rand.NewSource(1))
+	dict := make([]byte, 1<<20)
+	rnd.Read(dict)
+	var message []byte
+	for i := 0; i < 500; i++ {
+		offset := rnd.Intn(len(dict)/recordSize) * recordSize
+		message = append(message, dict[offset:offset+recordSize]...)
+	}
+
+	compressedSize := func(hashBits int) int {
+		prepared, err := PrepareDictionary(dict, PrepareDictionaryOptions{HashBits: hashBits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := Encode(message, WriterOptions{Quality: 5, PreparedDictionary: prepared})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionary: dict}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, message) {
+			t.Fatalf("HashBits %d: decoded output doesn't match", hashBits)
+		}
+		return len(encoded)
+	}
+
+	small, auto, large := compressedSize(10), compressedSize(0), compressedSize(18)
+	t.Logf("HashBits 10: %d bytes, auto: %d bytes, 18: %d bytes (of %d)", small, auto, large, len(message))
+	if large >= small {
+		t.Errorf("a larger hash table didn't help: %d bytes with HashBits 18, %d with 10", large, small)
+	}
+	if auto >= small {
+		t.Errorf("the automatic hash table size didn't help: %d bytes, %d with HashBits 10", auto, small)
+	}
+
+	if _, err := PrepareDictionary(dict, PrepareDictionaryOptions{HashBits: 30}); err == nil {
+		t.Error("PrepareDictionary accepted HashBits 30")
+	}
+}
+
+func TestPreparedDictionaryWarm(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := opticks[:300000]
+	messages := [][]byte{opticks[50000:60000], opticks[250000:290000]}
+
+	for _, options := range []WriterOptions{
+		{Quality: 1, LGWin: 22},
+		{Quality: 5, LGWin: 22},
+		{Quality: 7, LGWin: 18},
+		{Quality: 9, LGWin: 22},
+		{Quality: 10, LGWin: 20},
+		{Quality: 11, LGWin: 22},
+	} {
+		cold, err := PrepareDictionary(dict, PrepareDictionaryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		warm, err := PrepareDictionary(dict, PrepareDictionaryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		warm.Warm(options)
+		if want := options.Quality >= 5; (len(warm.warm) > 0) != want {
+			t.Errorf("quality %d: %d warm tables", options.Quality, len(warm.warm))
+		}
+
+		coldOptions, warmOptions := options, options
+		coldOptions.PreparedDictionary = cold
+		warmOptions.PreparedDictionary = warm
+		var coldBuf, warmBuf bytes.Buffer
+		cw := NewWriterOptions(&coldBuf, coldOptions)
+		ww := NewWriterOptions(&warmBuf, warmOptions)
+		// The second message is compressed after a Reset, into a hash table
+		// that already holds the first one.
+		for _, message := range messages {
+			coldBuf.Reset()
+			warmBuf.Reset()
+			for _, w := range []*Writer{cw, ww} {
+				if _, err := w.Write(message); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(warmBuf.Bytes(), coldBuf.Bytes()) {
+				t.Errorf("quality %d: %d bytes with a warm dictionary, %d without", options.Quality, warmBuf.Len(), coldBuf.Len())
+			}
+			decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(warmBuf.Bytes()), ReaderOptions{Dictionary: dict}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, message) {
+				t.Errorf("quality %d: decoded output doesn't match", options.Quality)
+			}
+			cw.Reset(&coldBuf)
+			ww.Reset(&warmBuf)
+		}
+	}
+}
+
+func BenchmarkPreparedDictionaryWarm(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	dict, message := opticks[:500000], opticks[100000:101000]
+	for _, quality := range []int{5, 9, 11} {
+		for _, warm := range []bool{false, true} {
+			name := fmt.Sprintf("q%d/cold", quality)
+			if warm {
+				name = fmt.Sprintf("q%d/warm", quality)
+			}
+			b.Run(name, func(b *testing.B) {
+				prepared, err := PrepareDictionary(dict, PrepareDictionaryOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				options := WriterOptions{Quality: quality, LGWin: 22, PreparedDictionary: prepared}
+				if warm {
+					prepared.Warm(options)
+				}
+				w := NewWriterOptions(ioutil.Discard, options)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					w.Reset(ioutil.Discard)
+					if _, err := w.Write(message); err != nil {
+						b.Fatal(err)
+					}
+					if err := w.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPrepareDictionaryReader(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, message := opticks[:100000], opticks[50000:60000]
+
+	for _, src := range []io.Reader{bytes.NewReader(dict), iotest.OneByteReader(bytes.NewReader(dict))} {
+		prepared, err := PrepareDictionaryReader(src, PrepareDictionaryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(prepared.data, dict) {
+			t.Fatalf("PrepareDictionaryReader read %d bytes, want the %d-byte dictionary", len(prepared.data), len(dict))
+		}
+		encoded, err := Encode(message, WriterOptions{Quality: 5, PreparedDictionary: prepared})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) > 100 {
+			t.Errorf("message compressed to %d bytes with the dictionary", len(encoded))
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionary: dict}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, message) {
+			t.Error("decoded output doesn't match")
+		}
+	}
+}
+
+func TestWriterResetKeepsPreparedDictionary(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, message := opticks[:100000], opticks[50000:60000]
+	prepared, err := PrepareDictionary(dict, PrepareDictionaryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := Encode(message, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first, second bytes.Buffer
+	w := NewWriterOptions(&first, WriterOptions{Quality: 5, PreparedDictionary: prepared})
+	for _, buf := range []*bytes.Buffer{&first, &second} {
+		w.Reset(buf)
+		if _, err := w.Write(message); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() > len(plain)/10 {
+			t.Errorf("%d bytes with the dictionary, %d without", buf.Len(), len(plain))
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(buf.Bytes()), ReaderOptions{Dictionary: dict}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, message) {
+			t.Error("decoded output doesn't match")
+		}
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("output changed after Reset")
+	}
+}
+
+func TestStackedDictionaries(t *testing.T) {
+	// A message made of records from a global dictionary and a tenant's
+	// dictionary.
+	const recordSize = 32
+	rnd := rand.New(rand.NewSource(2))
+	global := make([]byte, 16<<10)
+	rnd.Read(global)
+	tenant := make([]byte, 16<<10)
+	rnd.Read(tenant)
+	var message []byte
+	for i := 0; i < 200; i++ {
+		src := global
+		if i%2 == 1 {
+			src = tenant
+		}
+		offset := rnd.Intn(len(src)/recordSize) * recordSize
+		message = append(message, src[offset:offset+recordSize]...)
+	}
+
+	prepare := func(data []byte) *PreparedDictionary {
+		d, err := PrepareDictionary(data, PrepareDictionaryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	compressedSize := func(dicts ...[]byte) int {
+		var prepared []*PreparedDictionary
+		for _, d := range dicts {
+			prepared = append(prepared, prepare(d))
+		}
+		encoded, err := Encode(message, WriterOptions{Quality: 9, Dictionaries: prepared})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionaries: dicts}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, message) {
+			t.Fatalf("decoded output doesn't match with %d dictionaries", len(dicts))
+		}
+		return len(encoded)
+	}
+
+	globalOnly, tenantOnly, both := compressedSize(global), compressedSize(tenant), compressedSize(global, tenant)
+	t.Logf("global: %d bytes, tenant: %d bytes, both: %d bytes (of %d)", globalOnly, tenantOnly, both, len(message))
+	if both >= globalOnly || both >= tenantOnly {
+		t.Errorf("stacking the dictionaries didn't help: %d bytes, vs. %d and %d with one", both, globalOnly, tenantOnly)
+	}
+}
+
+func TestReplaceBuiltinDictionary(t *testing.T) {
+	// Eight 12-byte words.
+	words := []string{
+		"temperature=", "humidity====", "pressure====", "windspeed===",
+		"winddirectn=", "rainfall====", "visibility==", "cloudcover==",
+	}
+	dict := make([]byte, 21)
+	dict[12-4] = 3
+	for _, w := range words {
+		dict = append(dict, w...)
+	}
+
+	var sb strings.Builder
+	for i, w := range words {
+		fmt.Fprintf(&sb, "%s%d;", w, i*37)
+	}
+	input := []byte(sb.String())
+
+	options := WriterOptions{Quality: 11, ReplaceBuiltinDictionary: dict}
+	encoded, err := Encode(input, options)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	standard, err := Encode(input, WriterOptions{Quality: 11})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(encoded) >= len(standard) {
+		t.Errorf("with the replaced dictionary, compressed size is %d; want less than %d", len(encoded), len(standard))
+	}
+
+	decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{ReplaceBuiltinDictionary: dict}))
+	if err != nil || !bytes.Equal(decoded, input) {
+		t.Errorf("decoding with the replaced dictionary: got %q, %v; want %q", decoded, err, input)
+	}
+
+	other := append([]byte(nil), dict...)
+	copy(other[21:], "TEMPERATURE:")
+	for _, ro := range []ReaderOptions{{}, {ReplaceBuiltinDictionary: other}} {
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ro))
+		if err == nil && bytes.Equal(decoded, input) {
+			t.Errorf("stream decoded with the wrong dictionary")
+		}
+	}
+
+	// A dictionary whose length doesn't match its header is rejected.
+	bad := dict[:len(dict)-1]
+	if _, err := Encode(input, WriterOptions{ReplaceBuiltinDictionary: bad}); err != errInvalidDictionary {
+		t.Errorf("Encode with invalid dictionary: got %v, want %v", err, errInvalidDictionary)
+	}
+	if _, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{ReplaceBuiltinDictionary: bad})); err != errInvalidDictionary {
+		t.Errorf("Read with invalid dictionary: got %v, want %v", err, errInvalidDictionary)
+	}
+}
+
+func TestSelectiveWriter(t *testing.T) {
+	text := bytes.Repeat([]byte("This part is text, which compresses well. "), 100)
+	random := make([]byte, 4000)
+	rand.New(rand.NewSource(1)).Read(random)
+	parts := []struct {
+		compress bool
+		data     []byte
+	}{
+		{true, text},
+		{false, random},
+		{false, nil},
+		{true, nil},
+		{true, text[:100]},
+	}
+
+	var buf bytes.Buffer
+	sw := NewSelectiveWriter(&buf, WriterOptions{Quality: 5})
+	if _, err := sw.Write(text); err != errNoPart {
+		t.Errorf("Write outside a part: got %v, want %v", err, errNoPart)
+	}
+	for _, part := range parts {
+		if err := sw.BeginPart(part.compress); err != nil {
+			t.Fatalf("BeginPart: %v", err)
+		}
+		if _, err := sw.Write(part.data); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := sw.EndPart(); err != nil {
+			t.Fatalf("EndPart: %v", err)
+		}
+	}
+	if max := len(random) + len(parts)*partHeaderSize + 200; buf.Len() > max {
+		t.Errorf("output is %d bytes; want at most %d", buf.Len(), max)
+	}
+
+	sr := NewSelectiveReader(bytes.NewReader(buf.Bytes()))
+	for i, part := range parts {
+		compressed, err := sr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: NextPart: %v", i, err)
+		}
+		if compressed != part.compress {
+			t.Errorf("part %d: compressed = %v, want %v", i, compressed, part.compress)
+		}
+		if i == 1 {
+			// Skip the rest of a part.
+			continue
+		}
+		got, err := ioutil.ReadAll(sr)
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if !bytes.Equal(got, part.data) {
+			t.Errorf("part %d: got %d bytes, want %d", i, len(got), len(part.data))
+		}
+	}
+	if _, err := sr.NextPart(); err != io.EOF {
+		t.Errorf("NextPart at end: got %v, want io.EOF", err)
+	}
+
+	// A truncated part is reported, whether compressed or not.
+	for _, compress := range []bool{false, true} {
+		buf.Reset()
+		sw.BeginPart(compress)
+		sw.Write(random)
+		sw.EndPart()
+		sr = NewSelectiveReader(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+		if _, err := sr.NextPart(); err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		if _, err := ioutil.ReadAll(sr); err != io.ErrUnexpectedEOF {
+			t.Errorf("reading a truncated part (compress=%v): got %v, want %v", compress, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestEstimateRatio(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := Encode(opticks, WriterOptions{Quality: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := float64(len(opticks)) / float64(len(encoded))
+	if est := EstimateRatio(opticks); est < actual/1.5 || est > actual*1.5 {
+		t.Errorf("EstimateRatio(text) = %.2f; actual ratio is %.2f", est, actual)
+	}
+
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	if est := EstimateRatio(random); est > 1.05 {
+		t.Errorf("EstimateRatio(random data) = %.2f, want about 1", est)
+	}
+	if est := EstimateRatio(nil); est != 1 {
+		t.Errorf("EstimateRatio(nil) = %.2f, want 1", est)
+	}
+}
+
+func TestScoreDictionary(t *testing.T) {
+	record := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"event":"page_view","user_id":%d,"session":"s-%06d","path":"/products/%d","referrer":"https://www.example.com/search","user_agent":"Mozilla/5.0 (X11; Linux x86_64)"}`, i*7919, i*31, i%97))
+	}
+	var samples [][]byte
+	for i := 0; i < 20; i++ {
+		samples = append(samples, record(i))
+	}
+	var relevant []byte
+	for i := 100; i < 110; i++ {
+		relevant = append(relevant, record(i)...)
+	}
+	irrelevant, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	irrelevant = irrelevant[:len(relevant)]
+
+	options := WriterOptions{Quality: 9}
+	good := ScoreDictionary(relevant, samples, options)
+	bad := ScoreDictionary(irrelevant, samples, options)
+	t.Logf("relevant dictionary: %.2f, irrelevant: %.2f", good, bad)
+	if good <= bad || good < 2 {
+		t.Errorf("relevant dictionary scored %.2f, irrelevant one %.2f", good, bad)
+	}
+	if score := ScoreDictionary(relevant, nil, options); score != 1 {
+		t.Errorf("score with no samples = %.2f, want 1", score)
+	}
+}
+
+func TestNewAutoReader(t *testing.T) {
+	content := bytes.Repeat([]byte("Hello, proxy! "), 200)
+	br, err := Encode(content, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(content)
+	zw.Close()
+
+	for _, c := range []struct {
+		encoding string
+		data     []byte
+	}{
+		{"br", br},
+		{"gzip", gz.Bytes()},
+		{"x-gzip", gz.Bytes()},
+		{"identity", content},
+		{" BR ", br},
+		{"", br},
+		{"", gz.Bytes()},
+	} {
+		r, err := NewAutoReader(bytes.NewReader(c.data), c.encoding)
+		if err != nil {
+			t.Errorf("NewAutoReader(%q): %v", c.encoding, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("encoding %q: got %d bytes, %v; want %d bytes", c.encoding, len(got), err, len(content))
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("encoding %q: Close: %v", c.encoding, err)
+		}
+	}
+
+	if _, err := NewAutoReader(bytes.NewReader(content), "compress"); err == nil {
+		t.Error("no error for an unsupported encoding")
+	}
+}
+
+func TestReaderMaxReadChunk(t *testing.T) {
+	content := bytes.Repeat([]byte("A fairly compressible line of text.\n"), 100000)
+	encoded, err := Encode(content, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const max = 10000
+	r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxReadChunk: max})
+	p := make([]byte, 2*len(content))
+	var got []byte
+	for {
+		n, err := r.Read(p)
+		if n > max {
+			t.Fatalf("Read returned %d bytes; want at most %d", n, max)
+		}
+		got = append(got, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestReaderResync(t *testing.T) {
+	var segments [][]byte
+	for i := 0; i < 5; i++ {
+		var seg bytes.Buffer
+		for j := 0; j < 2000; j++ {
+			fmt.Fprintf(&seg, "segment %d, record %d: %x\n", i, j, j*j*(i+1))
+		}
+		segments = append(segments, seg.Bytes())
+	}
+
+	var encoded bytes.Buffer
+	var ends []int
+	w := NewWriterOptions(&encoded, WriterOptions{Quality: 5, AutoWindow: true})
+	for _, seg := range segments {
+		w.Reset(&encoded)
+		if _, err := w.Write(seg); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, encoded.Len())
+	}
+
+	// Damage the middle of the third stream.
+	data := encoded.Bytes()
+	mid := (ends[1] + ends[2]) / 2
+	for i := mid; i < mid+16; i++ {
+		data[i] = 0xff
+	}
+
+	r := NewReaderOptions(bytes.NewReader(data), ReaderOptions{Multistream: true})
+	var got bytes.Buffer
+	resynced := false
+	p := make([]byte, 4096)
+	for {
+		n, err := r.Read(p)
+		got.Write(p[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if resynced {
+				t.Fatalf("error after Resync: %v", err)
+			}
+			resynced = true
+			skipped, err := r.Resync()
+			if err != nil {
+				t.Fatalf("Resync: %v", err)
+			}
+			if skipped == 0 {
+				t.Error("Resync didn't skip any data")
+			}
+		}
+	}
+	if !resynced {
+		t.Fatal("the damaged stream decoded without error")
+	}
+
+	want := bytes.Join(segments[3:], nil)
+	if !bytes.HasSuffix(got.Bytes(), want) {
+		t.Errorf("recovered output doesn't end with the last two segments")
+	}
+	if !bytes.HasPrefix(got.Bytes(), bytes.Join(segments[:2], nil)) {
+		t.Errorf("recovered output doesn't start with the first two segments")
+	}
+}
+
+// recordingWriter records the size of each Write.
+type recordingWriter struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.sizes = append(rw.sizes, len(p))
+	return rw.Buffer.Write(p)
+}
+
+func TestWriterIOBufferSize(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 4096
+	var rw recordingWriter
+	w := NewWriterOptions(&rw, WriterOptions{Quality: 5, LGWin: 16, IOBufferSize: size})
+	w.Write(opticks[:len(opticks)/2])
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed := rw.Len()
+	w.Write(opticks[len(opticks)/2:])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// All writes are full-sized except the last ones before Flush and Close.
+	var total int
+	for i, n := range rw.sizes {
+		total += n
+		if n != size && total != flushed && i != len(rw.sizes)-1 {
+			t.Errorf("write %d of %d is %d bytes, want %d", i, len(rw.sizes), n, size)
+		}
+	}
+	if err := checkCompressedData(rw.Bytes(), opticks); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkReaderBufferSize(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	encoded, err := Encode(bytes.Repeat(opticks, 4), WriterOptions{Quality: 5})
+	if err != nil {
+		b.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "brotli")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(encoded); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprint("size=", size), func(b *testing.B) {
+			b.SetBytes(int64(len(opticks) * 4))
+			r := NewReaderOptions(nil, ReaderOptions{BufferSize: size})
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				r.Reset(f)
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterOnBlockHash(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(data []byte) []uint64 {
+		var hashes []uint64
+		options := WriterOptions{Quality: 5, LGWin: 16, OnBlockHash: func(i int, h uint64) {
+			if i != len(hashes) {
+				t.Errorf("block index %d, want %d", i, len(hashes))
+			}
+			hashes = append(hashes, h)
+		}}
+		w := NewWriterOptions(ioutil.Discard, options)
+		for len(data) > 0 {
+			n := 100000
+			if n > len(data) {
+				n = len(data)
+			}
+			w.Write(data[:n])
+			w.Flush()
+			data = data[n:]
+		}
+		w.Close()
+		return hashes
+	}
+
+	a := encode(opticks)
+	b := encode(opticks)
+	if len(a) < 6 {
+		t.Fatalf("got %d blocks, want at least 6", len(a))
+	}
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("block hashes differ between identical encodes:\n%x\n%x", a, b)
+	}
+
+	// Changing the end of the input leaves the hashes of the blocks before
+	// it unchanged.
+	changed := append([]byte(nil), opticks...)
+	changed[len(changed)-10] ^= 1
+	c := encode(changed)
+	if fmt.Sprint(c[:4]) != fmt.Sprint(a[:4]) || fmt.Sprint(c) == fmt.Sprint(a) {
+		t.Errorf("after changing the end of the input, got hashes\n%x\nwant the same start as\n%x", c, a)
+	}
+}
+
+func TestWriterFlushAlignment(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The alignments around 256 and 65536 need each size of metadata block.
+	for _, align := range []int{2, 3, 257, 259, 260, 512, 4096, 65539, 65541, 100000} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, WriterOptions{Quality: 5, FlushAlignment: align})
+		data := opticks
+		for n := 1; len(data) > 0; n *= 3 {
+			if n > len(data) {
+				n = len(data)
+			}
+			w.Write(data[:n])
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if buf.Len()%align != 0 {
+				t.Fatalf("align %d: after Flush, output is %d bytes", align, buf.Len())
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if err := checkCompressedData(buf.Bytes(), opticks); err != nil {
+			t.Errorf("align %d: %v", align, err)
+		}
+	}
+}
+
+func TestTeeWriter(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fast, best bytes.Buffer
+	tw := NewTeeWriter([]SinkSpec{
+		{W: &fast, Options: WriterOptions{Quality: 1}},
+		{W: &best, Options: WriterOptions{Quality: 11}},
+	})
+	for i := 0; i < len(content); i += 10000 {
+		end := i + 10000
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := tw.Write(content[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoded := range []*bytes.Buffer{&fast, &best} {
+		decoded, err := Decode(encoded.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, content) {
+			t.Fatal("decoded output doesn't match")
+		}
+	}
+	if best.Len() >= fast.Len() {
+		t.Errorf("quality 11 output (%d bytes) isn't smaller than quality 1 output (%d bytes)", best.Len(), fast.Len())
+	}
+
+	// A failing sink doesn't stop the others.
+	var good bytes.Buffer
+	tw = NewTeeWriter([]SinkSpec{
+		{W: errorWriter{}, Options: WriterOptions{Quality: 5}},
+		{W: &good, Options: WriterOptions{Quality: 5}},
+	})
+	tw.Write(content)
+	err = tw.Close()
+	teeErr, ok := err.(TeeError)
+	if !ok || teeErr[0] != errWriteFailed || teeErr[1] != nil {
+		t.Fatalf("Close returned %v; want a TeeError for sink 0 only", err)
+	}
+	if decoded, err := Decode(good.Bytes()); err != nil || !bytes.Equal(decoded, content) {
+		t.Errorf("the working sink's output doesn't decode correctly: %v", err)
+	}
+}
+
+func TestDecodeVerify(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := WriterOptions{Quality: 6, LGWin: 20}
+	encoded, err := Encode(content, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeVerify(encoded, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Error("decoded output doesn't match")
+	}
+
+	if _, err := DecodeVerify(encoded, WriterOptions{Quality: 5, LGWin: 20}); err == nil {
+		t.Error("DecodeVerify accepted a stream written with different options")
+	}
+}
+
+func TestWriterPending(t *testing.T) {
+	for _, options := range []WriterOptions{{Quality: 1}, {Quality: 5}, {Quality: 5, LGWin: 20}, {Quality: 11, LGWin: 22}} {
+		w := NewWriterOptions(ioutil.Discard, options)
+		line := []byte("Some data that has to be buffered for a while.\n")
+		last := 0
+		for i := 0; i < 100; i++ {
+			if _, err := w.Write(line); err != nil {
+				t.Fatal(err)
+			}
+			pending := w.Pending()
+			if options.Quality > 1 && pending != last+len(line) {
+				t.Fatalf("quality %d, LGWin %d: Pending is %d after writing %d more bytes; was %d", options.Quality, options.LGWin, pending, len(line), last)
+			}
+			last = pending
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if pending := w.Pending(); pending != 0 {
+			t.Errorf("quality %d, LGWin %d: Pending is %d after Flush", options.Quality, options.LGWin, pending)
+		}
+	}
+}
+
+func TestSafeDecode(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := Encode(content, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := SafeDecode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Error("decoded output doesn't match")
+	}
+
+	if _, err := SafeDecode(encoded[:len(encoded)/2]); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := SafeDecode(append(encoded[:len(encoded):len(encoded)], "trailing data"...)); err == nil {
+		t.Error("trailing data was accepted")
+	}
+
+	// A bomb: a small stream that decompresses to more than the limit.
+	bomb, err := Encode(make([]byte, SafeDecodeMaxSize+1), WriterOptions{Quality: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SafeDecode(bomb); err != ErrTooLarge {
+		t.Errorf("bomb (%d bytes): got %v, want ErrTooLarge", len(bomb), err)
+	}
+	limit, err := Encode(make([]byte, SafeDecodeMaxSize), WriterOptions{Quality: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := SafeDecode(limit); err != nil || len(decoded) != SafeDecodeMaxSize {
+		t.Errorf("output of exactly the limit: got %d bytes, %v", len(decoded), err)
+	}
+}
+
+func TestRoundTripReader(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(RoundTripReader(bytes.NewReader(content), WriterOptions{Quality: 5, AutoFlushBytes: 4096}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, want %d", len(got), len(content))
+	}
+
+	// An error from the source comes through.
+	_, err = ioutil.ReadAll(RoundTripReader(io.MultiReader(bytes.NewReader(content[:1000]), errorReader{}), WriterOptions{}))
+	if err != errReadFailed {
+		t.Errorf("got %v, want %v", err, errReadFailed)
+	}
+}
+
+func TestRoundTripOptions(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := opticks[:300000]
+	dict := opticks[300000:310000]
+	prepared, err := PrepareDictionary(dict, PrepareDictionaryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invert := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i, c := range b {
+			out[i] = ^c
+		}
+		return out
+	}
+	for _, test := range []struct {
+		name    string
+		options WriterOptions
+	}{
+		{"dictionary", WriterOptions{Quality: 5, Dictionary: dict}},
+		{"prepared dictionary", WriterOptions{Quality: 5, PreparedDictionary: prepared}},
+		{"dictionaries", WriterOptions{Quality: 5, Dictionaries: []*PreparedDictionary{prepared, prepared}}},
+		{"grow window", WriterOptions{Quality: 5, GrowWindow: true}},
+		{"grow window with dictionary", WriterOptions{Quality: 5, GrowWindow: true, Dictionary: dict}},
+		{"frame per write", WriterOptions{Quality: 5, FramePerWrite: true}},
+		{"preprocess", WriterOptions{Quality: 5, Preprocess: invert}},
+	} {
+		if err := RoundTrip(content, test.options); err != nil {
+			t.Errorf("%s: RoundTrip: %v", test.name, err)
+		}
+
+		want := content
+		if test.options.Preprocess != nil {
+			want = test.options.Preprocess(content)
+		}
+		// Several writes, so that FramePerWrite makes several messages.
+		src := io.MultiReader(bytes.NewReader(content[:100000]), bytes.NewReader(content[100000:]))
+		got, err := ioutil.ReadAll(RoundTripReader(src, test.options))
+		if err != nil {
+			t.Errorf("%s: RoundTripReader: %v", test.name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: RoundTripReader returned %d bytes that don't match", test.name, len(got))
+		}
+	}
+}
+
+func TestReaderOnMetablockBytes(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, quality := range []int{1, 5, 11} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, WriterOptions{Quality: quality, MaxMetablockSize: 50000})
+		for i := 0; i < len(content); i += 100000 {
+			end := i + 100000
+			if end > len(content) {
+				end = len(content)
+			}
+			w.Write(content[i:end])
+			w.Flush()
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		encoded := buf.Bytes()
+
+		// The metablocks are the same size whether the decoder gets its
+		// input all at once or byte by byte, which it buffers internally.
+		var sizes []int
+		for pass, src := range []io.Reader{bytes.NewReader(encoded), iotest.OneByteReader(bytes.NewReader(encoded))} {
+			var reassembled []byte
+			count := 0
+			r := NewReaderOptions(src, ReaderOptions{OnMetablockBytes: func(index int, compressed []byte) {
+				if index != count {
+					t.Errorf("quality %d: got metablock %d, want %d", quality, index, count)
+				}
+				if pass == 0 {
+					sizes = append(sizes, len(compressed))
+				} else if index >= len(sizes) || len(compressed) != sizes[index] {
+					t.Fatalf("quality %d: metablock %d doesn't match when read byte by byte", quality, index)
+				}
+				count++
+				reassembled = append(reassembled, compressed...)
+			}})
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				t.Fatal(err)
+			}
+			if count < 10 {
+				t.Errorf("quality %d: only %d metablocks", quality, count)
+			}
+			if !bytes.Equal(reassembled, encoded) {
+				t.Fatalf("quality %d: the metablocks add up to %d bytes, not the %d-byte stream", quality, len(reassembled), len(encoded))
+			}
+			decoded, err := Decode(reassembled)
+			if err != nil || !bytes.Equal(decoded, content) {
+				t.Fatalf("quality %d: reassembled stream doesn't decode correctly: %v", quality, err)
+			}
+		}
+	}
+}
+
+func TestNewWriterLevelDict(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, message := content[:100000], content[100000:200000]
+	for _, level := range []int{BestSpeed, 5, BestCompression} {
+		var got, want bytes.Buffer
+		w := NewWriterLevelDict(&got, level, dict)
+		w.Write(message)
+		w.Close()
+		w = NewWriterOptions(&want, WriterOptions{Quality: level, Dictionary: dict})
+		w.Write(message)
+		w.Close()
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("level %d: NewWriterLevelDict output differs from NewWriterOptions", level)
+		}
+	}
+}
+
+func TestDictionaryLowQuality(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The message is copied from the dictionary, so a dictionary that is
+	// actually used makes the output tiny.
+	dict, message := content[:100000], content[50000:60000]
+	for _, quality := range []int{0, 1} {
+		plain, err := Encode(message, WriterOptions{Quality: quality})
+		if err != nil {
+			t.Fatal(err)
+		}
+		withDict, err := Encode(message, WriterOptions{Quality: quality, Dictionary: dict})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("quality %d: %d bytes with dictionary, %d without", quality, len(withDict), len(plain))
+		if len(withDict)*10 > len(plain) {
+			t.Errorf("quality %d: %d bytes with dictionary, want less than a tenth of %d", quality, len(withDict), len(plain))
+		}
+		r := NewReaderOptions(bytes.NewReader(withDict), ReaderOptions{Dictionary: dict})
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("quality %d: %v", quality, err)
+		}
+		if !bytes.Equal(got, message) {
+			t.Errorf("quality %d: decompressed output doesn't match", quality)
+		}
+
+		var samples [][]byte
+		for i := 0; i < 10; i++ {
+			samples = append(samples, content[50000+i*1000:51000+i*1000])
+		}
+		if score := ScoreDictionary(dict, samples, WriterOptions{Quality: quality}); score < 2 {
+			t.Errorf("quality %d: ScoreDictionary = %.2f, want at least 2", quality, score)
+		}
+	}
+}
+
+// slowWriter takes delay for each Write, and records the largest one.
+type slowWriter struct {
+	delay   time.Duration
+	largest int
+}
+
+func (sw *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(sw.delay)
+	if len(p) > sw.largest {
+		sw.largest = len(p)
+	}
+	return len(p), nil
+}
+
+func TestWriterWriteContext(t *testing.T) {
+	input := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(input)
+	// Writing the whole output would take about 3 seconds.
+	sink := &slowWriter{delay: 100 * time.Millisecond}
+
+	w := NewWriterOptions(sink, WriterOptions{Quality: 1, LGWin: 18})
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := w.WriteContext(ctx, input)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("WriteContext returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("WriteContext took %v", elapsed)
+	}
+	if sink.largest > contextWriteSize {
+		t.Errorf("the sink got a %d-byte Write", sink.largest)
+	}
+	if _, err := w.Write(input); err != context.DeadlineExceeded {
+		t.Errorf("Write after the deadline returned %v", err)
+	}
+
+	// Without a deadline, the output arrives as usual.
+	var buf bytes.Buffer
+	w.Reset(&buf)
+	if _, err := w.WriteContext(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := Decode(buf.Bytes()); err != nil || !bytes.Equal(decoded, input) {
+		t.Errorf("output doesn't decode correctly: %v", err)
+	}
+}
+
+func TestPreprocess(t *testing.T) {
+	// A series of slowly and irregularly increasing 32-bit counters, which
+	// compress much better as differences.
+	rnd := rand.New(rand.NewSource(3))
+	var content []byte
+	var v uint32
+	var b [4]byte
+	for i := 0; i < 20000; i++ {
+		v += uint32(rnd.Intn(4))
+		binary.LittleEndian.PutUint32(b[:], v)
+		content = append(content, b[:]...)
+	}
+	delta := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		var prev uint32
+		for i := 0; i+4 <= len(b); i += 4 {
+			cur := binary.LittleEndian.Uint32(b[i:])
+			binary.LittleEndian.PutUint32(out[i:], cur-prev)
+			prev = cur
+		}
+		return out
+	}
+	undelta := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		var prev uint32
+		for i := 0; i+4 <= len(b); i += 4 {
+			prev += binary.LittleEndian.Uint32(b[i:])
+			binary.LittleEndian.PutUint32(out[i:], prev)
+		}
+		return out
+	}
+
+	plain, err := Encode(content, WriterOptions{Quality: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 9, Preprocess: delta})
+	for i := 0; i < len(content); i += 1000 {
+		w.Write(content[i : i+1000])
+		w.Flush()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%d bytes without the transform, %d with it", len(plain), buf.Len())
+	if buf.Len() >= len(plain)/2 {
+		t.Errorf("delta encoding didn't help much: %d bytes, %d without", buf.Len(), len(plain))
+	}
+
+	decoded, err := ioutil.ReadAll(iotest.OneByteReader(NewReaderOptions(&buf, ReaderOptions{Postprocess: undelta})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Error("decoded output doesn't match")
+	}
+}
+
+func TestWriterLargeInputQuality(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compress writes the first bytes of content at once, and the rest in
+	// pieces of 50000 bytes.
+	compress := func(content []byte, options WriterOptions, first int) []byte {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, options)
+		w.Write(content[:first])
+		for i := first; i < len(content); i += 50000 {
+			end := i + 50000
+			if end > len(content) {
+				end = len(content)
+			}
+			w.Write(content[i:end])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	options, err := Options().Quality(11).MaxQualityForLargeInput(100000, 1).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{50000, 100000, 100001, len(opticks)} {
+		// The Writer holds back the input until it knows whether the
+		// stream is larger than LargeInputSize, and then compresses the
+		// held input at once.
+		want, held := 11, size
+		if size > 100000 {
+			want, held = 1, 100000
+		}
+		got := compress(opticks[:size], options, 0)
+		if !bytes.Equal(got, compress(opticks[:size], WriterOptions{Quality: want}, held)) {
+			t.Errorf("%d bytes weren't compressed at quality %d", size, want)
+		}
+	}
+	if _, err := Options().MaxQualityForLargeInput(100000, 12).Build(); err == nil {
+		t.Error("Build accepted LargeInputQuality 12")
+	}
+}
+
+func TestIsEmptyStream(t *testing.T) {
+	empty, err := Encode(nil, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := Decode(empty); err != nil || len(decoded) != 0 {
+		t.Errorf("decoding the empty stream returned %d bytes, %v", len(decoded), err)
+	}
+	var flushed bytes.Buffer
+	w := NewWriterOptions(&flushed, WriterOptions{Quality: 5, EmitSizeHint: true})
+	w.Flush()
+	w.Close()
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonEmpty, err := Encode(content, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneByte, err := Encode([]byte{'x'}, WriterOptions{Quality: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		src  []byte
+		want bool
+	}{
+		{"empty", empty, true},
+		{"empty with size hint", flushed.Bytes(), true},
+		{"non-empty", nonEmpty, false},
+		{"one byte", oneByte, false},
+		{"nil", nil, false},
+		{"truncated", empty[:len(empty)-1], false},
+		{"trailing data", append(append([]byte(nil), empty...), 0), false},
+		{"invalid", []byte{0xff, 0xff, 0xff}, false},
+	} {
+		if got := IsEmptyStream(c.src); got != c.want {
+			t.Errorf("IsEmptyStream(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// shortWriter accepts at most one byte per Write, without an error.
+type shortWriter struct {
+	bytes.Buffer
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return sw.Buffer.Write(p)
+}
+
+func TestWriterShortWrites(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = content[:100000]
+	for _, options := range []WriterOptions{{Quality: 1}, {Quality: 5, IOBufferSize: 4096}, {Quality: 9}} {
+		var sink shortWriter
+		w := NewWriterOptions(&sink, options)
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(sink.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, content) {
+			t.Errorf("quality %d: decoded output doesn't match", options.Quality)
+		}
+		if w.bytesOut != int64(sink.Len()) {
+			t.Errorf("quality %d: counted %d bytes written, want %d", options.Quality, w.bytesOut, sink.Len())
+		}
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if w.Closed() {
+		t.Error("new Writer is closed")
+	}
+	w.Write([]byte("hello"))
+	if w.Closed() {
+		t.Error("Writer is closed after Write")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Closed() {
+		t.Error("Writer isn't closed after Close")
+	}
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+	w.Reset(&buf)
+	if w.Closed() {
+		t.Error("Writer is closed after Reset")
+	}
+}
+
+func TestMessageWriter(t *testing.T) {
+	dict := []byte(`{"method":"GetUser","params":{"id":0},"jsonrpc":"2.0"}`)
+	var messages [][]byte
+	for i := 0; i < 20; i++ {
+		messages = append(messages, []byte(fmt.Sprintf(`{"method":"GetUser","params":{"id":%d},"jsonrpc":"2.0"}`, i*1013)))
+	}
+	messages = append(messages, nil, bytes.Repeat([]byte("a longer message "), 10000))
+
+	var buf bytes.Buffer
+	mw := NewMessageWriter(&buf, WriterOptions{Quality: 5, Dictionary: dict})
+	for _, msg := range messages {
+		if err := mw.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encoded := buf.Bytes()
+
+	mr := NewMessageReader(bytes.NewReader(encoded), ReaderOptions{Dictionary: dict})
+	for i, want := range messages {
+		got, err := mr.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d: got %q, want %q", i, got, want)
+		}
+	}
+	if _, err := mr.ReadMessage(); err != io.EOF {
+		t.Errorf("ReadMessage at the end returned %v, want io.EOF", err)
+	}
+
+	// Only the last message is cut short.
+	mr = NewMessageReader(bytes.NewReader(encoded[:len(encoded)-10]), ReaderOptions{Dictionary: dict})
+	for i := 0; i < len(messages)-1; i++ {
+		if _, err := mr.ReadMessage(); err != nil {
+			t.Fatalf("truncated stream: message %d: %v", i, err)
+		}
+	}
+	if _, err := mr.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated message: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestWriterAbort(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []WriterOptions{{Quality: 1}, {Quality: 5}, {Quality: 5, LGWin: 22, IOBufferSize: 1 << 16}, {Quality: 11, LGWin: 22}} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, options)
+		w.Write(content[:300000])
+		before := buf.Len()
+		w.Abort()
+		if buf.Len() != before {
+			t.Errorf("quality %d: Abort wrote %d bytes", options.Quality, buf.Len()-before)
+		}
+		if !w.Closed() {
+			t.Errorf("quality %d: Writer isn't closed after Abort", options.Quality)
+		}
+		if _, err := w.Write(content); err == nil {
+			t.Errorf("quality %d: Write after Abort succeeded", options.Quality)
+		}
+		if err := w.Close(); err == nil || buf.Len() != before {
+			t.Errorf("quality %d: Close after Abort returned %v and wrote %d bytes", options.Quality, err, buf.Len()-before)
+		}
+
+		// The Writer works again after Reset.
+		buf.Reset()
+		w.Reset(&buf)
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err := Decode(buf.Bytes()); err != nil || !bytes.Equal(decoded, content) {
+			t.Errorf("quality %d: output after Reset doesn't decode correctly: %v", options.Quality, err)
+		}
+	}
+}
+
+func TestWriterFlushAfterClose(t *testing.T) {
+	identity := func(p []byte) []byte { return p }
+	for _, test := range []struct {
+		name    string
+		options WriterOptions
+	}{
+		{"plain", WriterOptions{Quality: 5}},
+		{"preprocess", WriterOptions{Quality: 5, Preprocess: identity}},
+		{"frame per write", WriterOptions{Quality: 5, FramePerWrite: true}},
+	} {
+		w := NewWriterOptions(ioutil.Discard, test.options)
+		w.Write([]byte("hello"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != errWriterClosed {
+			t.Errorf("%s: Flush after Close returned %v, want errWriterClosed", test.name, err)
+		}
+
+		w.Reset(ioutil.Discard)
+		w.Write([]byte("hello"))
+		w.Abort()
+		if err := w.Flush(); err != errWriterClosed {
+			t.Errorf("%s: Flush after Abort returned %v, want errWriterClosed", test.name, err)
+		}
+	}
+}
+
+func TestNewBoundedReader(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	for i := 0; i < 8; i++ {
+		want.Write(content)
+	}
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 5, LGWin: 16})
+	w.Write(want.Bytes())
+	w.Close()
+	compressed := append([]byte(nil), buf.Bytes()...)
+
+	// Drain the output through a small buffer.
+	r := NewBoundedReader(bytes.NewReader(compressed), 1<<16)
+	var got bytes.Buffer
+	if _, err := io.CopyBuffer(&got, struct{ io.Reader }{r}, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if cap(r.ringbuffer) > 1<<16+int(kRingBufferWriteAheadSlack) {
+		t.Errorf("ring buffer grew to %d bytes", cap(r.ringbuffer))
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Error("decoded output doesn't match")
+	}
+
+	buf.Reset()
+	w = NewWriterOptions(&buf, WriterOptions{Quality: 5, LGWin: 22})
+	w.Write(want.Bytes())
+	w.Close()
+	_, err = ioutil.ReadAll(NewBoundedReader(&buf, 1<<16))
+	if err != ErrWindowTooLarge {
+		t.Errorf("got error %v with a 4 MiB window, want ErrWindowTooLarge", err)
+	}
+}
+
+func TestWriterFormatCompat(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := make([][]byte, LatestFormatCompat+1)
+	for level := 1; level <= LatestFormatCompat; level++ {
+		name := fmt.Sprintf("testdata/Opticks-compat%d.br", level)
+		golden, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each golden file is the first 50000 bytes at quality 5, followed
+		// by the next 20000 at quality 11.
+		var buf bytes.Buffer
+		for _, part := range []struct {
+			data    []byte
+			quality int
+		}{{content[:50000], 5}, {content[50000:70000], 11}} {
+			w := NewWriterOptions(&buf, WriterOptions{Quality: part.quality, FormatCompat: level})
+			w.Write(part.data)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(golden), ReaderOptions{Multistream: true}))
+		if err != nil || !bytes.Equal(decoded, content[:70000]) {
+			t.Fatalf("%s doesn't decode correctly: %v", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), golden) {
+			t.Errorf("output with FormatCompat %d doesn't match %s", level, name)
+		}
+		outputs[level] = buf.Bytes()
+	}
+	// Each level pins different heuristics, or it wouldn't need a level.
+	for level := 2; level <= LatestFormatCompat; level++ {
+		if bytes.Equal(outputs[level], outputs[level-1]) {
+			t.Errorf("FormatCompat %d produces the same output as %d", level, level-1)
+		}
+	}
+
+	w := NewWriterOptions(ioutil.Discard, WriterOptions{FormatCompat: LatestFormatCompat + 1})
+	if _, err := w.Write(content); err != errInvalidFormatCompat {
+		t.Errorf("Write with an unsupported FormatCompat returned %v, want %v", err, errInvalidFormatCompat)
+	}
+}
+
+func TestWriterMatchLimits(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Repeat part of the input, for long copies.
+	input := append(append([]byte(nil), content[:200000]...), content[:100000]...)
+	for _, quality := range []int{0, 2, 5, 9, 10, 11} {
+		for _, limits := range []struct{ distance, length int }{{1000, 0}, {0, 20}, {30000, 2}, {5000, 5}} {
+			var buf bytes.Buffer
+			w := NewWriterOptions(&buf, WriterOptions{Quality: quality, MaxMatchDistance: limits.distance, MaxMatchLength: limits.length})
+			for i := 0; i < len(input); i += 100000 {
+				w.Write(input[i : i+100000])
+				w.Flush()
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := NewReader(bytes.NewReader(buf.Bytes()))
+			copies := 0
+			r.traceCopy = func(distance, length int, dictionary bool) {
+				copies++
+				if limits.distance > 0 && (dictionary || distance > limits.distance) {
+					t.Fatalf("quality %d, limits %v: copy at distance %d (dictionary: %v)", quality, limits, distance, dictionary)
+				}
+				if limits.length > 0 && length > limits.length {
+					t.Fatalf("quality %d, limits %v: copy of length %d", quality, limits, length)
+				}
+			}
+			decoded, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(decoded, input) {
+				t.Fatalf("quality %d, limits %v: output doesn't decode correctly: %v", quality, limits, err)
+			}
+			if copies == 0 {
+				t.Errorf("quality %d, limits %v: no copies", quality, limits)
+			}
+		}
+	}
+
+	if err := checkOptions(WriterOptions{MaxMatchLength: 1}); err != errInvalidMaxMatchLength {
+		t.Errorf("checkOptions(MaxMatchLength: 1) = %v, want %v", err, errInvalidMaxMatchLength)
+	}
+	if err := checkOptions(WriterOptions{MaxMatchDistance: 1 << 24}); err != errInvalidMaxMatchDistance {
+		t.Errorf("checkOptions(MaxMatchDistance: 1 << 24) = %v, want %v", err, errInvalidMaxMatchDistance)
+	}
+}
+
+func TestDecodeLines(t *testing.T) {
+	want := []string{"first line", "", strings.Repeat("a long line ", 1000), "last line, without a newline"}
+	compressed, err := Encode([]byte(strings.Join(want, "\n")), WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = DecodeLines(bytes.NewReader(compressed), func(line []byte) error {
+		got = append(got, string(line))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = DecodeLines(bytes.NewReader(compressed), func(line []byte) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("DecodeLines returned %v after %d calls, want %v after 1", err, calls, errStop)
+	}
+
+	err = DecodeLines(bytes.NewReader(compressed[:len(compressed)-1]), func(line []byte) error { return nil })
+	if err == nil {
+		t.Error("no error for a truncated stream")
+	}
+}
+
+func TestDecoderConcurrent(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inputs, streams [][]byte
+	for i := 0; i < 8; i++ {
+		input := content[i*1000 : i*1000+(i+1)*20000]
+		compressed, err := Encode(input, WriterOptions{Quality: i, LGWin: 16 + i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, input)
+		streams = append(streams, compressed)
+	}
+
+	var d Decoder
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				n := (g + i) % len(streams)
+				src := streams[n]
+				if i%10 == 9 {
+					// A truncated stream, which must not affect the other calls.
+					if _, err := d.Decode(src[:len(src)/2]); err == nil {
+						errs <- fmt.Errorf("no error for a truncated stream")
+						return
+					}
+					continue
+				}
+				decoded, err := d.Decode(src)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(decoded, inputs[n]) {
+					errs <- fmt.Errorf("stream %d decoded incorrectly", n)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestWrapUncompressed(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("a"), []byte("OK"), []byte(`{"status":"ok"}`), bytes.Repeat([]byte("x"), 1000), bytes.Repeat([]byte("0123456789"), 7000)} {
+		wrapped := WrapUncompressed(data)
+		maxOverhead := 4
+		if len(data) == 0 {
+			maxOverhead = 1
+		} else if len(data) > 1<<16 {
+			maxOverhead = 5
+		}
+		if len(wrapped) > len(data)+maxOverhead {
+			t.Errorf("%d bytes of data took %d bytes", len(data), len(wrapped))
+		}
+		decoded, err := SafeDecode(wrapped)
+		if err != nil {
+			t.Errorf("%d bytes of data: %v", len(data), err)
+			continue
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%d bytes of data decoded to %d bytes", len(data), len(decoded))
+		}
+	}
+}
+
+func TestNewWriterSize(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = append(append(content, content...), content...)
+	for _, test := range []struct {
+		size int
+		want int
+	}{
+		{0, 10},
+		{1000, 10},
+		{1009, 11},
+		{100000, 17},
+		{len(content), 21},
+	} {
+		var buf bytes.Buffer
+		w := NewWriterSize(&buf, WriterOptions{Quality: 5}, int64(test.size))
+		w.Write(content[:test.size])
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := streamWindowBits(buf.Bytes()); got != test.want {
+			t.Errorf("size %d: window %d, want %d", test.size, got, test.want)
+		}
+		if decoded, err := Decode(buf.Bytes()); err != nil || !bytes.Equal(decoded, content[:test.size]) {
+			t.Errorf("size %d: output doesn't decode correctly: %v", test.size, err)
+		}
+	}
+}
+
+func TestAllocHook(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	largest := make(map[string]int)
+	AllocHook = func(size int, purpose string) {
+		if size <= 0 {
+			t.Errorf("%s: size %d", purpose, size)
+		}
+		if size > largest[purpose] {
+			largest[purpose] = size
+		}
+	}
+	defer func() { AllocHook = nil }()
+
+	compressed, err := Encode(content, WriterOptions{Quality: 5, LGWin: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The encoder's ring buffer is twice the 1 MiB window, and the hash
+	// table is a few MiB at quality 5.
+	if n := largest["encoder window"]; n < 2<<20 || n > 3<<20 {
+		t.Errorf("encoder window: %d bytes", n)
+	}
+	if n := largest["hash table"]; n < 1<<20 || n > 16<<20 {
+		t.Errorf("hash table: %d bytes", n)
+	}
+	if n := largest["output buffer"]; n == 0 || n > 4*len(content) {
+		t.Errorf("output buffer: %d bytes", n)
+	}
+
+	if _, err := Decode(compressed); err != nil {
+		t.Fatal(err)
+	}
+	if n := largest["decoder window"]; n < 1<<19 || n > 2<<20 {
+		t.Errorf("decoder window: %d bytes", n)
+	}
+	if n := largest["input buffer"]; n != readBufSize {
+		t.Errorf("input buffer: %d bytes", n)
+	}
+}
+
+func TestReaderStats(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := Encode(content, WriterOptions{Quality: 5, LGWin: 20, MaxMetablockSize: 100000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bytes.NewReader(compressed))
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	stats := r.Stats()
+	if stats.BytesOut != int64(len(content)) {
+		t.Errorf("BytesOut = %d, want %d", stats.BytesOut, len(content))
+	}
+	if stats.BytesIn != int64(len(compressed)) {
+		t.Errorf("BytesIn = %d, want %d", stats.BytesIn, len(compressed))
+	}
+	if min := (len(content) + 99999) / 100000; stats.Metablocks < min {
+		t.Errorf("Metablocks = %d, want at least %d", stats.Metablocks, min)
+	}
+	if stats.WindowBits != 20 {
+		t.Errorf("WindowBits = %d, want 20", stats.WindowBits)
+	}
+
+	r.Reset(bytes.NewReader(compressed))
+	if stats := r.Stats(); stats != (ReaderStats{}) {
+		t.Errorf("Stats after Reset = %+v", stats)
+	}
+}
+
+func TestWriterOnFlushChunk(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	var dst bytes.Buffer
+	w := NewWriterOptions(&dst, WriterOptions{
+		Quality:      5,
+		IOBufferSize: 1000,
+		OnFlushChunk: func(chunk []byte) error {
+			chunks = append(chunks, append([]byte(nil), chunk...))
+			return nil
+		},
+	})
+	const flushes = 10
+	pieceSize := len(content) / flushes
+	for i := 0; i < flushes; i++ {
+		w.Write(content[i*pieceSize : (i+1)*pieceSize])
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != i+1 {
+			t.Fatalf("%d chunks after %d flushes", len(chunks), i+1)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != flushes+1 {
+		t.Errorf("%d chunks after Close, want %d", len(chunks), flushes+1)
+	}
+	if dst.Len() != 0 {
+		t.Errorf("%d bytes written to the underlying writer", dst.Len())
+	}
+
+	// Each chunk completes the output of the data written before its flush.
+	var stream []byte
+	for i, chunk := range chunks {
+		stream = append(stream, chunk...)
+		decoded, err := ioutil.ReadAll(NewReader(bytes.NewReader(stream)))
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		want := content[:len(content)/flushes*flushes]
+		if i < flushes {
+			want = content[:(i+1)*pieceSize]
+		}
+		if !bytes.Equal(decoded, want) {
+			t.Fatalf("chunks up to %d decoded to %d bytes, want %d", i, len(decoded), len(want))
+		}
+	}
+
+	errSend := errors.New("send failed")
+	w = NewWriterOptions(ioutil.Discard, WriterOptions{OnFlushChunk: func([]byte) error { return errSend }})
+	w.Write(content[:1000])
+	if err := w.Flush(); err != errSend {
+		t.Errorf("Flush returned %v, want %v", err, errSend)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]int)
+	for _, preset := range []struct {
+		name    string
+		options WriterOptions
+	}{
+		{"Fastest", PresetFastest()},
+		{"Balanced", PresetBalanced()},
+		{"Smallest", PresetSmallest()},
+		{"Web", PresetWeb()},
+	} {
+		if err := checkOptions(preset.options); err != nil {
+			t.Errorf("Preset%s: %v", preset.name, err)
+		}
+		compressed, err := Encode(content, preset.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCompressedData(compressed, content); err != nil {
+			t.Errorf("Preset%s: %v", preset.name, err)
+		}
+		sizes[preset.name] = len(compressed)
+	}
+	if sizes["Smallest"] >= sizes["Fastest"] {
+		t.Errorf("PresetSmallest: %d bytes, PresetFastest: %d bytes", sizes["Smallest"], sizes["Fastest"])
+	}
+}
+
+func TestWriterFlushedInputOffset(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []WriterOptions{{Quality: 1}, {Quality: 5}, {Quality: 5, AutoFlushBytes: 30000}, {Quality: 9, IOBufferSize: 4096}} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, options)
+		// checkRecoverable checks that the output so far decodes to at least
+		// the input up to the offset.
+		checkRecoverable := func(when string) {
+			offset := w.FlushedInputOffset()
+			decoded, _ := ioutil.ReadAll(NewReader(bytes.NewReader(buf.Bytes())))
+			if int64(len(decoded)) < offset || !bytes.Equal(decoded[:offset], content[:offset]) {
+				t.Fatalf("%+v: %s: offset %d, but %d bytes were recovered", options, when, offset, len(decoded))
+			}
+		}
+
+		pos := 0
+		for i, size := range []int{100, 50000, 1, 70000, 20000, 150000} {
+			w.Write(content[pos : pos+size])
+			pos += size
+			checkRecoverable(fmt.Sprintf("after write %d", i))
+			if i == 1 && options.AutoFlushBytes > 0 && w.FlushedInputOffset() != int64(options.AutoFlushBytes) {
+				t.Errorf("%+v: offset %d after an automatic flush", options, w.FlushedInputOffset())
+			}
+			if i%2 == 1 {
+				before := w.FlushedInputOffset()
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				if got := w.FlushedInputOffset(); got != int64(pos) || got < before {
+					t.Fatalf("%+v: offset %d after a Flush at %d", options, got, pos)
+				}
+				checkRecoverable(fmt.Sprintf("after flush %d", i))
+			}
+		}
+		w.Write(content[pos : pos+5000])
+		pos += 5000
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.FlushedInputOffset(); got != int64(pos) {
+			t.Errorf("%+v: offset %d after Close, want %d", options, got, pos)
+		}
+		checkRecoverable("after Close")
+	}
+}
+
+func TestReaderLenient(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = content[:50000]
+	compressed, err := Encode(content, WriterOptions{Quality: 5, LGWin: 12, DisableBuiltinDictionary: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the window size with the invalid code 0010001.
+	badWindow := append([]byte(nil), compressed...)
+	badWindow[0] = badWindow[0]&^0x70 | 0x10
+
+	// Set padding bits after an uncompressed metablock's header (bits 21 to
+	// 23) and after the last metablock.
+	badPadding := WrapUncompressed(content)
+	badPadding[2] |= 0x80
+	badPadding[len(badPadding)-1] |= 0x80
+
+	for i, damaged := range [][]byte{badWindow, badPadding} {
+		if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(damaged))); err == nil {
+			t.Errorf("stream %d: no error without Lenient", i)
+		}
+		decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(damaged), ReaderOptions{Lenient: true}))
+		if err != nil {
+			t.Errorf("stream %d: %v", i, err)
+		} else if !bytes.Equal(decoded, content) {
+			t.Errorf("stream %d decoded incorrectly with Lenient", i)
+		}
+	}
+}
+
+func TestReaderChunkBoundary(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	boundaries := func(content []byte, opts WriterOptions) []int64 {
+		compressed, err := Encode(content, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offsets []int64
+		r := NewReaderOptions(bytes.NewReader(compressed), ReaderOptions{
+			ChunkBoundary: func(offset int64) { offsets = append(offsets, offset) },
+		})
+		if _, err := io.CopyBuffer(ioutil.Discard, r, make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		return offsets
+	}
+
+	want := boundaries(opticks, WriterOptions{Quality: 5})
+	if len(want) < 10 {
+		t.Fatalf("only %d boundaries in %d bytes", len(want), len(opticks))
+	}
+	last := int64(0)
+	for _, b := range want {
+		if size := b - last; size < minChunkSize || size > maxChunkSize {
+			t.Errorf("chunk of %d bytes at %d", size, last)
+		}
+		last = b
+	}
+
+	// The same content, compressed differently, has the same boundaries.
+	if got := boundaries(opticks, WriterOptions{Quality: 11, LGWin: 18}); !reflect.DeepEqual(got, want) {
+		t.Errorf("boundaries differ with a different encoding:\n got %v\nwant %v", got, want)
+	}
+
+	// A prefix only moves the boundaries near the start.
+	prefix := []byte("An inserted preface.\n")
+	got := boundaries(append(prefix, opticks...), WriterOptions{Quality: 5})
+	shifted := make(map[int64]bool)
+	for _, b := range got {
+		shifted[b-int64(len(prefix))] = true
+	}
+	common := 0
+	for _, b := range want {
+		if shifted[b] {
+			common++
+		}
+	}
+	if common < len(want)-2 {
+		t.Errorf("only %d of %d boundaries survive a prefix", common, len(want))
+	}
+}
+
+func TestWriterFramePerWrite(t *testing.T) {
+	messages := [][]byte{
+		[]byte("first message"),
+		bytes.Repeat([]byte("a repetitive second message "), 100),
+		nil,
+		[]byte("last message"),
+	}
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 5, FramePerWrite: true})
+	for i, msg := range messages {
+		if _, err := w.Write(msg); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+		if got := w.FlushedInputOffset(); got != w.written {
+			t.Errorf("FlushedInputOffset after Write %d = %d, want %d", i, got, w.written)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); err != errWriterClosed {
+		t.Errorf("Write after Close returned %v, want errWriterClosed", err)
+	}
+
+	mr := NewMessageReader(bytes.NewReader(buf.Bytes()), ReaderOptions{})
+	for i, want := range messages {
+		got, err := mr.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("message %d = %q, want %q", i, got, want)
+		}
+	}
+	if _, err := mr.ReadMessage(); err != io.EOF {
+		t.Errorf("ReadMessage after the last message returned %v, want io.EOF", err)
+	}
+
+	// Each message is a complete stream on its own.
+	rest := buf.Bytes()
+	for i, want := range messages {
+		size, n := binary.Uvarint(rest)
+		got, err := Decode(rest[n : n+int(size)])
+		if err != nil {
+			t.Fatalf("decoding message %d alone: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("message %d decoded alone = %q, want %q", i, got, want)
+		}
+		rest = rest[n+int(size):]
+	}
+}
+
+// repeatedLogBlocks returns copies of a block of random log lines, slightly
+// varied, each after a stretch of other lines, so that the repeats are far
+// apart.
+func repeatedLogBlocks(blockSize, copies int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	lines := func(size int) []byte {
+		var buf bytes.Buffer
+		for buf.Len() < size {
+			fmt.Fprintf(&buf, "%08x INFO request id=%016x status=%d bytes=%d\n", rng.Uint32(), rng.Uint64(), 200+rng.Intn(4), rng.Intn(1<<20))
+		}
+		return buf.Bytes()
+	}
+	block := lines(blockSize)
+	var data []byte
+	for i := 0; i < copies; i++ {
+		start := len(data)
+		data = append(data, block...)
+		// Vary a byte in every few hundred, like a counter in some lines.
+		for j := start + rng.Intn(1000); j < len(data); j += 1 + rng.Intn(1000) {
+			data[j]++
+		}
+		data = append(data, lines(blockSize)...)
+	}
+	return data
+}
+
+func TestWriterLongRangeMatching(t *testing.T) {
+	data := repeatedLogBlocks(1<<20, 2)
+	for _, q := range []int{0, 2, 5} {
+		plain, err := Encode(data, WriterOptions{Quality: q, LGWin: 24})
+		if err != nil {
+			t.Fatal(err)
+		}
+		long, err := Encode(data, WriterOptions{Quality: q, LGWin: 24, LongRangeMatching: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(long)
+		if err != nil {
+			t.Fatalf("quality %d: %v", q, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("quality %d: decoded incorrectly", q)
+		}
+		if q == 2 && len(long) > len(plain)*9/10 {
+			t.Errorf("quality 2: %d bytes with LongRangeMatching, %d without", len(long), len(plain))
+		}
+	}
+
+	// A Writer that is Reset doesn't refer to the data of the previous
+	// stream.
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 2, LGWin: 24, LongRangeMatching: true})
+	w.Write(data)
+	w.Close()
+	buf.Reset()
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	if err := checkCompressedData(buf.Bytes(), data); err != nil {
+		t.Errorf("after Reset: %v", err)
+	}
+}
+
+func BenchmarkEncodeLongRangeMatching(b *testing.B) {
+	data := repeatedLogBlocks(1<<20, 4)
+	for _, q := range []int{2, 3, 5} {
+		for _, long := range []bool{false, true} {
+			options := WriterOptions{Quality: q, LGWin: 24, LongRangeMatching: long}
+			encoded, err := Encode(data, options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			w := NewWriterOptions(ioutil.Discard, options)
+			b.Run(fmt.Sprintf("q=%d/long=%v", q, long), func(b *testing.B) {
+				b.ReportMetric(float64(len(data))/float64(len(encoded)), "ratio")
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					w.Reset(ioutil.Discard)
+					w.Write(data)
+					w.Close()
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeToHash(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := Encode(opticks, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := sha256.New()
+	n, err := DecodeToHash(compressed, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(opticks)) {
+		t.Errorf("DecodeToHash returned length %d, want %d", n, len(opticks))
+	}
+	if want := sha256.Sum256(opticks); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("digest = %x, want %x", h.Sum(nil), want)
+	}
+
+	if _, err := DecodeToHash(compressed[:len(compressed)/2], sha256.New()); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestAnalyzeStream(t *testing.T) {
+	// A short input only refers back a short way, whatever the window.
+	content := bytes.Repeat([]byte("abcdefghij0123456789"), 50)
+	compressed, err := Encode(content, WriterOptions{Quality: 5, LGWin: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := AnalyzeStream(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.WindowBits != 24 {
+		t.Errorf("WindowBits = %d, want 24", info.WindowBits)
+	}
+	if info.MaxDistance != 20 {
+		t.Errorf("MaxDistance = %d, want 20", info.MaxDistance)
+	}
+	if info.Metablocks < 1 || info.Stored {
+		t.Errorf("got %+v, want at least one metablock and none stored", info)
+	}
+
+	info, err = AnalyzeStream(WrapUncompressed(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Stored || info.MaxDistance != 0 {
+		t.Errorf("uncompressed stream: got %+v, want Stored and no distances", info)
+	}
+
+	if _, err := AnalyzeStream(compressed[:len(compressed)-1]); err == nil {
+		t.Error("no error for a truncated stream")
+	}
+}
+
+func TestLogDelta(t *testing.T) {
+	var text bytes.Buffer
+	rnd := rand.New(rand.NewSource(1))
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20000; i++ {
+		ts := start.Add(time.Duration(i) * 37 * time.Millisecond)
+		fmt.Fprintf(&text, "%s host=web-01 service=checkout level=info request=%08x latency_ms=%d\n", ts.Format("2006-01-02T15:04:05.000Z"), rnd.Uint32(), rnd.Intn(500))
+	}
+	plain, err := Encode(text.Bytes(), WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tail := range []string{"", "a last line without a newline", "\r\n\n"} {
+		content := append(text.Bytes()[:text.Len():text.Len()], tail...)
+		var buf bytes.Buffer
+		lw := NewLogDeltaWriter(&buf, WriterOptions{Quality: 5})
+		// Write in pieces that split lines.
+		for p := content; len(p) > 0; {
+			n := 1 + rnd.Intn(200)
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := lw.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if err := lw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if tail == "" {
+			t.Logf("%d bytes of log: %d bytes with LogDeltaWriter, %d with plain brotli", len(content), buf.Len(), len(plain))
+			if buf.Len() >= len(plain) {
+				t.Errorf("LogDeltaWriter wrote %d bytes, plain brotli %d", buf.Len(), len(plain))
+			}
+		}
+
+		decoded, err := ioutil.ReadAll(NewLogDeltaReader(&buf, ReaderOptions{}))
+		if err != nil {
+			t.Fatalf("tail %q: %v", tail, err)
+		}
+		if !bytes.Equal(decoded, content) {
+			t.Errorf("tail %q: decoded text doesn't match", tail)
+		}
+	}
+}
+
+func TestReaderReadAll(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocs := make(map[bool]float64)
+	for _, hint := range []bool{false, true} {
+		compressed, err := Encode(opticks, WriterOptions{Quality: 5, EmitSizeHint: hint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := bytes.NewReader(compressed)
+		r := NewReader(src)
+		var decoded []byte
+		allocs[hint] = testing.AllocsPerRun(10, func() {
+			src.Reset(compressed)
+			r.Reset(src)
+			if decoded, err = r.ReadAll(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if !bytes.Equal(decoded, opticks) {
+			t.Fatalf("hint %v: decoded output doesn't match", hint)
+		}
+		if hint && cap(decoded) != len(opticks) {
+			t.Errorf("with a size hint, the buffer has %d bytes for %d of output", cap(decoded), len(opticks))
+		}
+	}
+	t.Logf("allocations without a size hint: %v, with one: %v", allocs[false], allocs[true])
+	// The decoder's own allocations are the same either way; without the
+	// hint, the output buffer grows many times.
+	if allocs[false]-allocs[true] < 10 {
+		t.Errorf("%v allocations with a size hint, %v without", allocs[true], allocs[false])
+	}
+
+	compressed, err := Encode(opticks, WriterOptions{Quality: 5, EmitSizeHint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReader(bytes.NewReader(compressed[:len(compressed)/2])).ReadAll(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// flatCostModel charges the same for every literal and every copy.
+type flatCostModel struct {
+	literal, copy float32
+}
+
+func (m flatCostModel) LiteralCost(b byte) float32            { return m.literal }
+func (m flatCostModel) CopyCost(length, distance int) float32 { return m.copy }
+
+func TestWriterCostModel(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := opticks[:50000]
+	for _, q := range []int{10, 11} {
+		builtin, err := Encode(content, WriterOptions{Quality: q})
+		if err != nil {
+			t.Fatal(err)
+		}
+		flat, err := Encode(content, WriterOptions{Quality: q, CostModel: flatCostModel{8, 20}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCompressedData(flat, content); err != nil {
+			t.Fatalf("quality %d: %v", q, err)
+		}
+
+		// With copies priced out, the literals are all that's left.
+		literals, err := Encode(content, WriterOptions{Quality: q, CostModel: flatCostModel{8, 1e6}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCompressedData(literals, content); err != nil {
+			t.Fatalf("quality %d: %v", q, err)
+		}
+		t.Logf("quality %d: %d bytes with the built-in model, %d with a flat one, %d without copies", q, len(builtin), len(flat), len(literals))
+		if len(literals) < len(builtin)*3/2 {
+			t.Errorf("quality %d: %d bytes with copies priced out, %d with the built-in model", q, len(literals), len(builtin))
+		}
+	}
+}
+
+func TestWriterMemoryBudget(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []int{1, 5, 11} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, WriterOptions{Quality: q, LGWin: 22, MemoryBudget: 1 << 20})
+		if _, err := w.Write(opticks); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		lgwin := w.AdjustedWindow()
+		if lgwin >= 22 {
+			t.Errorf("quality %d: window not reduced for a 1 MiB budget", q)
+		}
+		if got := streamWindowBits(buf.Bytes()); got != lgwin && !(q == 1 && got == 18) {
+			t.Errorf("quality %d: stream has a window of %d bits, AdjustedWindow reports %d", q, got, lgwin)
+		}
+		if err := checkCompressedData(buf.Bytes(), opticks); err != nil {
+			t.Fatalf("quality %d: %v", q, err)
+		}
+		var params encoderParams
+		encoderInitParams(&params)
+		params.quality, params.lgwin = q, uint(lgwin)
+		if mem := encoderMemory(&params); mem > 1<<20 && lgwin > minWindowBits {
+			t.Errorf("quality %d: got %d bytes with a window of %d bits", q, mem, lgwin)
+		}
+	}
+
+	// A generous budget changes nothing.
+	w := NewWriterOptions(ioutil.Discard, WriterOptions{Quality: 5, LGWin: 22, MemoryBudget: 1 << 30})
+	if got := w.AdjustedWindow(); got != 22 {
+		t.Errorf("AdjustedWindow = %d with a 1 GiB budget, want 22", got)
+	}
+	if err := checkOptions(WriterOptions{MemoryBudget: -1}); err != errInvalidMemoryBudget {
+		t.Errorf("checkOptions(MemoryBudget: -1) = %v, want %v", err, errInvalidMemoryBudget)
+	}
+}
+
+func TestDecompressedSize(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []WriterOptions{
+		{Quality: 5},
+		{Quality: 1, LGWin: 16},
+		{Quality: 5, EmitSizeHint: true},
+	} {
+		compressed, err := Encode(opticks, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := DecompressedSize(compressed)
+		if err != nil {
+			t.Fatalf("%+v: %v", options, err)
+		}
+		if size != int64(len(decoded)) {
+			t.Errorf("%+v: got %d bytes, decoded %d", options, size, len(decoded))
+		}
+	}
+
+	compressed, err := Encode(opticks, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecompressedSize(compressed[:len(compressed)/2]); err == nil {
+		t.Error("no error for a truncated stream")
+	}
+
+	// A size hint that understates the size isn't believed.
+	hinted, err := Encode(opticks, WriterOptions{Quality: 5, EmitSizeHint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(hinted, []byte(sizeHintMagic)) + len(sizeHintMagic)
+	binary.BigEndian.PutUint64(hinted[i:], 10)
+	if size, err := DecompressedSize(hinted); err != nil || size != int64(len(opticks)) {
+		t.Errorf("with a size hint of 10 bytes, got %d bytes, %v; want %d", size, err, len(opticks))
+	}
+}
+
+// appendOnlyWriter fails the test if it is used other than by appending
+// with Write.
+type appendOnlyWriter struct {
+	t   *testing.T
+	buf bytes.Buffer
+}
+
+func (w *appendOnlyWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *appendOnlyWriter) Seek(offset int64, whence int) (int64, error) {
+	w.t.Errorf("Seek(%d, %d) called", offset, whence)
+	return 0, errors.New("not seekable")
+}
+
+func (w *appendOnlyWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.t.Errorf("WriteAt(%d bytes, %d) called", len(p), off)
+	return 0, errors.New("append only")
+}
+
+func TestWriterOnlyAppends(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []WriterOptions{
+		{Quality: 5},
+		{Quality: 1, EmitSizeHint: true},
+		{Quality: 5, GrowWindow: true},
+		{Quality: 5, FlushAlignment: 512, IOBufferSize: 4096},
+		{Quality: 5, FramePerWrite: true},
+	} {
+		dst := &appendOnlyWriter{t: t}
+		w := NewWriterOptions(dst, options)
+		for i := 0; i < len(opticks); i += 100000 {
+			end := i + 100000
+			if end > len(opticks) {
+				end = len(opticks)
+			}
+			if _, err := w.Write(opticks[i:end]); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%+v: %v", options, err)
+		}
+		if dst.buf.Len() == 0 {
+			t.Errorf("%+v: no output", options)
+		}
+	}
+}
+
+func TestWriterLowLatency(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// firstOutput returns how much input was written before the Writer
+	// wrote anything.
+	firstOutput := func(options WriterOptions) (int, []byte) {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, options)
+		first := -1
+		for i := 0; i < len(opticks); i += 1024 {
+			end := i + 1024
+			if end > len(opticks) {
+				end = len(opticks)
+			}
+			if _, err := w.Write(opticks[i:end]); err != nil {
+				t.Fatal(err)
+			}
+			if first < 0 && buf.Len() > 0 {
+				first = end
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return first, buf.Bytes()
+	}
+	for _, q := range []int{1, 5, 11} {
+		defaultFirst, defaultOut := firstOutput(WriterOptions{Quality: q})
+		lowFirst, lowOut := firstOutput(WriterOptions{Quality: q, LowLatency: true})
+		if err := checkCompressedData(lowOut, opticks); err != nil {
+			t.Fatalf("quality %d: %v", q, err)
+		}
+		t.Logf("quality %d: first output after %d bytes (%d compressed), vs %d (%d compressed) by default", q, lowFirst, len(lowOut), defaultFirst, len(defaultOut))
+		if lowFirst < 0 || lowFirst > 2*lowLatencyMetablockSize || defaultFirst >= 0 && lowFirst > defaultFirst {
+			t.Errorf("quality %d: first output after %d bytes with LowLatency, %d by default", q, lowFirst, defaultFirst)
+		}
+	}
+}
+
+func TestParallelWriterDeterministic(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first []byte
+	for i, workers := range []int{1, 2, 4} {
+		var buf bytes.Buffer
+		pw := NewWriterParallelDeterministic(&buf, WriterOptions{Quality: 5}, 100000, workers)
+		// Write in pieces of varying sizes, which mustn't affect the chunks.
+		rnd := rand.New(rand.NewSource(int64(workers)))
+		for data := opticks; len(data) > 0; {
+			n := rnd.Intn(70000)
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := pw.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		if err := pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = buf.Bytes()
+		} else if !bytes.Equal(buf.Bytes(), first) {
+			t.Errorf("%d workers: output differs from 1 worker", workers)
+		}
+	}
+
+	decoded, err := ioutil.ReadAll(NewReaderOptions(bytes.NewReader(first), ReaderOptions{Multistream: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, opticks) {
+		t.Error("output doesn't decode to the input")
+	}
+
+	var empty bytes.Buffer
+	if err := NewWriterParallelDeterministic(&empty, WriterOptions{}, 0, 0).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCompressedData(empty.Bytes(), nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderMaxTotalAlloc(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := Encode(bytes.Repeat(opticks, 8), WriterOptions{Quality: 1, LGWin: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := Encode(opticks, WriterOptions{Quality: 5, LGWin: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReaderOptions(bytes.NewReader(large), ReaderOptions{MaxTotalAlloc: 1 << 20})
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != ErrAllocLimit {
+		t.Errorf("large window: got error %v after %d bytes, want ErrAllocLimit", err, n)
+	}
+
+	for _, test := range []struct {
+		src   []byte
+		limit int
+	}{
+		{small, 1 << 20},
+		{large, 40 << 20},
+	} {
+		r := NewReaderOptions(bytes.NewReader(test.src), ReaderOptions{MaxTotalAlloc: test.limit})
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Errorf("limit %d: %v", test.limit, err)
+		}
+		if allocated := len(r.buf) + r.windowAlloc + r.streamAlloc + r.tableAlloc; allocated > test.limit {
+			t.Errorf("limit %d: %d bytes allocated", test.limit, allocated)
+		}
+	}
+
+	// A Reader that hit the limit can be Reset for a stream that fits.
+	r.Reset(bytes.NewReader(small))
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Errorf("after Reset: %v", err)
+	}
+}
+
+func TestNewReaderOptionsDefault(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := Encode(opticks, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range [][]byte{compressed, compressed[:len(compressed)/2], append(compressed[:len(compressed):len(compressed)], 0)} {
+		want, wantErr := ioutil.ReadAll(NewReader(bytes.NewReader(src)))
+		r := NewReaderOptions(bytes.NewReader(src), ReaderOptions{})
+		got, err := ioutil.ReadAll(r)
+		if err != wantErr || !bytes.Equal(got, want) {
+			t.Errorf("%d bytes of input: NewReaderOptions gave %d bytes and error %v, NewReader %d bytes and error %v", len(src), len(got), err, len(want), wantErr)
+		}
+		if st := r.Stats(); st.BytesOut != int64(len(got)) {
+			t.Errorf("%d bytes of input: Stats().BytesOut = %d, want %d", len(src), st.BytesOut, len(got))
+		}
+	}
+}
+
+func TestWriterStoredPreferred(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range [][]byte{nil, []byte("x"), opticks} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, WriterOptions{StoredPreferred: true})
+		half := len(content) / 2
+		if _, err := w.Write(content[:half]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content[half:]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCompressedData(buf.Bytes(), content); err != nil {
+			t.Fatalf("%d bytes: %v", len(content), err)
+		}
+		if max := len(content) + len(content)/4096 + 8; buf.Len() > max {
+			t.Errorf("%d bytes: %d bytes stored, want at most %d", len(content), buf.Len(), max)
+		}
+		info, err := AnalyzeStream(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.WindowBits != minWindowBits || len(content) > 0 && !info.Stored {
+			t.Errorf("%d bytes: got %+v, want stored data and the smallest window", len(content), info)
+		}
+	}
+}
+
+func BenchmarkEncodeStoredPreferred(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		options WriterOptions
+	}{
+		{"StoredPreferred", WriterOptions{StoredPreferred: true}},
+		{"Quality0", WriterOptions{Quality: 0}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(opticks)))
+			w := NewWriterOptions(ioutil.Discard, test.options)
+			for i := 0; i < b.N; i++ {
+				w.Reset(ioutil.Discard)
+				w.Write(opticks)
+				w.Close()
+			}
+		})
+	}
+}
+
+func TestReaderOnWindowAlloc(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := Encode(opticks, WriterOptions{Quality: 5, LGWin: 18})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	r := NewReaderOptions(bytes.NewReader(compressed), ReaderOptions{
+		OnWindowAlloc: func(bytes int) { sizes = append(sizes, bytes) },
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		if len(sizes) != 1 || sizes[0] != 1<<18 {
+			t.Errorf("stream %d: OnWindowAlloc called with %v, want [%d]", i, sizes, 1<<18)
+		}
+		sizes = nil
+		r.Reset(bytes.NewReader(compressed))
+	}
+}
+
+func TestWriterRotate(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := [][]byte{opticks[:100000], opticks[100000:300000], opticks[300000:]}
+	files := make([]bytes.Buffer, len(parts))
+	w := NewWriterOptions(&files[0], WriterOptions{Quality: 5})
+	for i, part := range parts {
+		if i > 0 {
+			if err := w.Rotate(&files[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Write in two pieces, with input still pending at the rotation.
+		if _, err := w.Write(part[:len(part)/2]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(part[len(part)/2:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range parts {
+		if err := checkCompressedData(files[i].Bytes(), parts[i]); err != nil {
+			t.Errorf("file %d: %v", i, err)
+		}
+	}
+
+	if err := w.Rotate(ioutil.Discard); err != errWriterClosed {
+		t.Errorf("Rotate after Close returned %v, want %v", err, errWriterClosed)
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	content := bytes.Repeat([]byte("limited reader "), 1000)
+	compressed, err := Encode(content, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		limit      int64
+		overflowed bool
+	}{
+		{int64(len(content)) + 100, false},
+		{int64(len(content)), false},
+		{int64(len(content)) - 1, true},
+		{100, true},
+	} {
+		lr := NewLimitedReader(NewReader(bytes.NewReader(compressed)), test.limit)
+		got, err := ioutil.ReadAll(lr)
+		if err != nil {
+			t.Fatalf("limit %d: %v", test.limit, err)
+		}
+		want := content
+		if int64(len(want)) > test.limit {
+			want = want[:test.limit]
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("limit %d: got %d bytes, want %d", test.limit, len(got), len(want))
+		}
+		if lr.Overflowed() != test.overflowed {
+			t.Errorf("limit %d: Overflowed() = %v, want %v", test.limit, lr.Overflowed(), test.overflowed)
+		}
+	}
+
+	// Errors from beyond the limit are reported.
+	lr := NewLimitedReader(NewReader(bytes.NewReader(append(compressed[:len(compressed):len(compressed)], 0))), int64(len(content)))
+	if _, err := ioutil.ReadAll(lr); err != errExcessiveInput {
+		t.Errorf("trailing garbage: got error %v, want %v", err, errExcessiveInput)
+	}
+
+	// A reader that never gets past the limit, or to EOF, doesn't hang.
+	lr = NewLimitedReader(io.MultiReader(bytes.NewReader(content), stuckReader{}), int64(len(content)))
+	if got, err := ioutil.ReadAll(lr); err != io.ErrNoProgress || !bytes.Equal(got, content) {
+		t.Errorf("stuck reader: got %d bytes and error %v, want %d bytes and %v", len(got), err, len(content), io.ErrNoProgress)
+	}
+}
+
+// stuckReader always returns no data and no error.
+type stuckReader struct{}
+
+func (stuckReader) Read(p []byte) (int, error) { return 0, nil }
+
+// flushRecorder records the sizes of the writes to it, and the number of
+// writes before each flush.
+type flushRecorder struct {
+	bytes.Buffer
+	writes  []int
+	flushes []int
+}
+
+func (f *flushRecorder) Write(p []byte) (int, error) {
+	f.writes = append(f.writes, len(p))
+	return f.Buffer.Write(p)
+}
+
+func (f *flushRecorder) Flush() { f.flushes = append(f.flushes, len(f.writes)) }
+
+func TestDecodeToChunked(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := Encode(opticks, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunkSize = 10000
+	var dst flushRecorder
+	if err := DecodeToChunked(&dst, bytes.NewReader(compressed), chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), opticks) {
+		t.Fatal("output doesn't match the input")
+	}
+	wantWrites := (len(opticks) + chunkSize - 1) / chunkSize
+	if len(dst.writes) != wantWrites {
+		t.Errorf("%d writes, want %d", len(dst.writes), wantWrites)
+	}
+	for i, n := range dst.writes[:len(dst.writes)-1] {
+		if n != chunkSize {
+			t.Errorf("write %d is %d bytes, want %d", i, n, chunkSize)
+		}
+	}
+	for i, writes := range dst.flushes {
+		if writes != i+1 {
+			t.Fatalf("flush %d came after %d writes, want one after each write", i, writes)
+		}
+	}
+	if len(dst.flushes) != len(dst.writes) {
+		t.Errorf("%d flushes for %d writes", len(dst.flushes), len(dst.writes))
+	}
+
+	if err := DecodeToChunked(ioutil.Discard, bytes.NewReader(compressed[:len(compressed)/2]), 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestAnalyzeDictionaryUsage(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := Encode(opticks[:50000], WriterOptions{Quality: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := AnalyzeDictionaryUsage(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%+v", stats)
+	if stats.References == 0 || stats.Transformed == 0 || stats.WordBytes < 4*stats.References {
+		t.Errorf("English text: got %+v, want dictionary references, some of them transformed", stats)
+	}
+
+	compressed, err = Encode(opticks[:50000], WriterOptions{Quality: 11, DisableBuiltinDictionary: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := AnalyzeDictionaryUsage(compressed); err != nil || stats != (DictStats{}) {
+		t.Errorf("without the dictionary: got %+v, %v", stats, err)
+	}
+}
+
+func TestWriterLimit(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const limit = 64 << 10
+	var buf bytes.Buffer
+	w := NewWriterLimit(&buf, WriterOptions{Quality: 5, LGWin: 18}, limit)
+	written := 0
+	for written < len(opticks) {
+		end := written + 4096
+		if end > len(opticks) {
+			end = len(opticks)
+		}
+		if _, err = w.Write(opticks[written:end]); err != nil {
+			break
+		}
+		written = end
+		if err = w.Flush(); err != nil {
+			break
+		}
+	}
+	if err != ErrOutputFull {
+		t.Fatalf("got error %v after %d bytes, want ErrOutputFull", err, written)
+	}
+	if buf.Len() > limit {
+		t.Errorf("%d bytes written, limit %d", buf.Len(), limit)
+	}
+	if err := w.Close(); err != ErrOutputFull {
+		t.Errorf("Close returned %v, want ErrOutputFull", err)
+	}
+	r := NewReader(&buf)
+	decoded, _ := ioutil.ReadAll(r)
+	if r.state == stateDone {
+		t.Error("partial output is a complete stream")
+	}
+	if len(decoded) == 0 || !bytes.HasPrefix(opticks, decoded) {
+		t.Errorf("partial output decodes to %d bytes that aren't a prefix of the input", len(decoded))
+	}
+
+	// Data that fits is unaffected.
+	buf.Reset()
+	w.Reset(&buf)
+	if _, err := w.Write(opticks[:10000]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCompressedData(buf.Bytes(), opticks[:10000]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderPool(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := opticks[:20000]
+	var streams [][]byte
+	for i := 0; i < 8; i++ {
+		content := opticks[20000+i*30000 : 20000+(i+1)*30000]
+		compressed, err := Encode(content, WriterOptions{Quality: 5, Dictionary: dict})
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, compressed)
+	}
+
+	pool := NewReaderPool(ReaderOptions{Dictionary: dict})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				n := (g + i) % len(streams)
+				r := pool.GetReader(bytes.NewReader(streams[n]))
+				// Leave some streams unfinished, which Reset must clear.
+				if i%5 == 4 {
+					r.Read(make([]byte, 100))
+					pool.PutReader(r)
+					continue
+				}
+				decoded, err := ioutil.ReadAll(r)
+				pool.PutReader(r)
+				if err != nil {
+					t.Errorf("stream %d: %v", n, err)
+					return
+				}
+				if !bytes.Equal(decoded, opticks[20000+n*30000:20000+(n+1)*30000]) {
+					t.Errorf("stream %d: output doesn't match", n)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,44 @@
+package brotli
+
+// ReaderOptions.ChunkBoundary uses a gear hash: for each byte b of output,
+// hash = hash<<1 + gearTable[b], so the top bits depend on the last 64
+// bytes. A chunk ends after a byte where the top chunkBits bits of the hash
+// are zero, giving chunks of 8 KiB on average, but no shorter than
+// minChunkSize or longer than maxChunkSize.
+const (
+	chunkBits    = 13
+	minChunkSize = 2 << 10
+	maxChunkSize = 64 << 10
+)
+
+// gearTable holds pseudo-random values for the gear hash, from splitmix64
+// with a fixed seed, so that the boundaries never change.
+var gearTable = func() (table [256]uint64) {
+	x := uint64(0x62726f746c694344) // "brotliCD"
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// findChunkBoundaries passes the chunk boundaries in out, the next output
+// of r, to r.options.ChunkBoundary.
+func (r *Reader) findChunkBoundaries(out []byte) {
+	const mask = (1<<chunkBits - 1) << (64 - chunkBits)
+	h := r.chunkHash
+	for i, b := range out {
+		h = h<<1 + gearTable[b]
+		size := r.chunkOffset + int64(i+1) - r.chunkStart
+		if size >= minChunkSize && h&mask == 0 || size >= maxChunkSize {
+			r.chunkStart += size
+			h = 0
+			r.options.ChunkBoundary(r.chunkStart)
+		}
+	}
+	r.chunkHash = h
+	r.chunkOffset += int64(len(out))
+}
@@ -489,7 +489,7 @@ var kCmdHistoSeed = [128]uint32{
 var compressFragmentFastImpl_kFirstBlockSize uint = 3 << 15
 var compressFragmentFastImpl_kMergeBlockSize uint = 1 << 16
 
-func compressFragmentFastImpl(in []byte, input_size uint, is_last bool, table []int, table_bits uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, storage_ix *uint, storage []byte) {
+func compressFragmentFastImpl(in []byte, input_size uint, is_last bool, table []int, table_bits uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, storage_ix *uint, storage []byte, info *EncodeInfo) {
 	var cmd_histo [128]uint32
 	var ip_end int
 	var next_emit int = 0
@@ -518,6 +518,7 @@ func compressFragmentFastImpl(in []byte, input_size uint, is_last bool, table []
 	/* Save the bit position of the MLEN field of the meta-block header, so that
 	   we can update it later if we decide to extend this meta-block. */
 	storeMetaBlockHeader1(block_size, false, storage_ix, storage)
+	info.Metablocks++
 
 	/* No block splits, no contexts. */
 	writeBits(13, 0, storage_ix, storage)
@@ -633,6 +634,7 @@ emit_commands:
 					emitInsertLen1(insert, cmd_depth, cmd_bits, cmd_histo[:], storage_ix, storage)
 				} else if shouldUseUncompressedMode(in[metablock_start:], in[next_emit:], insert, literal_ratio) {
 					emitUncompressedMetaBlock1(in[metablock_start:], in[base:], mlen_storage_ix-3, storage_ix, storage)
+					info.Stored = true
 					input_size -= uint(base - input)
 					input = base
 					next_emit = input
@@ -745,6 +747,7 @@ emit_remainder:
 			emitLiterals(in[next_emit:], insert, lit_depth[:], lit_bits[:], storage_ix, storage)
 		} else if shouldUseUncompressedMode(in[metablock_start:], in[next_emit:], insert, literal_ratio) {
 			emitUncompressedMetaBlock1(in[metablock_start:], in[ip_end:], mlen_storage_ix-3, storage_ix, storage)
+			info.Stored = true
 		} else {
 			emitLongInsertLen(insert, cmd_depth, cmd_bits, cmd_histo[:], storage_ix, storage)
 			emitLiterals(in[next_emit:], insert, lit_depth[:], lit_bits[:], storage_ix, storage)
@@ -766,6 +769,7 @@ next_block:
 		mlen_storage_ix = *storage_ix + 3
 
 		storeMetaBlockHeader1(block_size, false, storage_ix, storage)
+		info.Metablocks++
 
 		/* No block splits, no contexts. */
 		writeBits(13, 0, storage_ix, storage)
@@ -807,8 +811,9 @@ next_block:
    REQUIRES: "table_size" is an odd (9, 11, 13, 15) power of two
    OUTPUT: maximal copy distance <= |input_size|
    OUTPUT: maximal copy distance <= BROTLI_MAX_BACKWARD_LIMIT(18) */
-func compressFragmentFast(input []byte, input_size uint, is_last bool, table []int, table_size uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, storage_ix *uint, storage []byte) {
+func compressFragmentFast(input []byte, input_size uint, is_last bool, table []int, table_size uint, cmd_depth []byte, cmd_bits []uint16, cmd_code_numbits *uint, cmd_code []byte, storage_ix *uint, storage []byte, info *EncodeInfo) {
 	var initial_storage_ix uint = *storage_ix
+	var initial_metablocks int = info.Metablocks
 	var table_bits uint = uint(log2FloorNonZero(table_size))
 
 	if input_size == 0 {
@@ -819,11 +824,13 @@ func compressFragmentFast(input []byte, input_size uint, is_last bool, table []i
 		return
 	}
 
-	compressFragmentFastImpl(input, input_size, is_last, table, table_bits, cmd_depth, cmd_bits, cmd_code_numbits, cmd_code, storage_ix, storage)
+	compressFragmentFastImpl(input, input_size, is_last, table, table_bits, cmd_depth, cmd_bits, cmd_code_numbits, cmd_code, storage_ix, storage, info)
 
 	/* If output is larger than single uncompressed block, rewrite it. */
 	if *storage_ix-initial_storage_ix > 31+(input_size<<3) {
 		emitUncompressedMetaBlock1(input, input[input_size:], initial_storage_ix, storage_ix, storage)
+		info.Metablocks = initial_metablocks + 1
+		info.Stored = true
 	}
 
 	if is_last {
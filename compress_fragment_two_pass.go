@@ -678,7 +678,7 @@ func emitUncompressedMetaBlock(input []byte, input_size uint, storage_ix *uint,
 	storage[*storage_ix>>3] = 0
 }
 
-func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_bits uint, min_match uint, storage_ix *uint, storage []byte) {
+func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_bits uint, min_match uint, storage_ix *uint, storage []byte, info *EncodeInfo) {
 	/* Save the start of the first block for position and distance computations.
 	 */
 	var base_ip []byte = input
@@ -690,6 +690,7 @@ func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, co
 		var num_literals uint
 		createCommands(input, block_size, input_size, base_ip, table, table_bits, min_match, &literals, &commands)
 		num_literals = uint(-cap(literals) + cap(literal_buf))
+		info.Metablocks++
 		if shouldCompress(input, block_size, num_literals) {
 			var num_commands uint = uint(-cap(commands) + cap(command_buf))
 			storeMetaBlockHeader(block_size, false, storage_ix, storage)
@@ -703,6 +704,7 @@ func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, co
 			   the data is close to 8 bits, we can simply emit an uncompressed block.
 			   This makes compression speed of uncompressible data about 3x faster. */
 			emitUncompressedMetaBlock(input, block_size, storage_ix, storage)
+			info.Stored = true
 		}
 
 		input = input[block_size:]
@@ -723,8 +725,9 @@ func compressFragmentTwoPassImpl(input []byte, input_size uint, is_last bool, co
    REQUIRES: "table_size" is a power of two
    OUTPUT: maximal copy distance <= |input_size|
    OUTPUT: maximal copy distance <= BROTLI_MAX_BACKWARD_LIMIT(18) */
-func compressFragmentTwoPass(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_size uint, storage_ix *uint, storage []byte) {
+func compressFragmentTwoPass(input []byte, input_size uint, is_last bool, command_buf []uint32, literal_buf []byte, table []int, table_size uint, storage_ix *uint, storage []byte, info *EncodeInfo) {
 	var initial_storage_ix uint = *storage_ix
+	var initial_metablocks int = info.Metablocks
 	var table_bits uint = uint(log2FloorNonZero(table_size))
 	var min_match uint
 	if table_bits <= 15 {
@@ -732,12 +735,14 @@ func compressFragmentTwoPass(input []byte, input_size uint, is_last bool, comman
 	} else {
 		min_match = 6
 	}
-	compressFragmentTwoPassImpl(input, input_size, is_last, command_buf, literal_buf, table, table_bits, min_match, storage_ix, storage)
+	compressFragmentTwoPassImpl(input, input_size, is_last, command_buf, literal_buf, table, table_bits, min_match, storage_ix, storage, info)
 
 	/* If output is larger than single uncompressed block, rewrite it. */
 	if *storage_ix-initial_storage_ix > 31+(input_size<<3) {
 		rewindBitPosition(initial_storage_ix, storage_ix, storage)
 		emitUncompressedMetaBlock(input, input_size, storage_ix, storage)
+		info.Metablocks = initial_metablocks + 1
+		info.Stored = true
 	}
 
 	if is_last {
@@ -0,0 +1,27 @@
+package brotli
+
+// A CostModel estimates the cost, in bits, of encoding literals and copies,
+// for WriterOptions.CostModel. The costs must not be negative. It is
+// EXPERIMENTAL, and may change or go away in any release.
+type CostModel interface {
+	// LiteralCost returns the cost of the literal b.
+	LiteralCost(b byte) float32
+	// CopyCost returns the cost of a copy of length bytes from distance
+	// bytes back, including the command that carries it (but not its
+	// literals). A distance beyond the window refers to the built-in
+	// dictionary.
+	CopyCost(length, distance int) float32
+}
+
+// zopfliCostModelSetCustom replaces the literal costs of self with those of
+// self.custom. The copy costs are replaced in updateNodes.
+func zopfliCostModelSetCustom(self *zopfliCostModel, position uint, ringbuffer []byte, ringbuffer_mask uint) {
+	var literal_costs []float32 = self.literal_costs_
+	literal_costs[0] = 0
+	for i := uint(0); i < self.num_bytes_; i++ {
+		literal_costs[i+1] = literal_costs[i] + self.custom.LiteralCost(ringbuffer[(position+i)&ringbuffer_mask])
+	}
+
+	// The cheapest command, for pruning the search: any copy may be free.
+	self.min_cost_cmd_ = 0
+}
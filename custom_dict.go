@@ -0,0 +1,96 @@
+package brotli
+
+import "errors"
+
+// A replacement for the built-in static dictionary (see
+// WriterOptions.ReplaceBuiltinDictionary) starts with one byte for each word
+// length from minDictionaryWordLength to maxDictionaryWordLength, giving the
+// base 2 logarithm of the number of words of that length, or 0 if there are
+// none. The words follow, grouped by length in increasing order, which is
+// the layout of the built-in dictionary in RFC 7932, Appendix A.
+const customDictionaryHeaderLen = maxDictionaryWordLength - minDictionaryWordLength + 1
+
+// The encoder's lookup tables store word indices in 11 bits. The built-in
+// dictionary has at most 1 << 11 words of each length, too.
+const maxCustomDictionarySizeBits = 11
+
+var errInvalidDictionary = errors.New("brotli: invalid replacement dictionary")
+
+// parseCustomDictionary parses a replacement dictionary for the decoder.
+func parseCustomDictionary(data []byte) (*dictionary, error) {
+	if len(data) < customDictionaryHeaderLen {
+		return nil, errInvalidDictionary
+	}
+	var d *dictionary = new(dictionary)
+	var offset uint32 = 0
+	for l := 0; l < len(d.offsets_by_length); l++ {
+		d.offsets_by_length[l] = offset
+		if l < minDictionaryWordLength || l > maxDictionaryWordLength {
+			continue
+		}
+		var bits byte = data[l-minDictionaryWordLength]
+		if bits > maxCustomDictionarySizeBits {
+			return nil, errInvalidDictionary
+		}
+		d.size_bits_by_length[l] = bits
+		if bits != 0 {
+			offset += uint32(l) << bits
+		}
+	}
+
+	d.data = data[customDictionaryHeaderLen:]
+	d.data_size = uint(len(d.data))
+	if d.data_size != uint(offset) {
+		return nil, errInvalidDictionary
+	}
+	return d, nil
+}
+
+// newCustomEncoderDictionary builds the encoder's lookup tables for a
+// replacement dictionary: the hash table searched by
+// searchInStaticDictionary, which holds the two longest words for each
+// hash14 of the first four bytes, and the buckets searched by
+// findAllStaticDictionaryMatches, which hold all the words. Unlike the
+// tables for the built-in dictionary, these don't list uppercased variants
+// of the words.
+func newCustomEncoderDictionary(words *dictionary) *encoderDictionary {
+	var dict *encoderDictionary = &encoderDictionary{
+		words:                 words,
+		cutoffTransformsCount: kCutoffTransformsCount,
+		cutoffTransforms:      kCutoffTransforms,
+		hash_table:            make([]uint16, 2<<14),
+		buckets:               make([]uint16, 1<<uint(kDictNumBits)),
+	}
+
+	var chains [][]dictWord = make([][]dictWord, len(dict.buckets))
+	for l := maxDictionaryWordLength; l >= minDictionaryWordLength; l-- {
+		var bits byte = words.size_bits_by_length[l]
+		if bits == 0 {
+			continue
+		}
+		for idx := 0; idx < 1<<bits; idx++ {
+			var word []byte = words.data[int(words.offsets_by_length[l])+l*idx:]
+			var key uint32 = hash14(word) << 1
+			if dict.hash_table[key] == 0 {
+				dict.hash_table[key] = uint16(idx<<5 | l)
+			} else if dict.hash_table[key+1] == 0 {
+				dict.hash_table[key+1] = uint16(idx<<5 | l)
+			}
+			var h uint32 = hash(word)
+			chains[h] = append(chains[h], dictWord{len: byte(l), idx: uint16(idx)})
+		}
+	}
+
+	// Offset 0 in the buckets means an empty bucket, so dict_words starts
+	// with an unused entry. The last entry of each chain is marked.
+	dict.dict_words = make([]dictWord, 1)
+	for h, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+		dict.buckets[h] = uint16(len(dict.dict_words))
+		chain[len(chain)-1].len |= 0x80
+		dict.dict_words = append(dict.dict_words, chain...)
+	}
+	return dict
+}
@@ -112,6 +112,9 @@ func decodeWindowBits(s *Reader, br *bitReader) int {
 
 			s.large_window = true
 			return decoderSuccess
+		} else if s.options.Lenient {
+			s.window_bits = maxWindowBits
+			return decoderSuccess
 		} else {
 			return decoderErrorFormatWindowBits
 		}
@@ -242,7 +245,7 @@ func decodeMetaBlockLength(s *Reader, br *bitReader) int {
 					return decoderNeedsMoreInput
 				}
 
-				if uint(i+1) == s.size_nibbles && s.size_nibbles > 4 && bits == 0 {
+				if uint(i+1) == s.size_nibbles && s.size_nibbles > 4 && bits == 0 && !s.options.Lenient {
 					return decoderErrorFormatExuberantNibble
 				}
 
@@ -275,7 +278,7 @@ func decodeMetaBlockLength(s *Reader, br *bitReader) int {
 				return decoderNeedsMoreInput
 			}
 
-			if bits != 0 {
+			if bits != 0 && !s.options.Lenient {
 				return decoderErrorFormatReserved
 			}
 
@@ -307,7 +310,7 @@ func decodeMetaBlockLength(s *Reader, br *bitReader) int {
 					return decoderNeedsMoreInput
 				}
 
-				if uint(i+1) == s.size_nibbles && s.size_nibbles > 1 && bits == 0 {
+				if uint(i+1) == s.size_nibbles && s.size_nibbles > 1 && bits == 0 && !s.options.Lenient {
 					return decoderErrorFormatExuberantMetaNibble
 				}
 
@@ -944,7 +947,7 @@ func huffmanTreeGroupDecode(group *huffmanTreeGroup, s *Reader) int {
        This table will be used for reading context map items.
     3) Read context map items; "0" values could be run-length encoded.
     4) Optionally, apply InverseMoveToFront transform to the resulting map. */
-func decodeContextMap(context_map_size uint32, num_htrees *uint32, context_map_arg *[]byte, s *Reader) int {
+func decodeContextMap(context_map_size uint32, num_htrees *uint32, context_map_arg *[]byte, spare *[]byte, s *Reader) int {
 	var br *bitReader = &s.br
 	var result int = decoderSuccess
 
@@ -957,7 +960,10 @@ func decodeContextMap(context_map_size uint32, num_htrees *uint32, context_map_a
 
 		(*num_htrees)++
 		s.context_index = 0
-		*context_map_arg = make([]byte, uint(context_map_size))
+		if !s.allocate(&s.tableAlloc, int(context_map_size)) {
+			return decoderErrorAllocContextMap
+		}
+		*context_map_arg = reuseBytes(spare, int(context_map_size))
 		if *context_map_arg == nil {
 			return decoderErrorAllocContextMap
 		}
@@ -1279,6 +1285,9 @@ func writeRingBuffer(s *Reader, available_out *uint, next_out *[]byte, total_out
 	if s.ringbuffer_size == 1<<s.window_bits && s.pos >= s.ringbuffer_size {
 		s.pos -= s.ringbuffer_size
 		s.rb_roundtrips++
+		if s.options.Logger != nil {
+			s.logf("ring buffer wrapped: %d times", s.rb_roundtrips)
+		}
 		if uint(s.pos) != 0 {
 			s.should_wrap_ringbuffer = 1
 		} else {
@@ -1311,12 +1320,35 @@ func ensureRingBuffer(s *Reader) bool {
 	spaceNeeded := int(s.new_ringbuffer_size) + int(kRingBufferWriteAheadSlack)
 	if len(s.ringbuffer) < spaceNeeded {
 		old_ringbuffer = s.ringbuffer
-		s.ringbuffer = make([]byte, spaceNeeded)
+		if window := s.options.WindowBuffer; cap(window) >= spaceNeeded {
+			s.ringbuffer = window[:cap(window)]
+		} else if s.fixedWindow {
+			return false
+		} else {
+			if !s.allocate(&s.windowAlloc, spaceNeeded) {
+				return false
+			}
+			s.ringbuffer = make([]byte, spaceNeeded)
+			s.windowAlloc = spaceNeeded
+			reportAlloc(spaceNeeded, "decoder window")
+		}
 	}
 
 	s.ringbuffer[s.new_ringbuffer_size-2] = 0
 	s.ringbuffer[s.new_ringbuffer_size-1] = 0
 
+	/* Place the custom dictionary at the end of the ring buffer, so that it
+	   is just before the start of the output. The ring buffer is allocated
+	   only once in that case (see calculateRingBufferSize). */
+	if s.ringbuffer_size == 0 && len(s.options.Dictionary) > 0 {
+		var dict []byte = s.options.Dictionary
+		if len(dict) > s.max_backward_distance {
+			dict = dict[len(dict)-s.max_backward_distance:]
+		}
+		copy(s.ringbuffer[s.new_ringbuffer_size-len(dict):], dict)
+		s.custom_dict_size = len(dict)
+	}
+
 	if old_ringbuffer != nil {
 		copy(s.ringbuffer, old_ringbuffer[:uint(s.pos)])
 	}
@@ -1324,6 +1356,12 @@ func ensureRingBuffer(s *Reader) bool {
 	s.ringbuffer_size = s.new_ringbuffer_size
 	s.ringbuffer_mask = s.new_ringbuffer_size - 1
 	s.ringbuffer_end = s.ringbuffer[s.ringbuffer_size:]
+	if s.options.Logger != nil {
+		s.logf("ring buffer: %d bytes", s.ringbuffer_size)
+	}
+	if s.options.OnWindowAlloc != nil {
+		s.options.OnWindowAlloc(s.ringbuffer_size)
+	}
 
 	return true
 }
@@ -1423,7 +1461,8 @@ func calculateRingBufferSize(s *Reader) {
 		min_size = output_size
 	}
 
-	if !(s.canny_ringbuffer_allocation == 0) {
+	/* A custom dictionary is stored at the end of the full-size ring buffer. */
+	if !(s.canny_ringbuffer_allocation == 0) && len(s.options.Dictionary) == 0 {
 		/* Reduce ring buffer size to save memory when server is unscrupulous.
 		   In worst case memory usage might be 1.5x bigger for a short period of
 		   ring buffer reallocation. */
@@ -1847,14 +1886,17 @@ CommandPostDecodeLiterals:
 	}
 
 	if s.max_distance != s.max_backward_distance {
-		if pos < s.max_backward_distance {
-			s.max_distance = pos
+		if pos+s.custom_dict_size < s.max_backward_distance {
+			s.max_distance = pos + s.custom_dict_size
 		} else {
 			s.max_distance = s.max_backward_distance
 		}
 	}
 
 	i = s.copy_length
+	if s.traceCopy != nil {
+		s.traceCopy(s.distance_code, s.copy_length, s.distance_code > s.max_distance)
+	}
 
 	/* Apply copy of LZ77 back-reference, or static dictionary reference if
 	   the distance is larger than the max LZ77 distance */
@@ -1876,6 +1918,11 @@ CommandPostDecodeLiterals:
 			var word_idx int = address & mask
 			var transform_idx int = address >> shift
 
+			/* A replacement dictionary may have no words of this length. */
+			if shift == 0 {
+				return decoderErrorFormatDictionary
+			}
+
 			/* Compensate double distance-ring-buffer roll. */
 			s.dist_rb_idx += s.distance_context
 
@@ -1887,6 +1934,9 @@ CommandPostDecodeLiterals:
 			if transform_idx < int(trans.num_transforms) {
 				word := words.data[offset:]
 				var len int = i
+				if s.traceDictionary != nil {
+					s.traceDictionary(i, transform_idx != int(trans.cutOffTransforms[0]))
+				}
 				if transform_idx == int(trans.cutOffTransforms[0]) {
 					copy(s.ringbuffer[pos:], word[:uint(len)])
 				} else {
@@ -2025,6 +2075,7 @@ func maxDistanceSymbol(ndirect uint32, npostfix uint32) uint32 {
 func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, available_out *uint, next_out *[]byte) int {
 	var result int = decoderSuccess
 	var br *bitReader = &s.br
+	var start_available_in uint = *available_in
 
 	/* Do not try to process further in a case of unrecoverable error. */
 	if int(s.error_code) < 0 {
@@ -2174,9 +2225,17 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 		/* Fall through. */
 		case stateInitialize:
 			s.max_backward_distance = (1 << s.window_bits) - windowGap
+			s.stats.WindowBits = int(s.window_bits)
+			if s.options.Logger != nil {
+				s.logf("window: %d bits", s.window_bits)
+			}
 
 			/* Allocate memory for both block_type_trees and block_len_trees. */
-			s.block_type_trees = make([]huffmanCode, (3 * (huffmanMaxSize258 + huffmanMaxSize26)))
+			if !s.allocate(&s.streamAlloc, 3*(huffmanMaxSize258+huffmanMaxSize26)*huffmanCodeSize) {
+				result = decoderErrorAllocBlockTypeTrees
+				break
+			}
+			s.block_type_trees = reuseCodes(&s.blockTypeTreesBuf, 3*(huffmanMaxSize258+huffmanMaxSize26))
 
 			if s.block_type_trees == nil {
 				result = decoderErrorAllocBlockTypeTrees
@@ -2204,28 +2263,47 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 
 			if s.is_metadata != 0 || s.is_uncompressed != 0 {
-				if !bitReaderJumpToByteBoundary(br) {
+				if !bitReaderJumpToByteBoundary(br) && !s.options.Lenient {
 					result = decoderErrorFormatPadding1
 					break
 				}
 			}
 
 			if s.is_metadata != 0 {
+				if s.options.Logger != nil {
+					s.logf("metadata metablock: %d bytes", s.meta_block_remaining_len)
+				}
+
+				/* A size hint is only recognized before any data. */
+				s.metadataLen = 0
+				s.collectSizeHint = s.ringbuffer_size == 0 && s.meta_block_remaining_len == sizeHintLen
 				s.state = stateMetadata
 				break
 			}
 
 			if s.meta_block_remaining_len == 0 {
+				if s.options.Logger != nil {
+					s.logf("empty metablock")
+				}
 				s.state = stateMetablockDone
 				break
 			}
 
 			calculateRingBufferSize(s)
 			if s.is_uncompressed != 0 {
+				if s.options.Logger != nil {
+					s.logf("uncompressed metablock: %d bytes", s.meta_block_remaining_len)
+				}
+				if s.traceUncompressed != nil {
+					s.traceUncompressed()
+				}
 				s.state = stateUncompressed
 				break
 			}
 
+			if s.options.Logger != nil {
+				s.logf("compressed metablock: %d bytes", s.meta_block_remaining_len)
+			}
 			s.loop_counter = 0
 			s.state = stateHuffmanCode0
 
@@ -2239,14 +2317,21 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			for ; s.meta_block_remaining_len > 0; s.meta_block_remaining_len-- {
 				var bits uint32
 
-				/* Read one byte and ignore it. */
+				/* Read one byte and ignore it, unless it may be part of a size hint. */
 				if !safeReadBits(br, 8, &bits) {
 					result = decoderNeedsMoreInput
 					break
 				}
+				if s.collectSizeHint {
+					s.metadataBuf[s.metadataLen] = byte(bits)
+					s.metadataLen++
+				}
 			}
 
 			if result == decoderSuccess {
+				if s.collectSizeHint {
+					s.sizeHint, s.hasSizeHint = parseSizeHint(s.metadataBuf[:])
+				}
 				s.state = stateMetablockDone
 			}
 
@@ -2318,7 +2403,11 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				bits >>= 2
 				s.num_direct_distance_codes = numDistanceShortCodes + (bits << s.distance_postfix_bits)
 				s.distance_postfix_mask = int(bitMask(s.distance_postfix_bits))
-				s.context_modes = make([]byte, uint(s.num_block_types[0]))
+				if !s.allocate(&s.tableAlloc, int(s.num_block_types[0])) {
+					result = decoderErrorAllocContextModes
+					break
+				}
+				s.context_modes = reuseBytes(&s.contextModesBuf, int(s.num_block_types[0]))
 				if s.context_modes == nil {
 					result = decoderErrorAllocContextModes
 					break
@@ -2340,7 +2429,7 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			fallthrough
 
 		case stateContextMap1:
-			result = decodeContextMap(s.num_block_types[0]<<literalContextBits, &s.num_literal_htrees, &s.context_map, s)
+			result = decodeContextMap(s.num_block_types[0]<<literalContextBits, &s.num_literal_htrees, &s.context_map, &s.contextMapBuf, s)
 
 			if result != decoderSuccess {
 				break
@@ -2363,7 +2452,7 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 					max_distance_symbol = num_distance_codes
 				}
 				var allocation_success bool = true
-				result = decodeContextMap(s.num_block_types[2]<<distanceContextBits, &s.num_dist_htrees, &s.dist_context_map, s)
+				result = decodeContextMap(s.num_block_types[2]<<distanceContextBits, &s.num_dist_htrees, &s.dist_context_map, &s.distContextMapBuf, s)
 				if result != decoderSuccess {
 					break
 				}
@@ -2467,13 +2556,18 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				break
 			}
 
+			if s.options.OnMetablockBytes != nil {
+				s.markMetablockEnd(start_available_in - *available_in)
+			}
+			s.stats.Metablocks++
+
 			decoderStateCleanupAfterMetablock(s)
 			if s.is_last_metablock == 0 {
 				s.state = stateMetablockBegin
 				break
 			}
 
-			if !bitReaderJumpToByteBoundary(br) {
+			if !bitReaderJumpToByteBoundary(br) && !s.options.Lenient {
 				result = decoderErrorFormatPadding2
 				break
 			}
@@ -0,0 +1,130 @@
+package brotli
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// DefaultDeltaHistory is the amount of the previous message used as the
+// dictionary by NewDeltaWriter and NewDeltaReader if maxHistory is not
+// positive.
+const DefaultDeltaHistory = 64 << 10
+
+// A DeltaWriter compresses a sequence of messages, each as a separate brotli
+// stream that uses (the end of) the previous message as its
+// WriterOptions.Dictionary. This suits streams of similar messages, such as
+// periodic samples of a time series, which then compress to little more than
+// their differences. Each message can only be decoded by a DeltaReader that
+// has decoded all the messages before it, with the same maxHistory.
+type DeltaWriter struct {
+	w          *Writer
+	maxHistory int
+	history    []byte // the dictionary for the current message
+	cur        []byte // the end of the current message
+}
+
+// NewDeltaWriter returns a DeltaWriter that compresses the first message to
+// dst. At most maxHistory bytes from the end of each message are used for
+// the next one.
+func NewDeltaWriter(dst io.Writer, maxHistory int, options WriterOptions) *DeltaWriter {
+	if maxHistory <= 0 {
+		maxHistory = DefaultDeltaHistory
+	}
+	dw := &DeltaWriter{maxHistory: maxHistory}
+	options.Dictionary = nil
+	dw.w = NewWriterOptions(dst, options)
+	return dw
+}
+
+// Write compresses p as part of the current message.
+func (dw *DeltaWriter) Write(p []byte) (n int, err error) {
+	n, err = dw.w.Write(p)
+	dw.cur = appendHistory(dw.cur, p[:n], dw.maxHistory)
+	return n, err
+}
+
+// Close ends the current message, which becomes the history for the next
+// one. It does not close the underlying writer.
+func (dw *DeltaWriter) Close() error {
+	if err := dw.w.Close(); err != nil {
+		return err
+	}
+	dw.history, dw.cur = lastBytes(dw.cur, dw.maxHistory), dw.history[:0]
+	return nil
+}
+
+// Reset starts the next message, writing it to dst. If the current message
+// was not closed, it is discarded, and the next message uses the same
+// history instead.
+func (dw *DeltaWriter) Reset(dst io.Writer) {
+	dw.cur = dw.cur[:0]
+	dw.w.options.Dictionary = dw.history
+	dw.w.Reset(dst)
+}
+
+// A DeltaReader decompresses a sequence of messages written by a
+// DeltaWriter, keeping the history needed to decode each one.
+type DeltaReader struct {
+	r          *Reader
+	maxHistory int
+	history    []byte // the dictionary for the current message
+	cur        []byte // the end of the current message
+}
+
+// NewDeltaReader returns a DeltaReader that decompresses the first message
+// from src. maxHistory must be the same as for the DeltaWriter.
+func NewDeltaReader(src io.Reader, maxHistory int, options ReaderOptions) *DeltaReader {
+	if maxHistory <= 0 {
+		maxHistory = DefaultDeltaHistory
+	}
+	dr := &DeltaReader{maxHistory: maxHistory}
+	options.Dictionary = nil
+	dr.r = NewReaderOptions(src, options)
+	return dr
+}
+
+// Read decompresses data from the current message.
+func (dr *DeltaReader) Read(p []byte) (n int, err error) {
+	n, err = dr.r.Read(p)
+	dr.cur = appendHistory(dr.cur, p[:n], dr.maxHistory)
+	if err == io.EOF && dr.r.state != stateDone {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Reset starts the next message, reading it from src. Since the whole
+// current message is needed as history, any part of it that hasn't been read
+// yet is decoded (and discarded) first; if that fails, the error is returned
+// and the DeltaReader can't decode further messages.
+func (dr *DeltaReader) Reset(src io.Reader) error {
+	if dr.r.state != stateDone || decoderHasMoreOutput(dr.r) {
+		if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+			return err
+		}
+	}
+	dr.history, dr.cur = lastBytes(dr.cur, dr.maxHistory), dr.history[:0]
+	dr.r.options.Dictionary = dr.history
+	return dr.r.Reset(src)
+}
+
+// appendHistory appends p to h, dropping data from the front once h would
+// hold more than twice max bytes, so that the last max bytes are kept
+// without copying them on every call.
+func appendHistory(h, p []byte, max int) []byte {
+	if len(p) >= max {
+		return append(h[:0], p[len(p)-max:]...)
+	}
+	if len(h)+len(p) > 2*max {
+		h = append(h[:0], lastBytes(h, max-len(p))...)
+	}
+	return append(h, p...)
+}
+
+// lastBytes returns the last n bytes of b, or all of it if it is shorter.
+func lastBytes(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[len(b)-n:]
+	}
+	return b
+}
@@ -1,8 +1,11 @@
 package brotli
 
 import (
+	"context"
+	"hash/fnv"
 	"io"
 	"math"
+	"math/bits"
 )
 
 /* Copyright 2016 Google Inc. All Rights Reserved.
@@ -71,16 +74,69 @@ const (
 	streamMetadataBody   = 4
 )
 
+// A Writer compresses the data written to it and writes the compressed
+// stream to an underlying writer. Whatever the options, it only ever appends
+// its output, in order, with the underlying writer's Write method: it never
+// seeks back to fill in a header or retract output, even if the underlying
+// writer implements io.Seeker or io.WriterAt, so it can write to an
+// append-only store.
 type Writer struct {
 	dst     io.Writer
 	options WriterOptions
 	err     error
+	ctx     context.Context // during WriteContext, FlushContext, or CloseContext
+
+	// bytesIn and bytesOut count the uncompressed bytes accepted and the
+	// compressed bytes written to dst since the last Reset; sizeEstimate
+	// remembers bytesOut from the previous stream.
+	bytesIn      int64
+	bytesOut     int64
+	sizeEstimate int64
+	stats        MatchStats
+	info         EncodeInfo
+	sinceFlush   int    // bytes written since the last Flush
+	outBuf       []byte // output held back to write IOBufferSize at a time
+	blockIndex   int    // the number of blocks reported to OnBlockHash
+	streamIn     int    // bytes written to the current stream, with GrowWindow
+
+	// written counts the bytes accepted by Write, and accepted those passed
+	// on to be compressed (the same, but for WriterOptions.Preprocess, and
+	// ahead of written during a Write). flushedIn is the input represented
+	// by the output as of the last Flush or Close.
+	written   int64
+	accepted  int64
+	flushedIn int64
+
+	// While holding is set, held collects the input, so that the window
+	// size can be chosen (if autoWindow is set) or the size hint written
+	// once the size of the whole stream is known.
+	holding    bool
+	autoWindow bool
+	held       []byte
+	// unprocessed collects the input for options.Preprocess.
+	unprocessed []byte
+	// emittingMetadata exempts the size hint and alignment padding from the
+	// AbortIfLarger check, which they would fail because they aren't
+	// compressed input.
+	emittingMetadata bool
+	// staticDict is parsed from options.ReplaceBuiltinDictionary by
+	// NewWriterOptions; staticDictErr reports invalid data.
+	staticDict    *encoderDictionary
+	staticDictErr error
+	// preparedDict is options.PreparedDictionary, or options.Dictionaries
+	// stacked by NewWriterOptions.
+	preparedDict *PreparedDictionary
+	// frames writes each message for options.FramePerWrite.
+	frames *MessageWriter
+	// maxOutput, if positive, is the output limit set by NewWriterLimit.
+	maxOutput int64
 
 	params              encoderParams
 	hasher_             hasherHandle
 	input_pos_          uint64
 	ringbuffer_         ringBuffer
 	commands            []command
+	spare_commands      []command
 	num_literals_       uint
 	last_insert_len_    uint
 	last_flush_pos_     uint64
@@ -112,6 +168,9 @@ type Writer struct {
 }
 
 func inputBlockSize(s *Writer) uint {
+	if s.params.max_metablock_size != 0 && s.params.max_metablock_size < uint(1)<<uint(s.params.lgblock) {
+		return s.params.max_metablock_size
+	}
 	return uint(1) << uint(s.params.lgblock)
 }
 
@@ -144,6 +203,7 @@ func wrapPosition(position uint64) uint32 {
 func (s *Writer) getStorage(size int) []byte {
 	if len(s.storage) < size {
 		s.storage = make([]byte, size)
+		reportAlloc(size, "output buffer")
 	}
 
 	return s.storage
@@ -182,6 +242,7 @@ func getHashTable(s *Writer, quality int, input_size uint, table_size *uint) []i
 			s.large_table_size_ = htsize
 			s.large_table_ = nil
 			s.large_table_ = make([]int, htsize)
+			reportAlloc(int(htsize)*bits.UintSize/8, "hash table")
 		}
 
 		table = s.large_table_
@@ -432,7 +493,7 @@ func chooseContextMode(params *encoderParams, data []byte, pos uint, mask uint,
 	return contextUTF8
 }
 
-func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes uint, is_last bool, literal_context_mode int, params *encoderParams, prev_byte byte, prev_byte2 byte, num_literals uint, commands []command, saved_dist_cache []int, dist_cache []int, storage_ix *uint, storage []byte) {
+func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes uint, is_last bool, literal_context_mode int, params *encoderParams, prev_byte byte, prev_byte2 byte, num_literals uint, commands []command, saved_dist_cache []int, dist_cache []int, storage_ix *uint, storage []byte, info *EncodeInfo) {
 	var wrapped_last_flush_pos uint32 = wrapPosition(last_flush_pos)
 	var last_bytes uint16
 	var last_bytes_bits byte
@@ -447,12 +508,19 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		return
 	}
 
-	if !shouldCompress_encode(data, mask, last_flush_pos, bytes, num_literals, uint(len(commands))) {
+	info.Metablocks++
+
+	/* An uncompressed meta-block can't be the last one, so storing the data
+	   uncompressed means an empty last meta-block has to follow it. */
+	var allow_uncompressed bool = !is_last || !params.compact_end
+
+	if allow_uncompressed && !shouldCompress_encode(data, mask, last_flush_pos, bytes, num_literals, uint(len(commands))) {
 		/* Restore the distance cache, as its last update by
 		   CreateBackwardReferences is now unused. */
 		copy(dist_cache, saved_dist_cache[:4])
 
 		storeUncompressedMetaBlock(is_last, data, uint(wrapped_last_flush_pos), mask, bytes, storage_ix, storage)
+		info.Stored = true
 		return
 	}
 
@@ -493,7 +561,7 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		freeMetaBlockSplit(mb)
 	}
 
-	if bytes+4 < *storage_ix>>3 {
+	if allow_uncompressed && bytes+4 < *storage_ix>>3 {
 		/* Restore the distance cache and last byte. */
 		copy(dist_cache, saved_dist_cache[:4])
 
@@ -501,6 +569,7 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		storage[1] = byte(last_bytes >> 8)
 		*storage_ix = uint(last_bytes_bits)
 		storeUncompressedMetaBlock(is_last, data, uint(wrapped_last_flush_pos), mask, bytes, storage_ix, storage)
+		info.Stored = true
 	}
 }
 
@@ -538,6 +607,9 @@ func ensureInitialized(s *Writer) bool {
 	s.remaining_metadata_bytes_ = math.MaxUint32
 
 	sanitizeParams(&s.params)
+	if budget := s.options.MemoryBudget; budget > 0 {
+		fitMemoryBudget(&s.params, budget)
+	}
 	s.params.lgblock = computeLgBlock(&s.params)
 	chooseDistanceParams(&s.params)
 
@@ -549,11 +621,14 @@ func ensureInitialized(s *Writer) bool {
 		if s.params.quality == fastOnePassCompressionQuality || s.params.quality == fastTwoPassCompressionQuality {
 			lgwin = brotli_max_int(lgwin, 18)
 		}
+		s.info.LGWin = lgwin
 
 		encodeWindowBits(lgwin, s.params.large_window, &s.last_bytes_, &s.last_bytes_bits_)
 	}
 
-	if s.params.quality == fastOnePassCompressionQuality {
+	/* A command prefix code may have been kept from the previous stream by
+	   Reset; it's stored in the stream like the default one. */
+	if s.params.quality == fastOnePassCompressionQuality && s.cmd_code_numbits_ == 0 {
 		s.cmd_depths_ = [128]byte{
 			0, 4, 4, 5, 6, 6, 7, 7, 7, 7, 7, 8, 8, 8, 8, 8,
 			0, 0, 0, 4, 4, 4, 4, 4, 5, 5, 6, 6, 6, 6, 7, 7,
@@ -592,6 +667,50 @@ func ensureInitialized(s *Writer) bool {
 	return true
 }
 
+/*
+   Fills the ring buffer and the hasher with a custom dictionary, as if it had
+   been compressed just before the input, so that the input can refer back to
+   it. The decoder must use the same dictionary. Only the last
+   maxBackwardLimit(lgwin) bytes of the dictionary are used. Must be called
+   after ensureInitialized, before any input is copied to the ring buffer.
+   The fast one- and two-pass qualities can't use the dictionary, so
+   sanitizeParams raises them to quality 2 when there is one.
+*/
+func encoderSetCustomDictionary(s *Writer, dict []byte) {
+	var max_dict_size uint = maxBackwardLimit(s.params.lgwin)
+	var dict_size uint = uint(len(dict))
+	if s.params.quality == fastOnePassCompressionQuality || s.params.quality == fastTwoPassCompressionQuality || dict_size == 0 {
+		return
+	}
+
+	if dict_size > max_dict_size {
+		dict = dict[dict_size-max_dict_size:]
+		dict_size = max_dict_size
+	}
+
+	copyInputToRingBuffer(s, dict_size, dict)
+	s.last_flush_pos_ = uint64(dict_size)
+	s.last_processed_pos_ = uint64(dict_size)
+	s.prev_byte_ = dict[dict_size-1]
+	if dict_size > 1 {
+		s.prev_byte2_ = dict[dict_size-2]
+	}
+
+	hasherSetup(&s.hasher_, &s.params, dict, 0, dict_size, false)
+	if s.preparedDict == nil || !s.preparedDict.copyWarmTables(s.hasher_, &s.params, dict_size) {
+		storeDictionary(s.hasher_, dict)
+	}
+}
+
+// storeDictionary stores the positions of dict in h, which has been set up
+// for it.
+func storeDictionary(h hasherHandle, dict []byte) {
+	var overlap uint = h.StoreLookahead() - 1
+	for i := uint(0); i+overlap < uint(len(dict)); i++ {
+		h.Store(dict, ^uint(0), i)
+	}
+}
+
 func encoderInitParams(params *encoderParams) {
 	params.mode = defaultMode
 	params.large_window = false
@@ -600,6 +719,9 @@ func encoderInitParams(params *encoderParams) {
 	params.lgblock = 0
 	params.size_hint = 0
 	params.disable_literal_context_modeling = false
+	params.extra_optimize = false
+	params.block_split_passes = 0
+	params.compact_end = false
 	initEncoderDictionary(&params.dictionary)
 	params.dist.distance_postfix_bits = 0
 	params.dist.num_direct_distance_codes = 0
@@ -798,13 +920,42 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 		storage[1] = byte(s.last_bytes_ >> 8)
 		table = getHashTable(s, s.params.quality, uint(bytes), &table_size)
 		if s.params.quality == fastOnePassCompressionQuality {
-			compressFragmentFast(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &storage_ix, storage)
+			compressFragmentFast(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &storage_ix, storage, &s.info)
+		} else {
+			compressFragmentTwoPass(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, s.command_buf_, s.literal_buf_, table, table_size, &storage_ix, storage, &s.info)
+		}
+
+		s.last_bytes_ = uint16(storage[storage_ix>>3])
+		s.last_bytes_bits_ = byte(storage_ix & 7)
+		updateLastProcessedPos(s)
+		s.writeOutput(storage[:storage_ix>>3])
+		return true
+	}
+
+	if s.params.stored_preferred {
+		var storage []byte
+		var storage_ix uint = uint(s.last_bytes_bits_)
+
+		if delta == 0 && !is_last {
+			return true
+		}
+
+		storage = s.getStorage(int(bytes + 16))
+		storage[0] = byte(s.last_bytes_)
+		storage[1] = byte(s.last_bytes_ >> 8)
+		if bytes > 0 {
+			storeUncompressedMetaBlock(is_last, data, uint(wrapped_last_processed_pos), uint(mask), uint(bytes), &storage_ix, storage)
+			s.info.Metablocks++
+			s.info.Stored = true
 		} else {
-			compressFragmentTwoPass(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, s.command_buf_, s.literal_buf_, table, table_size, &storage_ix, storage)
+			writeBits(1, 1, &storage_ix, storage) /* islast */
+			writeBits(1, 1, &storage_ix, storage) /* isempty */
+			jumpToByteBoundary(&storage_ix, storage)
 		}
 
 		s.last_bytes_ = uint16(storage[storage_ix>>3])
 		s.last_bytes_bits_ = byte(storage_ix & 7)
+		s.last_flush_pos_ = s.input_pos_
 		updateLastProcessedPos(s)
 		s.writeOutput(storage[:storage_ix>>3])
 		return true
@@ -887,7 +1038,14 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 		var storage_ix uint = uint(s.last_bytes_bits_)
 		storage[0] = byte(s.last_bytes_)
 		storage[1] = byte(s.last_bytes_ >> 8)
-		writeMetaBlockInternal(data, uint(mask), s.last_flush_pos_, uint(metablock_size), is_last, literal_context_mode, &s.params, s.prev_byte_, s.prev_byte2_, s.num_literals_, s.commands, s.saved_dist_cache_[:], s.dist_cache_[:], &storage_ix, storage)
+		if s.params.max_match_distance > 0 || s.params.max_match_length > 0 {
+			s.spare_commands = limitMatches(s.spare_commands[:0], s.commands, s.last_flush_pos_, uint(metablock_size), &s.params, s.saved_dist_cache_[:], s.dist_cache_[:], &s.num_literals_)
+			s.commands, s.spare_commands = s.spare_commands, s.commands
+		}
+		if s.options.CollectStats {
+			s.stats.addCommands(s.commands, &s.params.dist)
+		}
+		writeMetaBlockInternal(data, uint(mask), s.last_flush_pos_, uint(metablock_size), is_last, literal_context_mode, &s.params, s.prev_byte_, s.prev_byte2_, s.num_literals_, s.commands, s.saved_dist_cache_[:], s.dist_cache_[:], &storage_ix, storage, &s.info)
 		s.last_bytes_ = uint16(storage[storage_ix>>3])
 		s.last_bytes_bits_ = byte(storage_ix & 7)
 		s.last_flush_pos_ = s.input_pos_
@@ -977,6 +1135,9 @@ func checkFlushComplete(s *Writer) {
 
 func encoderCompressStreamFast(s *Writer, op int, available_in *uint, next_in *[]byte) bool {
 	var block_size_limit uint = uint(1) << s.params.lgwin
+	if s.params.max_metablock_size != 0 && s.params.max_metablock_size < block_size_limit {
+		block_size_limit = s.params.max_metablock_size
+	}
 	var buf_size uint = brotli_min_size_t(kCompressFragmentTwoPassBlockSize, brotli_min_size_t(*available_in, block_size_limit))
 	var command_buf []uint32 = nil
 	var literal_buf []byte = nil
@@ -1028,13 +1189,14 @@ func encoderCompressStreamFast(s *Writer, op int, available_in *uint, next_in *[
 			table = getHashTable(s, s.params.quality, block_size, &table_size)
 
 			if s.params.quality == fastOnePassCompressionQuality {
-				compressFragmentFast(*next_in, block_size, is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &storage_ix, storage)
+				compressFragmentFast(*next_in, block_size, is_last, table, table_size, s.cmd_depths_[:], s.cmd_bits_[:], &s.cmd_code_numbits_, s.cmd_code_[:], &storage_ix, storage, &s.info)
 			} else {
-				compressFragmentTwoPass(*next_in, block_size, is_last, command_buf, literal_buf, table, table_size, &storage_ix, storage)
+				compressFragmentTwoPass(*next_in, block_size, is_last, command_buf, literal_buf, table, table_size, &storage_ix, storage, &s.info)
 			}
 
 			*next_in = (*next_in)[block_size:]
 			*available_in -= block_size
+			s.bytesIn += int64(block_size)
 			var out_bytes uint = storage_ix >> 3
 			s.writeOutput(storage[:out_bytes])
 
@@ -1169,6 +1331,7 @@ func encoderCompressStream(s *Writer, op int, available_in *uint, next_in *[]byt
 		if remaining_block_size != 0 && *available_in != 0 {
 			var copy_input_size uint = brotli_min_size_t(remaining_block_size, *available_in)
 			copyInputToRingBuffer(s, copy_input_size, *next_in)
+			s.bytesIn += int64(copy_input_size)
 			*next_in = (*next_in)[copy_input_size:]
 			*available_in -= copy_input_size
 			continue
@@ -1213,8 +1376,114 @@ func (w *Writer) writeOutput(data []byte) {
 		return
 	}
 
-	_, w.err = w.dst.Write(data)
+	if w.options.AbortIfLarger && !w.emittingMetadata && w.bytesOut+int64(len(w.outBuf)+len(data)) > w.bytesIn {
+		w.err = ErrNotCompressible
+		return
+	}
+
+	if w.maxOutput > 0 && w.bytesOut+int64(len(w.outBuf)+len(data)) > w.maxOutput {
+		w.err = ErrOutputFull
+		return
+	}
+
+	if w.options.OnBlockHash != nil {
+		h := fnv.New64a()
+		h.Write(data)
+		w.options.OnBlockHash(w.blockIndex, h.Sum64())
+		w.blockIndex++
+	}
+
+	if w.options.OnFlushChunk != nil {
+		w.outBuf = append(w.outBuf, data...)
+		checkFlushComplete(w)
+		return
+	}
+
+	if size := w.options.IOBufferSize; size > 0 {
+		w.outBuf = append(w.outBuf, data...)
+		var written int = 0
+		for len(w.outBuf)-written >= size && w.err == nil {
+			w.writeDst(w.outBuf[written : written+size])
+			written += size
+		}
+		w.outBuf = w.outBuf[:copy(w.outBuf, w.outBuf[written:])]
+		if w.err == nil {
+			checkFlushComplete(w)
+		}
+		return
+	}
+
+	w.writeDst(data)
 	if w.err == nil {
 		checkFlushComplete(w)
 	}
 }
+
+// writeDst writes data to the underlying writer.
+func (w *Writer) writeDst(data []byte) {
+	var n int
+	if w.ctx != nil {
+		n, w.err = w.writeDstContext(data)
+	} else {
+		n, w.err = writeFull(w.dst, data)
+	}
+	w.bytesOut += int64(n)
+}
+
+// writeFull writes all of data to dst, calling Write again after a short
+// write without an error, which io.Writer allows.
+func writeFull(dst io.Writer, data []byte) (n int, err error) {
+	for n < len(data) {
+		var m int
+		m, err = dst.Write(data[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// contextWriteSize is the most that writeDstContext passes to one Write of
+// the underlying writer, so that w.ctx is checked often enough.
+const contextWriteSize = 32 << 10
+
+// writeDstContext writes data to dst like writeFull, but in pieces of at
+// most contextWriteSize bytes, and gives up before the next piece once w.ctx
+// is done. A Write that has started isn't interrupted.
+func (w *Writer) writeDstContext(data []byte) (n int, err error) {
+	for n < len(data) {
+		if err := w.ctx.Err(); err != nil {
+			return n, err
+		}
+		end := len(data)
+		if end-n > contextWriteSize {
+			end = n + contextWriteSize
+		}
+		m, err := writeFull(w.dst, data[n:end])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// flushOutput writes any output held back by WriterOptions.IOBufferSize, or
+// passes it to WriterOptions.OnFlushChunk.
+func (w *Writer) flushOutput() error {
+	if len(w.outBuf) > 0 && w.err == nil {
+		if w.options.OnFlushChunk != nil {
+			if w.err = w.options.OnFlushChunk(w.outBuf); w.err == nil {
+				w.bytesOut += int64(len(w.outBuf))
+			}
+		} else {
+			w.writeDst(w.outBuf)
+		}
+		w.outBuf = w.outBuf[:0]
+	}
+	return w.err
+}
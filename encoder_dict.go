@@ -1,6 +1,7 @@
 package brotli
 
-/* Dictionary data (words and transforms) for 1 possible context */
+/* Dictionary data (words and transforms) for 1 possible context. The zero
+   value has no words, so that no static dictionary matches are searched for. */
 type encoderDictionary struct {
 	words                 *dictionary
 	cutoffTransformsCount uint32
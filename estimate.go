@@ -0,0 +1,84 @@
+package brotli
+
+import "io/ioutil"
+
+// estimateSampleMax is the most of its sample that EstimateRatio compresses.
+const estimateSampleMax = 64 << 10
+
+// estimateGainFactor scales the savings measured at Quality 1 to those
+// typically achieved at Quality 11 on a whole file of text or markup.
+const estimateGainFactor = 1.5
+
+// EstimateRatio returns a rough estimate of the compression ratio (the
+// uncompressed size divided by the compressed size, so higher is better;
+// this is the inverse of Writer.Ratio) that Quality 11 would achieve on
+// data resembling sample. It compresses (the first 64 KiB of) sample at
+// Quality 1, which is cheap, and scales up the savings.
+//
+// It is a heuristic meant to tell data that compresses well, such as text,
+// from data that barely compresses, such as images or data that is already
+// compressed, for which it returns about 1. The estimate for compressible
+// data may be off by 50% or more in either direction, and samples smaller
+// than a few KiB tend to underestimate the ratio. It returns 1 for an
+// empty sample.
+func EstimateRatio(sample []byte) float64 {
+	if len(sample) > estimateSampleMax {
+		sample = sample[:estimateSampleMax]
+	}
+	if len(sample) == 0 {
+		return 1
+	}
+	w := NewWriterOptions(ioutil.Discard, WriterOptions{Quality: 1})
+	w.Write(sample)
+	if err := w.Close(); err != nil {
+		return 1
+	}
+	ratio := float64(len(sample)) / float64(w.bytesOut)
+	if ratio <= 1 {
+		return 1
+	}
+	return 1 + (ratio-1)*estimateGainFactor
+}
+
+// ScoreDictionary measures how much dict helps to compress samples with
+// the given options, as a WriterOptions.Dictionary. For each sample, it
+// divides the compressed size without the dictionary by the size with it,
+// and it returns the average over the samples, so 1 means no improvement
+// (or less, if the dictionary gets in the way) and 2 means that samples
+// compress to half the size. Empty samples are
+// skipped, and it returns 1 if there is nothing else. It returns 0 if the
+// options are invalid. Since a Writer raises qualities 0 and 1 to 2 to use a
+// dictionary, they are raised to 2 without the dictionary too, so that only
+// the dictionary's effect is measured.
+func ScoreDictionary(dict []byte, samples [][]byte, options WriterOptions) float64 {
+	if options.Quality == fastOnePassCompressionQuality || options.Quality == fastTwoPassCompressionQuality {
+		options.Quality = 2
+	}
+	options.Dictionary = nil
+	options.PreparedDictionary = nil
+	options.Dictionaries = nil
+	without := NewWriterOptions(ioutil.Discard, options)
+	options.Dictionary = dict
+	with := NewWriterOptions(ioutil.Discard, options)
+
+	var total float64
+	n := 0
+	for _, sample := range samples {
+		if len(sample) == 0 {
+			continue
+		}
+		for _, w := range []*Writer{without, with} {
+			w.Reset(ioutil.Discard)
+			w.Write(sample)
+			if err := w.Close(); err != nil {
+				return 0
+			}
+		}
+		total += float64(without.bytesOut) / float64(with.bytesOut)
+		n++
+	}
+	if n == 0 {
+		return 1
+	}
+	return total / float64(n)
+}
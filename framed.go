@@ -0,0 +1,228 @@
+package brotli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The chunked framed format is a sequence of records, each consisting of
+// the length of a compressed chunk (4 bytes, big-endian), the length of its
+// uncompressed data (4 bytes, big-endian), the CRC-32 (IEEE) of the
+// compressed chunk (4 bytes, big-endian), and the compressed chunk itself,
+// which is a complete brotli stream. Since every chunk is independent, the
+// chunks that follow a corrupt one can still be recovered, and the
+// uncompressed length keeps their data offsets right.
+const chunkHeaderSize = 12
+
+// DefaultChunkSize is the amount of uncompressed data per chunk used by
+// NewChunkedFramedWriter if chunkSize is not positive.
+const DefaultChunkSize = 1 << 20
+
+// A ChunkError reports a chunk of a chunked framed stream that is corrupt
+// or truncated.
+type ChunkError struct {
+	// Offset is the position of the chunk's record in the framed stream.
+	Offset int64
+	// DataOffset is the position in the uncompressed data at which the
+	// chunk's contents start.
+	DataOffset int64
+	// Err describes the problem.
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("brotli: chunk at offset %d (data offset %d): %v", e.Offset, e.DataOffset, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error { return e.Err }
+
+var (
+	errChunkChecksum = errors.New("checksum mismatch")
+	errChunkLength   = errors.New("uncompressed length mismatch")
+)
+
+var errNoChunkToSkip = errors.New("brotli: no corrupt chunk to skip")
+
+// A ChunkedFramedWriter compresses data into the chunked framed format,
+// compressing each chunkSize bytes of input as a separate brotli stream.
+type ChunkedFramedWriter struct {
+	dst       io.Writer
+	chunkSize int
+	chunk     []byte
+	encoded   bytes.Buffer
+	w         *Writer
+	err       error
+}
+
+// NewChunkedFramedWriter returns a ChunkedFramedWriter that writes to dst.
+// Smaller chunks localize corruption more precisely, at some cost in
+// compression ratio.
+func NewChunkedFramedWriter(dst io.Writer, chunkSize int, options WriterOptions) *ChunkedFramedWriter {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	fw := &ChunkedFramedWriter{
+		dst:       dst,
+		chunkSize: chunkSize,
+		chunk:     make([]byte, 0, chunkSize),
+	}
+	fw.w = NewWriterOptions(&fw.encoded, options)
+	return fw
+}
+
+// Write buffers p, writing a record each time a chunk is full.
+func (fw *ChunkedFramedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && fw.err == nil {
+		m := copy(fw.chunk[len(fw.chunk):fw.chunkSize], p)
+		fw.chunk = fw.chunk[:len(fw.chunk)+m]
+		n += m
+		p = p[m:]
+		if len(fw.chunk) == fw.chunkSize {
+			fw.writeChunk()
+		}
+	}
+	return n, fw.err
+}
+
+// Close writes the final, partial chunk, if any. It does not close the
+// underlying writer.
+func (fw *ChunkedFramedWriter) Close() error {
+	if len(fw.chunk) > 0 {
+		fw.writeChunk()
+	}
+	return fw.err
+}
+
+func (fw *ChunkedFramedWriter) writeChunk() {
+	if fw.err != nil {
+		return
+	}
+	fw.encoded.Reset()
+	fw.w.Reset(&fw.encoded)
+	if _, fw.err = fw.w.Write(fw.chunk); fw.err != nil {
+		return
+	}
+	if fw.err = fw.w.Close(); fw.err != nil {
+		return
+	}
+
+	var header [chunkHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(fw.encoded.Len()))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(fw.chunk)))
+	binary.BigEndian.PutUint32(header[8:], crc32.ChecksumIEEE(fw.encoded.Bytes()))
+	fw.chunk = fw.chunk[:0]
+	if _, fw.err = writeFull(fw.dst, header[:]); fw.err != nil {
+		return
+	}
+	_, fw.err = writeFull(fw.dst, fw.encoded.Bytes())
+}
+
+// A ChunkedFramedReader decompresses data in the chunked framed format,
+// verifying each chunk's checksum before decompressing it. A corrupt or
+// truncated chunk is reported as a *ChunkError; no data from that chunk is
+// returned, and Read keeps returning the error until SkipChunk is called.
+type ChunkedFramedReader struct {
+	src        io.Reader
+	offset     int64 // offset of the next record in the framed stream
+	dataOffset int64 // uncompressed offset of the next chunk
+	encoded    bytes.Buffer
+	r          *Reader
+	decoded    bytes.Buffer
+	err        error
+	skip       int64 // size of the corrupt record that was read, if any
+	skipData   int64 // uncompressed length recorded for that record
+}
+
+// NewChunkedFramedReader returns a ChunkedFramedReader that reads from src.
+func NewChunkedFramedReader(src io.Reader) *ChunkedFramedReader {
+	return &ChunkedFramedReader{
+		src: src,
+		r:   NewReader(nil),
+	}
+}
+
+func (fr *ChunkedFramedReader) Read(p []byte) (n int, err error) {
+	for fr.decoded.Len() == 0 {
+		if fr.err != nil {
+			return 0, fr.err
+		}
+		fr.err = fr.readChunk()
+	}
+	return fr.decoded.Read(p)
+}
+
+// SkipChunk skips the corrupt chunk that Read has reported with a
+// *ChunkError, so that Read goes on with the next chunk. The skipped chunk's
+// data is missing from the output, but the DataOffset of later chunks still
+// counts it, using the uncompressed length recorded in its header. A
+// truncated chunk can't be skipped, since the stream ends with it; then
+// SkipChunk returns Read's error, and so does Read. If Read hasn't reported
+// a corrupt chunk, SkipChunk returns an error.
+func (fr *ChunkedFramedReader) SkipChunk() error {
+	if _, ok := fr.err.(*ChunkError); !ok {
+		return errNoChunkToSkip
+	}
+	if fr.skip == 0 {
+		return fr.err
+	}
+	fr.offset += fr.skip
+	fr.dataOffset += fr.skipData
+	fr.skip = 0
+	fr.err = nil
+	return nil
+}
+
+// readChunk reads, verifies, and decompresses the next chunk into
+// fr.decoded.
+func (fr *ChunkedFramedReader) readChunk() error {
+	var header [chunkHeaderSize]byte
+	if _, err := io.ReadFull(fr.src, header[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return fr.chunkError(err)
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	dataSize := int64(binary.BigEndian.Uint32(header[4:8]))
+	sum := binary.BigEndian.Uint32(header[8:])
+
+	// Don't trust size enough to allocate it up front.
+	fr.encoded.Reset()
+	if n, err := fr.encoded.ReadFrom(io.LimitReader(fr.src, size)); err != nil {
+		return fr.chunkError(err)
+	} else if n < size {
+		return fr.chunkError(io.ErrUnexpectedEOF)
+	}
+	// The whole record has been read, so if it is corrupt, SkipChunk can
+	// go on with the next one.
+	fr.skip = chunkHeaderSize + size
+	fr.skipData = dataSize
+	if crc32.ChecksumIEEE(fr.encoded.Bytes()) != sum {
+		return fr.chunkError(errChunkChecksum)
+	}
+
+	fr.decoded.Reset()
+	if err := fr.r.Reset(&fr.encoded); err != nil {
+		return fr.chunkError(err)
+	}
+	if _, err := fr.decoded.ReadFrom(fr.r); err != nil {
+		fr.decoded.Reset()
+		return fr.chunkError(err)
+	}
+	if int64(fr.decoded.Len()) != dataSize {
+		fr.decoded.Reset()
+		return fr.chunkError(errChunkLength)
+	}
+	fr.offset += fr.skip
+	fr.skip = 0
+	fr.dataOffset += int64(fr.decoded.Len())
+	return nil
+}
+
+func (fr *ChunkedFramedReader) chunkError(err error) error {
+	return &ChunkError{Offset: fr.offset, DataOffset: fr.dataOffset, Err: err}
+}
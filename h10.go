@@ -43,6 +43,7 @@ func (h *h10) Initialize(params *encoderParams) {
 	h.invalid_pos_ = uint32(0 - h.window_mask_)
 	var num_nodes uint = uint(1) << params.lgwin
 	h.forest = make([]uint32, 2*num_nodes)
+	reportAlloc(4*len(h.forest), "hash table")
 }
 
 func (h *h10) Prepare(one_shot bool, input_size uint, data []byte) {
@@ -251,6 +252,17 @@ func (h *h10) StoreRange(data []byte, mask uint, ix_start uint, ix_end uint) {
 	}
 }
 
+func (h *h10) copyTables(src hasherHandle, n uint) bool {
+	s, ok := src.(*h10)
+	if !ok {
+		return false
+	}
+	h.buckets_ = s.buckets_
+	/* Storing the first n positions only links the nodes of those positions. */
+	copy(h.forest[:2*n], s.forest[:2*n])
+	return true
+}
+
 func (h *h10) StitchToPreviousBlock(num_bytes uint, position uint, ringbuffer []byte, ringbuffer_mask uint) {
 	if num_bytes >= h.HashTypeLength()-1 && position >= 128 {
 		var i_start uint = position - 128 + 1
@@ -48,6 +48,7 @@ func (h *h5) Initialize(params *encoderParams) {
 	h.block_mask_ = uint32(h.block_size_ - 1)
 	h.num = make([]uint16, h.bucket_size_)
 	h.buckets = make([]uint32, h.block_size_*h.bucket_size_)
+	reportAlloc(2*len(h.num)+4*len(h.buckets), "hash table")
 }
 
 func (h *h5) Prepare(one_shot bool, input_size uint, data []byte) {
@@ -85,6 +86,22 @@ func (h *h5) StoreRange(data []byte, mask uint, ix_start uint, ix_end uint) {
 	}
 }
 
+func (h *h5) copyTables(src hasherHandle, n uint) bool {
+	s, ok := src.(*h5)
+	if !ok {
+		return false
+	}
+	copy(h.num, s.num)
+	/* Only the first num[key] entries of a bucket have been written, and
+	   only those are searched. */
+	for key, count := range s.num {
+		var offset uint = uint(key) << uint(h.params.block_bits)
+		var end uint = offset + brotli_min_size_t(uint(count), h.block_size_)
+		copy(h.buckets[offset:end], s.buckets[offset:end])
+	}
+	return true
+}
+
 func (h *h5) StitchToPreviousBlock(num_bytes uint, position uint, ringbuffer []byte, ringbuffer_mask uint) {
 	if num_bytes >= h.HashTypeLength()-1 && position >= 3 {
 		/* Prepare the hashes for three last bytes of the last write.
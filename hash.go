@@ -29,6 +29,14 @@ type hasherHandle interface {
 	Store(data []byte, mask uint, ix uint)
 }
 
+// A tableCopier is a hasher that can take over the tables of another hasher
+// with the same parameters, which has stored the first n positions of a
+// dictionary, instead of storing them itself. copyTables reports false if src
+// isn't of the same type.
+type tableCopier interface {
+	copyTables(src hasherHandle, n uint) bool
+}
+
 const kCutoffTransformsCount uint32 = 10
 
 /*   0,  12,   27,    23,    42,    63,    56,    48,    59,    64 */
@@ -162,6 +170,9 @@ func searchInStaticDictionary(dictionary *encoderDictionary, handle hasherHandle
 	var key uint
 	var i uint
 	var self *hasherCommon = handle.Common()
+	if dictionary.words == nil {
+		return
+	}
 	if self.dict_num_matches < self.dict_num_lookups>>7 {
 		return
 	}
@@ -313,6 +324,9 @@ func hasherSetup(handle *hasherHandle, params *encoderParams, data []byte, posit
 	if *handle == nil {
 		chooseHasher(params, &params.hasher)
 		self = newHasher(params.hasher.type_)
+		if params.long_range_matching {
+			self = longRangeHasher(self, params.quality)
+		}
 
 		*handle = self
 		common = self.Common()
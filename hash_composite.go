@@ -33,6 +33,8 @@ type hashComposite struct {
 	ha     hasherHandle
 	hb     hasherHandle
 	params *encoderParams
+
+	initialized bool
 }
 
 func (h *hashComposite) Initialize(params *encoderParams) {
@@ -44,7 +46,8 @@ func (h *hashComposite) Initialize(params *encoderParams) {
    here that are needed to know the memory size of them. Instead provide
    those params to all hashers InitializehashComposite */
 func (h *hashComposite) Prepare(one_shot bool, input_size uint, data []byte) {
-	if h.ha == nil {
+	if !h.initialized {
+		h.initialized = true
 		var common_a *hasherCommon
 		var common_b *hasherCommon
 
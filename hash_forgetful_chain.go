@@ -71,6 +71,7 @@ func (h *hashForgetfulChain) Initialize(params *encoderParams) {
 		h.banks[i] = make([]slot, bankSize)
 	}
 	h.free_slot_idx = make([]uint16, h.numBanks)
+	reportAlloc(6*bucketSize+4*bankSize*int(h.numBanks), "hash table")
 }
 
 func (h *hashForgetfulChain) Prepare(one_shot bool, input_size uint, data []byte) {
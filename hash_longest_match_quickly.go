@@ -49,6 +49,7 @@ type hashLongestMatchQuickly struct {
 
 func (h *hashLongestMatchQuickly) Initialize(params *encoderParams) {
 	h.buckets = make([]uint32, 1<<h.bucketBits+h.bucketSweep)
+	reportAlloc(4*len(h.buckets), "hash table")
 }
 
 func (h *hashLongestMatchQuickly) Prepare(one_shot bool, input_size uint, data []byte) {
@@ -50,6 +50,7 @@ type hashRolling struct {
 	next_ix       uint
 	factor        uint32
 	factor_remove uint32
+	stale         bool /* table holds positions */
 }
 
 func (h *hashRolling) Initialize(params *encoderParams) {
@@ -67,12 +68,26 @@ func (h *hashRolling) Initialize(params *encoderParams) {
 	}
 
 	h.table = make([]uint32, 16777216)
+	reportAlloc(4*len(h.table), "hash table")
 	for i := 0; i < 16777216; i++ {
 		h.table[i] = kInvalidPosHashRolling
 	}
 }
 
+/* Prepare starts a new stream: unlike the other hashers, the table isn't
+   replaced, so the positions of the previous stream (in a Writer that was
+   Reset) must be forgotten. */
 func (h *hashRolling) Prepare(one_shot bool, input_size uint, data []byte) {
+	if h.stale {
+		for i := range h.table {
+			h.table[i] = kInvalidPosHashRolling
+		}
+		h.stale = false
+	}
+	h.prepareState(input_size, data)
+}
+
+func (h *hashRolling) prepareState(input_size uint, data []byte) {
 	/* Too small size, cannot use this hasher. */
 	if input_size < 32 {
 		return
@@ -112,7 +127,7 @@ func (h *hashRolling) StitchToPreviousBlock(num_bytes uint, position uint, ringb
 		available = ring_buffer_mask - position_masked
 	}
 
-	h.Prepare(false, available, ringbuffer[position&ring_buffer_mask:])
+	h.prepareState(available, ringbuffer[position&ring_buffer_mask:])
 	h.next_ix = position
 }
 
@@ -165,4 +180,5 @@ func (h *hashRolling) FindLongestMatch(dictionary *encoderDictionary, data []byt
 	}
 
 	h.next_ix = cur_ix + uint(h.jump)
+	h.stale = true
 }
@@ -1,8 +1,11 @@
 package brotli
 
 import (
+	"bufio"
 	"compress/gzip"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -36,6 +39,89 @@ func HTTPCompressor(w http.ResponseWriter, r *http.Request) io.WriteCloser {
 	return nopCloser{w}
 }
 
+// RequestBody returns a reader that yields the brotli-compressed contents of
+// r, suitable for use as an http.Request's Body. The compression happens on
+// the fly, in a separate goroutine, as the returned reader is read, so the
+// compressed body is never buffered in memory all at once. Closing the
+// returned reader before it is exhausted stops the compression.
+func RequestBody(r io.Reader, options WriterOptions) (io.ReadCloser, error) {
+	if err := checkOptions(options); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := NewWriterOptions(pw, options)
+		_, err := io.Copy(w, r)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// NewAutoReader returns a reader that decompresses r according to encoding,
+// the value of a Content-Encoding header: "br" for brotli, "gzip" (or
+// "x-gzip") for gzip, or "identity" for no compression. If encoding is
+// empty, r is sniffed for the gzip magic number, and is assumed to be
+// brotli otherwise (since brotli streams have no magic number). Stacked
+// encodings, such as "gzip, br", are not supported. Closing the returned
+// reader does not close r.
+func NewAutoReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "br":
+		return ioutil.NopCloser(NewReader(r)), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "identity":
+		return ioutil.NopCloser(r), nil
+	case "":
+		br := bufio.NewReader(r)
+		if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			return gzip.NewReader(br)
+		}
+		return ioutil.NopCloser(NewReader(br)), nil
+	}
+	return nil, fmt.Errorf("brotli: unsupported Content-Encoding %q", encoding)
+}
+
+// DecodeToChunked decompresses the brotli stream from src and writes the
+// output to dst in writes of chunkSize bytes (except for the last one),
+// such as for a proxy that passes on a compressed upstream response
+// decompressed, with chunked transfer encoding. If dst is an http.Flusher,
+// such as an http.ResponseWriter, it is flushed after each write, so that
+// each chunk goes out as soon as it is decoded. If chunkSize is not
+// positive, 32 KiB is used.
+func DecodeToChunked(dst io.Writer, src io.Reader, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = readBufSize
+	}
+	flusher, _ := dst.(http.Flusher)
+	r := NewReader(src)
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if _, err := writeFull(dst, chunk[:n]); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if r.state != stateDone {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // negotiateContentEncoding returns the best offered content encoding for the
 // request's Accept-Encoding header. If two offers match with equal weight and
 // then the offer earlier in the list is preferred. If no offers are
@@ -96,6 +96,11 @@ type huffmanTreeGroup struct {
 	alphabet_size uint16
 	max_symbol    uint16
 	num_htrees    uint16
+
+	// htreesBuf and codesBuf keep the memory of htrees and codes for the
+	// next metablock.
+	htreesBuf [][]huffmanCode
+	codesBuf  []huffmanCode
 }
 
 const reverseBitsMax = 8
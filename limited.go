@@ -0,0 +1,76 @@
+package brotli
+
+import "io"
+
+// A LimitedReader reads at most a fixed amount of data from another reader,
+// like io.LimitReader, such as the decompressed data of a Reader, but can
+// tell whether there was more: once the limit is reached, it reads one more
+// byte to find out, and Overflowed reports the result. This distinguishes
+// data of exactly the limit from data that was cut off at it.
+type LimitedReader struct {
+	r          io.Reader
+	n          int64 // bytes left before the limit
+	probe      [1]byte
+	checked    bool
+	overflowed bool
+}
+
+// NewLimitedReader returns a LimitedReader that reads at most n bytes from
+// r.
+func NewLimitedReader(r io.Reader, n int64) *LimitedReader {
+	return &LimitedReader{r: r, n: n}
+}
+
+// Read reads from the underlying reader until the limit is reached, and
+// then returns io.EOF, unless looking for more data fails with another
+// error, or with io.ErrNoProgress if the underlying reader keeps returning
+// no data and no error.
+func (lr *LimitedReader) Read(p []byte) (n int, err error) {
+	if lr.n <= 0 {
+		return 0, lr.check()
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err = lr.r.Read(p)
+	lr.n -= int64(n)
+	if err == io.EOF {
+		lr.checked = true
+	}
+	return n, err
+}
+
+// maxEmptyReads is how many times in a row check lets the underlying reader
+// return no data and no error before failing with io.ErrNoProgress, like
+// bufio.Reader.
+const maxEmptyReads = 100
+
+// check looks for data beyond the limit, and returns io.EOF or the error
+// from the underlying reader.
+func (lr *LimitedReader) check() error {
+	if lr.checked {
+		return io.EOF
+	}
+	for i := 0; i < maxEmptyReads; i++ {
+		m, err := lr.r.Read(lr.probe[:])
+		if m > 0 {
+			lr.checked, lr.overflowed = true, true
+			return io.EOF
+		}
+		if err == io.EOF {
+			lr.checked = true
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
+
+// Overflowed reports whether the underlying reader had more data than the
+// limit. It is only known once Read has returned io.EOF; until then, it
+// reports false.
+func (lr *LimitedReader) Overflowed() bool {
+	return lr.overflowed
+}
@@ -0,0 +1,44 @@
+package brotli
+
+import (
+	"bufio"
+	"io"
+)
+
+// DecodeLines decompresses the brotli stream from src and calls onLine with
+// each line of the decompressed data, without its trailing newline, such
+// as for processing a compressed log. The final line is passed even if it
+// doesn't end with a newline. The slice is only valid during the call, and
+// lines can be of any length. DecodeLines stops at the first error from
+// onLine and returns it.
+func DecodeLines(src io.Reader, onLine func([]byte) error) error {
+	r := NewReader(src)
+	br := bufio.NewReader(r)
+	var long []byte // a line longer than br's buffer
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			long = append(long, line...)
+			continue
+		}
+		if len(long) > 0 {
+			line = append(long, line...)
+			long = long[:0]
+		}
+		if err == io.EOF {
+			if r.state != stateDone {
+				return io.ErrUnexpectedEOF
+			}
+			if len(line) > 0 {
+				return onLine(line)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := onLine(line[:len(line)-1]); err != nil {
+			return err
+		}
+	}
+}
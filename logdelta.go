@@ -0,0 +1,172 @@
+package brotli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The log delta format is a brotli stream of records, one for each line:
+// the length of the prefix that the line shares with the previous line, as
+// a uvarint (as in encoding/binary), followed by the rest of the line. A
+// line ends with '\n', which is kept in each record, so it is never part of
+// the shared prefix; only the last line may lack it, and its record then
+// ends at the end of the stream.
+
+var errInvalidLogDelta = errors.New("brotli: invalid log delta record")
+
+// A LogDeltaWriter compresses text made of lines, such as a log file,
+// writing only the part of each line that differs from the start of the
+// previous one, such as a timestamp's last digits and the message. This
+// suits logs whose adjacent lines share long prefixes. A LogDeltaReader
+// reads the text back, byte for byte, including a last line without a
+// newline and any '\r' before the newlines. Each line is held in memory
+// until its newline is written.
+type LogDeltaWriter struct {
+	w    *Writer
+	prev []byte // the previous line
+	line []byte // the current line, until it is complete
+	buf  []byte // the current record
+}
+
+// NewLogDeltaWriter returns a LogDeltaWriter that compresses to dst with
+// the given options.
+func NewLogDeltaWriter(dst io.Writer, options WriterOptions) *LogDeltaWriter {
+	return &LogDeltaWriter{w: NewWriterOptions(dst, options)}
+}
+
+// Write compresses p, writing a record for each line that it completes.
+func (lw *LogDeltaWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			lw.line = append(lw.line, p...)
+			return n + len(p), nil
+		}
+		lw.line = append(lw.line, p[:i+1]...)
+		if err := lw.writeLine(); err != nil {
+			return n, err
+		}
+		n += i + 1
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// writeLine writes the record for lw.line, which becomes lw.prev.
+func (lw *LogDeltaWriter) writeLine() error {
+	shared := len(lw.line)
+	if lw.line[shared-1] == '\n' {
+		shared--
+	}
+	if len(lw.prev) < shared {
+		shared = len(lw.prev)
+	}
+	for i := 0; i < shared; i++ {
+		if lw.line[i] != lw.prev[i] {
+			shared = i
+			break
+		}
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	lw.buf = append(lw.buf[:0], header[:binary.PutUvarint(header[:], uint64(shared))]...)
+	lw.buf = append(lw.buf, lw.line[shared:]...)
+	if _, err := lw.w.Write(lw.buf); err != nil {
+		return err
+	}
+	lw.prev, lw.line = lw.line, lw.prev[:0]
+	return nil
+}
+
+// Flush writes the records of the complete lines so far, like
+// Writer.Flush.
+func (lw *LogDeltaWriter) Flush() error {
+	return lw.w.Flush()
+}
+
+// Close writes the last line, if it has no newline, and finishes the
+// stream. It does not close the underlying writer.
+func (lw *LogDeltaWriter) Close() error {
+	if len(lw.line) > 0 {
+		if err := lw.writeLine(); err != nil {
+			return err
+		}
+	}
+	return lw.w.Close()
+}
+
+// A LogDeltaReader reads the text written by a LogDeltaWriter.
+type LogDeltaReader struct {
+	r    *Reader
+	src  *bufio.Reader
+	prev []byte // the previous line
+	out  []byte // the part of prev that hasn't been read yet
+	done bool   // the last line had no newline
+}
+
+// NewLogDeltaReader returns a LogDeltaReader that decompresses from src
+// with the given options.
+func NewLogDeltaReader(src io.Reader, options ReaderOptions) *LogDeltaReader {
+	r := NewReaderOptions(src, options)
+	return &LogDeltaReader{r: r, src: bufio.NewReader(r)}
+}
+
+// Read reads the text, a line at a time.
+func (lr *LogDeltaReader) Read(p []byte) (n int, err error) {
+	for len(lr.out) == 0 {
+		if err := lr.readLine(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, lr.out)
+	lr.out = lr.out[n:]
+	return n, nil
+}
+
+// readLine decodes the next record into lr.prev.
+func (lr *LogDeltaReader) readLine() error {
+	if lr.done {
+		return io.EOF
+	}
+	shared, err := binary.ReadUvarint(lr.src)
+	if err == io.EOF {
+		if lr.r.state != stateDone {
+			return io.ErrUnexpectedEOF
+		}
+		return io.EOF
+	}
+	if err == io.ErrUnexpectedEOF || err == nil && shared > uint64(len(lr.prev)) {
+		return errInvalidLogDelta
+	}
+	if err != nil {
+		return err
+	}
+
+	line := lr.prev[:shared]
+	for {
+		rest, err := lr.src.ReadSlice('\n')
+		line = append(line, rest...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			if lr.r.state != stateDone {
+				return io.ErrUnexpectedEOF
+			}
+			if len(line) == 0 {
+				return errInvalidLogDelta
+			}
+			lr.done = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	lr.prev, lr.out = line, line
+	return nil
+}
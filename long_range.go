@@ -0,0 +1,14 @@
+package brotli
+
+// longRangeHasher adds the rolling hasher of the large-window hashers (35,
+// 55 and 65) to ha, for WriterOptions.LongRangeMatching. It hashes every
+// byte of the 32 (jump 1): sampling every fourth byte, as hashers 35 and 55
+// do, makes too many windows of text that follows a template, like log
+// lines, look alike, and the one position in each bucket is then rarely a
+// match.
+func longRangeHasher(ha hasherHandle, quality int) hasherHandle {
+	if _, ok := ha.(*hashComposite); ok || quality < 2 || quality > 9 {
+		return ha
+	}
+	return &hashComposite{ha: ha, hb: &hashRolling{jump: 1}}
+}
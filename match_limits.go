@@ -0,0 +1,100 @@
+package brotli
+
+// minMatchLengthLimit is the smallest valid WriterOptions.MaxMatchLength,
+// the shortest copy that the format allows.
+const minMatchLengthLimit = 2
+
+// limitMatches appends to dst the commands of a metablock that starts at
+// position start and holds size bytes, rewritten so that no copy is longer
+// than params.max_match_length or further back than
+// params.max_match_distance. Copies that are too long are split, and those
+// that can't be kept become literals, which are added to numLiterals. Since
+// that changes the distance cache, the distance codes are recomputed,
+// starting from savedDistCache, the cache at the start of the metablock;
+// distCache is set to the cache after the rewritten commands.
+func limitMatches(dst []command, commands []command, start uint64, size uint, params *encoderParams, savedDistCache []int, distCache []int, numLiterals *uint) []command {
+	maxDist := params.max_match_distance
+	maxLen := params.max_match_length
+	maxBackward := uint64(maxBackwardLimit(params.lgwin))
+
+	// oldCache follows the original commands, to find their distances;
+	// newCache follows the rewritten ones.
+	var oldCache, newCache [4]int
+	copy(oldCache[:], savedDistCache)
+	copy(newCache[:], savedDistCache)
+
+	pos := start
+	end := start + uint64(size)
+	var literals uint // carried over to the next command's insert
+	for i := range commands {
+		cmd := &commands[i]
+		insert := uint(cmd.insert_len_) + literals
+		literals = 0
+		pos += uint64(cmd.insert_len_)
+		if pos >= end {
+			// The final insert-only command.
+			literals = insert
+			break
+		}
+
+		copyLen := uint(commandCopyLen(cmd))
+		lenCodeDelta := int(commandCopyLenCode(cmd)) - int(copyLen)
+		maxDistance := pos
+		if maxDistance > maxBackward {
+			maxDistance = maxBackward
+		}
+		code := uint(commandRestoreDistanceCode(cmd, &params.dist))
+		distance := code - (numDistanceShortCodes - 1)
+		if code < numDistanceShortCodes {
+			distance = uint(oldCache[kDistanceCacheIndex[code]] + kDistanceCacheOffset[code])
+		}
+		isDictionary := uint64(distance) > maxDistance
+		if !isDictionary && code > 0 {
+			oldCache[3], oldCache[2], oldCache[1], oldCache[0] = oldCache[2], oldCache[1], oldCache[0], int(distance)
+		}
+
+		if maxDist > 0 && (isDictionary || distance > maxDist) || maxLen > 0 && isDictionary && copyLen > maxLen {
+			// Write the copied bytes as literals instead.
+			literals = insert + copyLen
+			*numLiterals += copyLen
+			pos += uint64(copyLen)
+			continue
+		}
+
+		for copyLen > 0 {
+			n := copyLen
+			if maxLen > 0 && n > maxLen {
+				n = maxLen
+				if copyLen-n == 1 && n > minMatchLengthLimit {
+					// Leave enough for another copy.
+					n--
+				}
+			}
+			if n == 1 {
+				literals = 1
+				*numLiterals++
+				pos++
+				break
+			}
+			maxDistance = pos
+			if maxDistance > maxBackward {
+				maxDistance = maxBackward
+			}
+			distanceCode := computeDistanceCode(distance, uint(maxDistance), newCache[:])
+			if !isDictionary && distanceCode > 0 {
+				newCache[3], newCache[2], newCache[1], newCache[0] = newCache[2], newCache[1], newCache[0], int(distance)
+			}
+			dst = append(dst, makeCommand(&params.dist, insert, n, lenCodeDelta, distanceCode))
+			insert = 0
+			pos += uint64(n)
+			copyLen -= n
+		}
+		literals += insert
+	}
+
+	if literals > 0 {
+		dst = append(dst, makeInsertCommand(literals))
+	}
+	copy(distCache, newCache[:])
+	return dst
+}
@@ -0,0 +1,68 @@
+package brotli
+
+import "math/bits"
+
+// The sizes of the encoder's structs that take the most memory, in bytes.
+const (
+	commandSize       = 16 // command
+	zopfliNodeSize    = 24 // zopfliNode
+	backwardMatchSize = 8  // backwardMatch
+)
+
+// encoderMemory estimates the memory, in bytes, that a Writer allocates
+// with params (after sanitizeParams) for its window, hash table and
+// buffers. The Writer's smaller tables and the Go runtime's overhead aren't
+// included.
+func encoderMemory(params *encoderParams) int {
+	p := *params
+	p.lgblock = computeLgBlock(&p)
+	block := 1 << uint(p.lgblock)
+	metablock := int(maxMetablockSize(&p))
+	// The ring buffer, and the storage for a compressed metablock.
+	mem := 1<<uint(computeRbBits(&p)) + block + 2*metablock + 503
+
+	if p.quality <= fastTwoPassCompressionQuality {
+		mem += int(maxHashTableSize(p.quality)) * bits.UintSize / 8
+		if p.quality == fastTwoPassCompressionQuality {
+			// The command and literal buffers.
+			mem += 5 * int(kCompressFragmentTwoPassBlockSize)
+		}
+		return mem
+	}
+
+	// At most one command for every 2 bytes, and more for merging blocks.
+	mem += (metablock/2 + metablock/4) * commandSize
+	chooseHasher(&p, &p.hasher)
+	switch hp := &p.hasher; hp.type_ {
+	case 2, 3, 4, 54:
+		h := newHasher(hp.type_).(*hashLongestMatchQuickly)
+		mem += 4 << uint(h.bucketBits)
+	case 5, 6:
+		mem += 2<<uint(hp.bucket_bits) + 4<<uint(hp.bucket_bits+hp.block_bits)
+	case 10:
+		mem += 4<<17 + 8<<p.lgwin
+		// The nodes of the shortest path search, and for quality 11 the
+		// matches found at each position.
+		mem += block * zopfliNodeSize
+		if p.quality == hqZopflificationQuality {
+			mem += 4 * block * backwardMatchSize
+		}
+	case 40, 41, 42:
+		h := newHasher(hp.type_).(*hashForgetfulChain)
+		mem += 6<<uint(h.bucketBits) + 4<<uint(h.bankBits)*int(h.numBanks)
+	}
+	if p.long_range_matching {
+		mem += 4 << 24
+	}
+	return mem
+}
+
+// fitMemoryBudget reduces the window in params (after sanitizeParams) until
+// the Writer's memory is within budget, if possible, and returns the
+// window.
+func fitMemoryBudget(params *encoderParams, budget int) uint {
+	for params.lgwin > minWindowBits && encoderMemory(params) > budget {
+		params.lgwin--
+	}
+	return params.lgwin
+}
@@ -0,0 +1,130 @@
+package brotli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// The message format is a sequence of records, each consisting of the length
+// of a compressed message as a uvarint (as in encoding/binary), followed by
+// the message, a complete brotli stream.
+
+var errInvalidMessage = errors.New("brotli: invalid message record")
+
+// A MessageWriter writes a sequence of small messages, each compressed
+// separately, to a single stream, such as a connection shared by many RPCs.
+// A MessageReader reads them back. WriterOptions.Dictionary (and the
+// matching ReaderOptions.Dictionary) can hold data that the messages have in
+// common, which helps a great deal with small messages.
+type MessageWriter struct {
+	dst io.Writer
+	w   *Writer
+	buf bytes.Buffer
+	err error
+}
+
+// NewMessageWriter returns a MessageWriter that writes to dst, compressing
+// messages with the given options.
+func NewMessageWriter(dst io.Writer, options WriterOptions) *MessageWriter {
+	mw := &MessageWriter{dst: dst}
+	mw.w = NewWriterOptions(&mw.buf, options)
+	return mw
+}
+
+// WriteMessage compresses msg and writes it as the next record.
+func (mw *MessageWriter) WriteMessage(msg []byte) error {
+	if mw.err != nil {
+		return mw.err
+	}
+	mw.buf.Reset()
+	mw.w.Reset(&mw.buf)
+	if _, mw.err = mw.w.Write(msg); mw.err != nil {
+		return mw.err
+	}
+	if mw.err = mw.w.Close(); mw.err != nil {
+		return mw.err
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(mw.buf.Len()))
+	if _, mw.err = writeFull(mw.dst, header[:n]); mw.err != nil {
+		return mw.err
+	}
+	_, mw.err = writeFull(mw.dst, mw.buf.Bytes())
+	return mw.err
+}
+
+// A MessageReader reads the messages written by a MessageWriter.
+type MessageReader struct {
+	src  *bufio.Reader
+	part io.LimitedReader // the current record's message
+	r    *Reader
+}
+
+// NewMessageReader returns a MessageReader that reads from src, decoding
+// messages with the given options.
+func NewMessageReader(src io.Reader, options ReaderOptions) *MessageReader {
+	mr := &MessageReader{src: bufio.NewReader(src)}
+	mr.r = NewReaderOptions(&mr.part, options)
+	return mr
+}
+
+// ReadMessage reads and decompresses the next message. It returns io.EOF if
+// there are no more messages.
+func (mr *MessageReader) ReadMessage() ([]byte, error) {
+	size, err := binary.ReadUvarint(mr.src)
+	if err == io.ErrUnexpectedEOF || err == nil && size > math.MaxInt32 {
+		return nil, errInvalidMessage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mr.part = io.LimitedReader{R: mr.src, N: int64(size)}
+	if err := mr.r.Reset(&mr.part); err != nil {
+		return nil, err
+	}
+	msg, err := ioutil.ReadAll(mr.r)
+	if err == nil && mr.r.state != stateDone {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mr.part.N > 0 {
+		// There is data after the end of the brotli stream.
+		return nil, errInvalidMessage
+	}
+	return msg, nil
+}
+
+// writeFrame writes p as a message, for WriterOptions.FramePerWrite.
+func (w *Writer) writeFrame(p []byte) (n int, err error) {
+	if w.dst == nil {
+		return 0, errWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.err = w.frames.WriteMessage(p); w.err != nil {
+		return 0, w.err
+	}
+	w.written += int64(len(p))
+	w.accepted = w.written
+	w.flushedIn = w.written
+	return len(p), nil
+}
+
+// closeFrames is Close with WriterOptions.FramePerWrite.
+func (w *Writer) closeFrames() error {
+	if w.dst == nil {
+		return errWriterClosed
+	}
+	w.dst = nil
+	return w.err
+}
@@ -0,0 +1,76 @@
+package brotli
+
+// An OptionsBuilder builds a WriterOptions with chained method calls, as in
+//
+//	opts, err := brotli.Options().Quality(9).Window(22).Mode(brotli.ModeText).Build()
+//
+// It is an alternative to writing a WriterOptions literal, with the
+// validation done in one place by Build.
+type OptionsBuilder struct {
+	options WriterOptions
+}
+
+// Options returns an OptionsBuilder starting from the zero WriterOptions.
+func Options() *OptionsBuilder {
+	return new(OptionsBuilder)
+}
+
+// Quality sets WriterOptions.Quality.
+func (b *OptionsBuilder) Quality(quality int) *OptionsBuilder {
+	b.options.Quality = quality
+	return b
+}
+
+// Window sets WriterOptions.LGWin.
+func (b *OptionsBuilder) Window(lgwin int) *OptionsBuilder {
+	b.options.LGWin = lgwin
+	return b
+}
+
+// Mode sets WriterOptions.Mode.
+func (b *OptionsBuilder) Mode(mode Mode) *OptionsBuilder {
+	b.options.Mode = mode
+	return b
+}
+
+// MaxQualityForLargeInput sets WriterOptions.LargeInputSize and
+// LargeInputQuality, capping the quality at cappedQuality for streams larger
+// than sizeThreshold bytes.
+func (b *OptionsBuilder) MaxQualityForLargeInput(sizeThreshold, cappedQuality int) *OptionsBuilder {
+	b.options.LargeInputSize = sizeThreshold
+	b.options.LargeInputQuality = cappedQuality
+	return b
+}
+
+// Build returns the options, or an error if any of them is out of range.
+func (b *OptionsBuilder) Build() (WriterOptions, error) {
+	if err := checkOptions(b.options); err != nil {
+		return WriterOptions{}, err
+	}
+	return b.options, nil
+}
+
+// PresetFastest returns options for compressing as fast as possible, such as
+// for data that is only stored briefly or sent over a fast network.
+func PresetFastest() WriterOptions {
+	return WriterOptions{Quality: BestSpeed}
+}
+
+// PresetBalanced returns options that trade speed against size about evenly,
+// such as for compressing dynamic responses or logs on the fly.
+func PresetBalanced() WriterOptions {
+	return WriterOptions{Quality: DefaultCompression}
+}
+
+// PresetSmallest returns options for the smallest output, however slow, with
+// the largest standard window (16 MiB, which a Reader also needs), such as
+// for release archives that are compressed once and downloaded many times.
+func PresetSmallest() WriterOptions {
+	return WriterOptions{Quality: BestCompression, LGWin: maxWindowBits}
+}
+
+// PresetWeb returns options for precompressing static web content, such as
+// HTML, CSS, and JavaScript, with the window that browsers handle well.
+func PresetWeb() WriterOptions {
+	return WriterOptions{Quality: BestCompression, LGWin: defaultWindow, Mode: ModeText}
+}
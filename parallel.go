@@ -0,0 +1,147 @@
+package brotli
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+)
+
+// A ParallelWriter compresses data on several goroutines at once. It cuts
+// the input into chunks of a fixed size, at fixed offsets (0, chunkSize,
+// 2*chunkSize, and so on) that don't depend on how the data is written or
+// on how fast the workers are, and compresses each chunk as a separate
+// brotli stream. The streams are written in order, so the output is the
+// same byte for byte whatever the number of workers, such as for
+// reproducible builds. Since each chunk loses the history of the ones
+// before it, the output is somewhat larger than a Writer's, especially
+// with small chunks.
+//
+// The output is a concatenation of brotli streams, which only a Reader with
+// ReaderOptions.Multistream (or another decoder that supports concatenated
+// streams) can decode.
+type ParallelWriter struct {
+	dst       io.Writer
+	options   WriterOptions
+	chunkSize int
+	workers   int
+	chunk     []byte
+	started   bool // whether any chunk has been compressed
+
+	pending []*parallelChunk // chunks being compressed, in order
+	spare   [][]byte         // input buffers of finished chunks
+	writers chan *Writer     // idle Writers, at most workers of them
+	err     error
+}
+
+// parallelChunk is a chunk of input being compressed by a worker.
+type parallelChunk struct {
+	in   []byte
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// NewWriterParallelDeterministic returns a ParallelWriter that writes to
+// dst, compressing chunks of chunkSize bytes with the given options on up
+// to workers goroutines. If chunkSize is not positive, DefaultChunkSize is
+// used; if workers is not positive, GOMAXPROCS is used. The number of
+// workers doesn't change the output, but the chunk size does.
+func NewWriterParallelDeterministic(dst io.Writer, options WriterOptions, chunkSize, workers int) *ParallelWriter {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &ParallelWriter{
+		dst:       dst,
+		options:   options,
+		chunkSize: chunkSize,
+		workers:   workers,
+		chunk:     make([]byte, 0, chunkSize),
+		writers:   make(chan *Writer, workers),
+	}
+}
+
+// Write buffers p, handing each full chunk to a worker. It blocks while all
+// the workers are busy.
+func (pw *ParallelWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && pw.err == nil {
+		m := copy(pw.chunk[len(pw.chunk):pw.chunkSize], p)
+		pw.chunk = pw.chunk[:len(pw.chunk)+m]
+		n += m
+		p = p[m:]
+		if len(pw.chunk) == pw.chunkSize {
+			pw.dispatch()
+		}
+	}
+	return n, pw.err
+}
+
+// Close compresses the final, partial chunk, if any, and waits for the
+// workers to finish writing the output. It does not close the underlying
+// writer.
+func (pw *ParallelWriter) Close() error {
+	if pw.err == nil && (len(pw.chunk) > 0 || !pw.started) {
+		// Empty input still makes a (single, empty) stream.
+		pw.dispatch()
+	}
+	for len(pw.pending) > 0 && pw.err == nil {
+		pw.finishOldest()
+	}
+	if pw.err == nil {
+		pw.err = errWriterClosed
+		return nil
+	}
+	return pw.err
+}
+
+// dispatch hands the current chunk to a worker, first waiting for the
+// oldest one if all of them are busy.
+func (pw *ParallelWriter) dispatch() {
+	if len(pw.pending) == pw.workers {
+		pw.finishOldest()
+		if pw.err != nil {
+			return
+		}
+	}
+	job := &parallelChunk{in: pw.chunk, done: make(chan struct{})}
+	pw.pending = append(pw.pending, job)
+	pw.started = true
+	if n := len(pw.spare); n > 0 {
+		pw.chunk = pw.spare[n-1][:0]
+		pw.spare = pw.spare[:n-1]
+	} else {
+		pw.chunk = make([]byte, 0, pw.chunkSize)
+	}
+
+	go func() {
+		var w *Writer
+		select {
+		case w = <-pw.writers:
+			w.Reset(&job.out)
+		default:
+			w = NewWriterOptions(&job.out, pw.options)
+		}
+		_, job.err = w.Write(job.in)
+		if job.err == nil {
+			job.err = w.Close()
+		}
+		pw.writers <- w
+		close(job.done)
+	}()
+}
+
+// finishOldest waits for the oldest pending chunk and writes its output.
+func (pw *ParallelWriter) finishOldest() {
+	job := pw.pending[0]
+	<-job.done
+	pw.pending[0] = nil
+	pw.pending = pw.pending[1:]
+	if job.err != nil {
+		pw.err = job.err
+		return
+	}
+	_, pw.err = writeFull(pw.dst, job.out.Bytes())
+	pw.spare = append(pw.spare, job.in)
+}
@@ -31,7 +31,18 @@ type encoderParams struct {
 	size_hint                        uint
 	disable_literal_context_modeling bool
 	large_window                     bool
+	extra_optimize                   bool
+	block_split_passes               uint
+	max_metablock_size               uint
+	max_match_distance               uint
+	max_match_length                 uint
+	long_range_matching              bool
+	stored_preferred                 bool
+	cost_model                       CostModel
+	compact_end                      bool
 	hasher                           hasherParams
 	dist                             distanceParams
 	dictionary                       encoderDictionary
+	prepared_dictionary              *PreparedDictionary
+	custom_dictionary                bool
 }
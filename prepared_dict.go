@@ -0,0 +1,199 @@
+package brotli
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// The range of PrepareDictionaryOptions.HashBits. At quality 9 each bucket
+// holds 256 positions, so 20 bits is already a 1 GiB table.
+const (
+	minDictionaryHashBits = 10
+	maxDictionaryHashBits = 20
+)
+
+// maxAutoDictionaryHashBits limits the hash table size chosen automatically,
+// to 64 MiB at quality 9.
+const maxAutoDictionaryHashBits = 16
+
+var errInvalidHashBits = errors.New("brotli: invalid HashBits")
+
+// PrepareDictionaryOptions configures PrepareDictionary.
+type PrepareDictionaryOptions struct {
+	// HashBits is the base 2 logarithm of the number of buckets in the hash
+	// table that a Writer using the dictionary searches for matches, in the
+	// dictionary and in the data. Each bucket only remembers the last few
+	// positions (16 at quality 5, up to 256 at quality 9) with the same
+	// hash, so with a big dictionary, a small table forgets most of it.
+	// A table takes 4 << (HashBits + Quality - 1) bytes. HashBits must be
+	// from 10 to 20; if it is zero, it is chosen from the dictionary's size,
+	// but never below the Writer's default (14 or 15) or above 16. It only
+	// affects qualities 5 to 9, with a window larger than 64 KiB; the other
+	// qualities' tables have a fixed size.
+	HashBits int
+}
+
+// A PreparedDictionary is a WriterOptions.Dictionary together with the
+// size of the hash table to use with it. It can be shared by any number of
+// Writers.
+type PreparedDictionary struct {
+	data     []byte
+	hashBits int
+	autoBits int
+
+	mu   sync.Mutex
+	warm []warmTables
+}
+
+// warmTables is a hash table that Warm has stored the dictionary in, for
+// Writers with the same quality, window and hash table parameters.
+type warmTables struct {
+	quality int
+	lgwin   uint
+	params  hasherParams
+	hasher  hasherHandle
+}
+
+// PrepareDictionary prepares data for use as
+// WriterOptions.PreparedDictionary. The streams written with it can be
+// decoded by a Reader with data as its ReaderOptions.Dictionary.
+func PrepareDictionary(data []byte, options PrepareDictionaryOptions) (*PreparedDictionary, error) {
+	if options.HashBits != 0 && (options.HashBits < minDictionaryHashBits || options.HashBits > maxDictionaryHashBits) {
+		return nil, errInvalidHashBits
+	}
+	return &PreparedDictionary{data: data, hashBits: options.HashBits, autoBits: autoHashBits(len(data))}, nil
+}
+
+// PrepareDictionaryReader is like PrepareDictionary, but reads the
+// dictionary from r, such as a file, until EOF. If r reports its size (like
+// *os.File, *bytes.Reader or *strings.Reader), the dictionary is read into
+// a buffer of that size, without growing and copying it along the way.
+func PrepareDictionaryReader(r io.Reader, options PrepareDictionaryOptions) (*PreparedDictionary, error) {
+	var size int64
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		size = int64(r.Len())
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := r.Stat(); err == nil && fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+	}
+	var buf bytes.Buffer
+	// ReadFrom grows the buffer whenever it has less than bytes.MinRead
+	// bytes free, so leave that much room for reading the EOF.
+	buf.Grow(int(size) + bytes.MinRead)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return PrepareDictionary(buf.Bytes(), options)
+}
+
+// autoHashBits chooses the hash table size for a dictionary of size bytes,
+// aiming for about one bucket for every 16 bytes.
+func autoHashBits(size int) int {
+	bits := 0
+	for bits < maxAutoDictionaryHashBits && 16<<uint(bits) < size {
+		bits++
+	}
+	return bits
+}
+
+// stackDictionaries combines dicts into one dictionary, in order, using the
+// largest hash table that any of them asks for.
+func stackDictionaries(dicts []*PreparedDictionary) *PreparedDictionary {
+	d := new(PreparedDictionary)
+	for _, dict := range dicts {
+		d.data = append(d.data, dict.data...)
+		if dict.hashBits > d.hashBits {
+			d.hashBits = dict.hashBits
+		}
+	}
+	d.autoBits = autoHashBits(len(d.data))
+	return d
+}
+
+// Warm hashes the dictionary into the hash table that a Writer with options
+// and d as its PreparedDictionary would use, and keeps the table in d.
+// Before its first Write, a Writer hashes the dictionary into its own table,
+// which for a big dictionary takes longer than compressing a small input;
+// once d is warm, Writers with the same Quality and window copy the kept
+// table instead, which is several times faster. The options' dictionary
+// fields are ignored, so Warm doesn't help a Writer using Dictionaries.
+//
+// The kept table takes as much memory as a Writer's (see
+// PrepareDictionaryOptions.HashBits), for each set of options d is warmed
+// for, for as long as d is in use. Only qualities 5 to 11 with a window
+// larger than 64 KiB (without LongRangeMatching) can use a warm table; for
+// the others, Warm does nothing. A Writer that chooses its window from the
+// size of the input only uses a table warmed with that window as LGWin.
+func (d *PreparedDictionary) Warm(options WriterOptions) {
+	options.PreparedDictionary = d
+	options.Dictionaries = nil
+	w := NewWriterOptions(ioutil.Discard, options)
+	ensureInitialized(w)
+	if w.params.quality == fastOnePassCompressionQuality || w.params.quality == fastTwoPassCompressionQuality {
+		return
+	}
+	dict := d.data
+	if max := maxBackwardLimit(w.params.lgwin); uint(len(dict)) > max {
+		dict = dict[uint(len(dict))-max:]
+	}
+	if len(dict) == 0 {
+		return
+	}
+
+	var h hasherHandle
+	hasherSetup(&h, &w.params, dict, 0, uint(len(dict)), false)
+	if _, ok := h.(tableCopier); !ok {
+		return
+	}
+	if d.findWarmTables(h, &w.params) != nil {
+		return
+	}
+	storeDictionary(h, dict)
+	d.mu.Lock()
+	d.warm = append(d.warm, warmTables{quality: w.params.quality, lgwin: w.params.lgwin, params: h.Common().params, hasher: h})
+	d.mu.Unlock()
+}
+
+// findWarmTables returns the hasher that Warm stored the dictionary in for
+// h's parameters, or nil.
+func (d *PreparedDictionary) findWarmTables(h hasherHandle, params *encoderParams) hasherHandle {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, t := range d.warm {
+		if t.quality == params.quality && t.lgwin == params.lgwin && t.params == h.Common().params {
+			return t.hasher
+		}
+	}
+	return nil
+}
+
+// copyWarmTables copies the table that Warm stored the first n bytes of the
+// dictionary in into h, if d has been warmed for h's parameters, and reports
+// whether it did. The warm table is never written to after Warm, so it is
+// copied without holding the lock.
+func (d *PreparedDictionary) copyWarmTables(h hasherHandle, params *encoderParams, n uint) bool {
+	c, ok := h.(tableCopier)
+	if !ok {
+		return false
+	}
+	src := d.findWarmTables(h, params)
+	return src != nil && c.copyTables(src, n)
+}
+
+// bucketBits returns the number of hash bucket bits to use with d, given
+// the default for the quality, def.
+func (d *PreparedDictionary) bucketBits(def int) int {
+	if d.hashBits != 0 {
+		return d.hashBits
+	}
+	if d.autoBits > def {
+		return d.autoBits
+	}
+	return def
+}
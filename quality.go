@@ -57,11 +57,34 @@ func maxZopfliLen(params *encoderParams) uint {
 func maxZopfliCandidates(params *encoderParams) uint {
 	if params.quality <= 10 {
 		return 1
+	} else if params.extra_optimize {
+		return 10
 	} else {
 		return 5
 	}
 }
 
+/* Number of cost model refinement passes for quality 11. */
+func hqZopfliIterations(params *encoderParams) int {
+	if params.extra_optimize {
+		return 4
+	}
+	return 2
+}
+
+/* Number of refinement passes when searching for block splits. */
+func blockSplitIterations(params *encoderParams) uint {
+	if params.block_split_passes != 0 {
+		return params.block_split_passes
+	} else if params.quality < hqZopflificationQuality {
+		return 3
+	} else if params.extra_optimize {
+		return 20
+	} else {
+		return 10
+	}
+}
+
 func sanitizeParams(params *encoderParams) {
 	params.quality = brotli_min_int(maxQuality, brotli_max_int(minQuality, params.quality))
 	if params.quality <= maxQualityForStaticEntropyCodes {
@@ -81,6 +104,22 @@ func sanitizeParams(params *encoderParams) {
 			params.lgwin = uint(max_lgwin)
 		}
 	}
+
+	/* Qualities 0 and 1 write their commands directly, so they can't
+	   limit them, use another hasher, or refer to a custom dictionary. */
+	if (params.max_match_distance > 0 || params.max_match_length > 0 || params.long_range_matching || params.stored_preferred || params.custom_dictionary) && params.quality < 2 {
+		params.quality = 2
+	}
+
+	/* Stored data refers to nothing, so the smallest window does. */
+	if params.stored_preferred {
+		params.lgwin = minWindowBits
+	}
+
+	/* Use the smallest window that covers the longest distance allowed. */
+	for params.max_match_distance > 0 && params.lgwin > minWindowBits && maxBackwardLimit(params.lgwin-1) >= params.max_match_distance {
+		params.lgwin--
+	}
 }
 
 /* Returns optimized lg_block value. */
@@ -113,6 +152,9 @@ func computeRbBits(params *encoderParams) int {
 
 func maxMetablockSize(params *encoderParams) uint {
 	var bits int = brotli_min_int(computeRbBits(params), maxInputBlockBits)
+	if params.max_metablock_size != 0 && params.max_metablock_size < uint(1)<<uint(bits) {
+		return params.max_metablock_size
+	}
 	return uint(1) << uint(bits)
 }
 
@@ -150,6 +192,9 @@ func chooseHasher(params *encoderParams, hparams *hasherParams) {
 		hparams.block_bits = params.quality - 1
 		hparams.bucket_bits = 15
 		hparams.hash_len = 5
+		if params.prepared_dictionary != nil {
+			hparams.bucket_bits = params.prepared_dictionary.bucketBits(hparams.bucket_bits)
+		}
 		if params.quality < 7 {
 			hparams.num_last_distances_to_check = 4
 		} else if params.quality < 9 {
@@ -165,6 +210,9 @@ func chooseHasher(params *encoderParams, hparams *hasherParams) {
 		} else {
 			hparams.bucket_bits = 15
 		}
+		if params.prepared_dictionary != nil {
+			hparams.bucket_bits = params.prepared_dictionary.bucketBits(hparams.bucket_bits)
+		}
 		if params.quality < 7 {
 			hparams.num_last_distances_to_check = 4
 		} else if params.quality < 9 {
@@ -1,8 +1,12 @@
 package brotli
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
+	"time"
 )
 
 type decodeError int
@@ -11,6 +15,22 @@ func (err decodeError) Error() string {
 	return "brotli: " + string(decoderErrorString(int(err)))
 }
 
+// ErrTimeout is returned by a Reader that has not finished decoding its
+// stream within ReaderOptions.Timeout.
+var ErrTimeout = errors.New("brotli: decoding timed out")
+
+// ErrWindowTooLarge is returned by a Reader from NewBoundedReader when the
+// stream needs a larger window than the Reader has room for.
+var ErrWindowTooLarge = errors.New("brotli: window too large for bounded reader")
+
+// ErrSizeMismatch is returned by a Reader whose output doesn't have the
+// length given by ReaderOptions.ExpectedSize.
+var ErrSizeMismatch = errors.New("brotli: decompressed size mismatch")
+
+// ErrAllocLimit is returned by a Reader that would need more memory than
+// ReaderOptions.MaxTotalAlloc to go on decoding.
+var ErrAllocLimit = errors.New("brotli: allocation limit exceeded")
+
 var errExcessiveInput = errors.New("brotli: excessive input")
 var errInvalidState = errors.New("brotli: invalid state")
 
@@ -19,27 +39,287 @@ var errInvalidState = errors.New("brotli: invalid state")
 // It is arbitrarily chosen to be equal to the constant used in io.Copy.
 const readBufSize = 32 * 1024
 
+// ReaderOptions configures Reader.
+type ReaderOptions struct {
+	// WindowBuffer, if it has enough capacity to hold the stream's sliding
+	// window plus a few bytes of slack, is used as the decoder's ring buffer
+	// instead of allocating one. Otherwise the Reader allocates as usual.
+	WindowBuffer []byte
+	// Timeout, if positive, limits the wall-clock time from NewReaderOptions
+	// or Reset until the end of the stream, to bound the cost of decoding
+	// untrusted input. The time is checked between decoding steps, each of
+	// which produces at most timeoutCheckInterval bytes of output, and Read
+	// fails with ErrTimeout once it has passed. Time spent waiting for the
+	// source or for the caller counts towards the limit.
+	Timeout time.Duration
+	// Multistream makes the Reader decode a concatenation of brotli
+	// streams, such as the output of a Writer with WriterOptions.GrowWindow,
+	// as their concatenated contents. Otherwise, data after the end of the
+	// first stream is an error.
+	Multistream bool
+	// Logger, if not nil, is called with a short description of notable
+	// events while decoding, such as the window size, the kind and size of
+	// each metablock, and reallocations and wraparounds of the ring buffer.
+	// It is meant for troubleshooting streams from other encoders; the
+	// format of the descriptions may change.
+	Logger func(event string)
+	// BufferSize, if positive, is the size of the buffer for reading
+	// compressed data from the source, instead of 32 KiB. A larger size
+	// reduces the number of calls to the source's Read method, which helps
+	// when each call is costly, such as a request to an object store.
+	BufferSize int
+	// MaxReadChunk, if positive, is the most data a single Read returns,
+	// however large its buffer, so that each call does a bounded amount of
+	// decoding work. This suits consumers that pass large buffers but want
+	// the data to arrive in steady, small increments.
+	MaxReadChunk int
+	// Dictionary must be the WriterOptions.Dictionary that the stream was
+	// compressed with, if any. Without it, back-references into the
+	// dictionary are reported as errors.
+	Dictionary []byte
+	// Dictionaries must be the data of the WriterOptions.Dictionaries that
+	// the stream was compressed with, if any, in the same order. They are
+	// used instead of Dictionary.
+	Dictionaries [][]byte
+	// ReplaceBuiltinDictionary must be the
+	// WriterOptions.ReplaceBuiltinDictionary that the stream was compressed
+	// with, if any; see there for its format and caveats. If it is invalid,
+	// Read fails with an error.
+	ReplaceBuiltinDictionary []byte
+	// OnMetablockBytes, if not nil, is called with the compressed data of
+	// each metablock of the stream (numbered from 0) once it has been
+	// decoded, such as for repackaging a stream without re-encoding it. The
+	// slice is only valid during the call. Metablocks don't generally start
+	// on byte boundaries, so a byte shared by two metablocks is passed with
+	// the first of them, and the first also includes the stream header; the
+	// slices add up to the whole stream.
+	OnMetablockBytes func(index int, compressed []byte)
+	// Postprocess must be the inverse of the WriterOptions.Preprocess that
+	// the stream was compressed with, if any. It gets the whole output at
+	// once, so the Reader decodes the whole stream on the first Read.
+	Postprocess func([]byte) []byte
+	// Lenient relaxes the checks of the stream's framing that don't affect
+	// the decoded data, to recover as much as possible from a slightly
+	// damaged stream, such as in a recovery tool: nonzero padding and
+	// reserved bits and superfluous zero length nibbles are ignored, and an
+	// invalid window size in the stream header is taken as the largest
+	// standard window, 16 MiB. (If the actual window was smaller, the
+	// references to the built-in dictionary that come after that much output
+	// are misread.) Such streams
+	// aren't valid, and other decoders reject them. Don't use it on
+	// untrusted input, where the damage may not be accidental.
+	Lenient bool
+	// ChunkBoundary, if not nil, is called with the offset in the
+	// decompressed output of each content-defined chunk boundary, as it is
+	// decoded, for splitting the data into chunks for deduplication
+	// without another pass over it. The boundaries come from a rolling gear
+	// hash over the last 64 bytes of output; a chunk ends where the top 13
+	// bits of the hash are zero, so chunks are 8 KiB on average, but at
+	// least 2 KiB and at most 64 KiB. They only depend on the content, so
+	// identical data has identical boundaries, and an insertion or deletion
+	// only moves the boundaries near it. The offsets are of the data before
+	// Postprocess, and with Multistream they continue across streams. The
+	// end of the output isn't reported as a boundary.
+	ChunkBoundary func(offset int64)
+	// ExpectedSize, if positive, is the length that the output must have,
+	// such as one recorded with an upload. Once the output exceeds it, or
+	// if it ends short of it, Read fails with ErrSizeMismatch, which
+	// catches both truncated and tampered streams. With Multistream, the
+	// output is counted across all streams, and with Postprocess, it is
+	// counted after Postprocess.
+	ExpectedSize int64
+	// MaxTotalAlloc, if positive, limits the memory that the Reader holds
+	// at once for decoding, such as in a sandbox: its input buffer, its
+	// window (unless WindowBuffer is used), and the prefix codes and context
+	// maps of the current metablock, which the stream may make a few
+	// hundred KiB. (The output of Postprocess and the data passed to
+	// OnMetablockBytes are not counted.) An allocation that would exceed it
+	// fails, and so does Read, with ErrAllocLimit. Unlike a limit on the
+	// output size, it bounds the memory that a stream with a large window
+	// needs before it produces any output.
+	MaxTotalAlloc int
+	// OnWindowAlloc, if not nil, is called with the size in bytes of the
+	// ring buffer that holds the window once the Reader has set it up for a
+	// stream, after parsing the stream header, and again each time it grows
+	// it, such as for tracking peak memory use. For a short stream, the ring
+	// buffer starts smaller than the window, and it only grows if the
+	// stream turns out to be longer; for a stream longer than its window,
+	// the size is that of the window, 1<<LGWin. (The Reader allocates a few
+	// bytes more, and reuses the ring buffer after Reset if it is large
+	// enough.)
+	OnWindowAlloc func(bytes int)
+}
+
+// timeoutCheckInterval is the most output decoded between checks of
+// ReaderOptions.Timeout.
+const timeoutCheckInterval = 256 * 1024
+
+// logf reports an event to r.options.Logger, which must not be nil. (Callers
+// check, so that the arguments aren't even evaluated if there is no Logger.)
+func (r *Reader) logf(format string, args ...interface{}) {
+	r.options.Logger(fmt.Sprintf(format, args...))
+}
+
+// Sizes for counting allocations against options.MaxTotalAlloc.
+const (
+	huffmanCodeSize = 4  // bits, padding, and value
+	sliceHeaderSize = 24 // on 64-bit platforms
+)
+
+// allocate reports whether size more bytes may be allocated within
+// options.MaxTotalAlloc, and if so, adds them to *counter.
+func (r *Reader) allocate(counter *int, size int) bool {
+	if max := r.options.MaxTotalAlloc; max > 0 && len(r.buf)+r.windowAlloc+r.streamAlloc+r.tableAlloc+size > max {
+		r.allocLimitHit = true
+		return false
+	}
+	*counter += size
+	return true
+}
+
 // NewReader creates a new Reader reading the given reader.
 func NewReader(src io.Reader) *Reader {
+	return NewReaderOptions(src, ReaderOptions{})
+}
+
+// NewReaderOptions is like NewReader but specifies ReaderOptions, like
+// NewWriterOptions for a Writer. (There is no counterpart to
+// NewWriterLevel, since decoding has no levels.) With the zero
+// ReaderOptions, it is the same as NewReader.
+func NewReaderOptions(src io.Reader, options ReaderOptions) *Reader {
 	r := new(Reader)
+	r.options = options
+	if len(options.Dictionaries) > 0 {
+		r.options.Dictionary = bytes.Join(options.Dictionaries, nil)
+	}
+	if options.BufferSize > 0 {
+		r.buf = make([]byte, options.BufferSize)
+		reportAlloc(options.BufferSize, "input buffer")
+	}
+	if options.ReplaceBuiltinDictionary != nil {
+		r.staticDict, r.staticDictErr = parseCustomDictionary(options.ReplaceBuiltinDictionary)
+	}
 	r.Reset(src)
 	return r
 }
 
+// defaultPrefetch is the read size used by NewReaderAt if none is specified.
+const defaultPrefetch = 1 << 20
+
+// NewReaderAt creates a new Reader that decompresses the size bytes of
+// compressed data available from r. Instead of many small reads, the data is
+// read sequentially in chunks of prefetch bytes, each of them with a single
+// call to ReadAt, at offsets that are multiples of prefetch. This amortizes
+// the latency of sources such as cloud object stores, where each ReadAt is a
+// separate request; a prefetch of a few megabytes is usually a good choice.
+// If prefetch is not positive, 1 MiB is used.
+func NewReaderAt(r io.ReaderAt, size int64, prefetch int) *Reader {
+	if prefetch <= 0 {
+		prefetch = defaultPrefetch
+	}
+	d := new(Reader)
+	d.buf = make([]byte, prefetch)
+	reportAlloc(prefetch, "input buffer")
+	d.Reset(io.NewSectionReader(r, 0, size))
+	return d
+}
+
+// NewBoundedReader returns a Reader that decompresses src using at most
+// outputCap bytes (plus a few bytes of slack) for the decoded data it keeps,
+// however long the stream is. That data is the stream's sliding window, a
+// ring buffer allocated once from the start; each Read decodes only as much
+// as fits in the caller's buffer, so decoding simply waits while the
+// consumer falls behind, and nothing accumulates. A stream that needs a
+// larger window than outputCap (up to 16 MiB, as set by WriterOptions.LGWin)
+// fails with ErrWindowTooLarge.
+func NewBoundedReader(src io.Reader, outputCap int) *Reader {
+	r := NewReaderOptions(src, ReaderOptions{
+		WindowBuffer: make([]byte, outputCap+int(kRingBufferWriteAheadSlack)),
+	})
+	r.fixedWindow = true
+	return r
+}
+
 // Reset discards the Reader's state and makes it equivalent to the result of
 // its original state from NewReader, but reading from src instead.
-// This permits reusing a Reader rather than allocating a new one.
-// Error is always nil
+// This permits reusing a Reader rather than allocating a new one, even one
+// that stopped partway through a stream: any input it had buffered but not
+// yet decoded is discarded.
+// The error is only non-nil if ReaderOptions.ReplaceBuiltinDictionary is
+// invalid.
 func (r *Reader) Reset(src io.Reader) error {
 	decoderStateInit(r)
 	r.src = src
+	r.in = nil
+	r.postprocessed = false
+	r.processedOut = nil
+	r.stats = ReaderStats{}
+	r.produced = 0
+	r.allocLimitHit = false
+	r.chunkHash, r.chunkOffset, r.chunkStart = 0, 0, 0
+	r.deadline = time.Time{}
+	if r.options.Timeout > 0 {
+		r.deadline = time.Now().Add(r.options.Timeout)
+	}
 	if r.buf == nil {
 		r.buf = make([]byte, readBufSize)
+		reportAlloc(readBufSize, "input buffer")
 	}
-	return nil
+	return r.staticDictErr
 }
 
 func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.options.Postprocess != nil {
+		n, err = r.readPostprocessed(p)
+	} else {
+		n, err = r.read(p)
+	}
+	if r.options.ExpectedSize > 0 {
+		r.produced += int64(n)
+		if r.produced > r.options.ExpectedSize || err == io.EOF && r.produced != r.options.ExpectedSize {
+			err = ErrSizeMismatch
+		}
+	}
+	return n, err
+}
+
+// readPostprocessed decodes the whole stream, applies options.Postprocess,
+// and returns the result.
+func (r *Reader) readPostprocessed(p []byte) (n int, err error) {
+	if !r.postprocessed {
+		var data []byte
+		for {
+			if len(data) == cap(data) {
+				data = append(data, 0)[:len(data)]
+			}
+			m, err := r.read(data[len(data):cap(data)])
+			data = data[:len(data)+m]
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		if r.state != stateDone {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.postprocessed = true
+		r.processedOut = r.options.Postprocess(data)
+	}
+	if len(r.processedOut) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, r.processedOut)
+	r.processedOut = r.processedOut[n:]
+	return n, nil
+}
+
+// read is Read without Postprocess and the check of options.ExpectedSize.
+func (r *Reader) read(p []byte) (n int, err error) {
+	if r.staticDictErr != nil {
+		return 0, r.staticDictErr
+	}
 	if !decoderHasMoreOutput(r) && len(r.in) == 0 {
 		m, readErr := r.src.Read(r.buf)
 		if m == 0 {
@@ -48,29 +328,68 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 		}
 		r.in = r.buf[:m]
 	}
+	if r.options.Multistream && r.state == stateDone && !decoderHasMoreOutput(r) && len(r.in) > 0 {
+		decoderStateInit(r)
+	}
 
 	if len(p) == 0 {
 		return 0, nil
 	}
 
+	if max := r.options.MaxReadChunk; max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	if !r.deadline.IsZero() && len(p) > timeoutCheckInterval {
+		p = p[:timeoutCheckInterval]
+	}
+
 	for {
+		if !r.deadline.IsZero() && r.state != stateDone && time.Now().After(r.deadline) {
+			return 0, ErrTimeout
+		}
+
 		var written uint
+		in := r.in
 		in_len := uint(len(r.in))
 		out_len := uint(len(p))
 		in_remaining := in_len
 		out_remaining := out_len
+		out := p
 		result := decoderDecompressStream(r, &in_remaining, &r.in, &out_remaining, &p)
 		written = out_len - out_remaining
 		n = int(written)
+		if r.options.ChunkBoundary != nil {
+			r.findChunkBoundaries(out[:n])
+		}
+		r.stats.BytesIn += int64(in_len - in_remaining)
+		r.stats.BytesOut += int64(n)
+		if r.options.OnMetablockBytes != nil {
+			r.passMetablockBytes(in[:in_len-in_remaining])
+		}
 
 		switch result {
 		case decoderResultSuccess:
 			if len(r.in) > 0 {
-				return n, errExcessiveInput
+				if !r.options.Multistream {
+					return n, errExcessiveInput
+				}
+				// Another stream follows.
+				decoderStateInit(r)
+				if n > 0 {
+					return n, nil
+				}
+				continue
 			}
 			return n, nil
 		case decoderResultError:
-			return n, decodeError(decoderGetErrorCode(r))
+			code := decoderGetErrorCode(r)
+			if r.allocLimitHit {
+				return n, ErrAllocLimit
+			}
+			if r.fixedWindow && (code == decoderErrorAllocRingBuffer1 || code == decoderErrorAllocRingBuffer2) {
+				return n, ErrWindowTooLarge
+			}
+			return n, decodeError(code)
 		case decoderResultNeedsMoreOutput:
 			if n == 0 {
 				return 0, io.ErrShortBuffer
@@ -100,3 +419,488 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 		r.in = r.buf[:encN]
 	}
 }
+
+// markMetablockEnd records that the decoder has reached the end of a
+// metablock, having taken the given amount of its current input into its
+// bit reader or its internal buffer.
+func (r *Reader) markMetablockEnd(taken uint) {
+	// The offset in the stream where the bit reader's input starts.
+	start := r.inPos + int64(taken)
+	if r.buffer_length != 0 {
+		start -= int64(r.buffer_length)
+	}
+	bits := (start+int64(r.br.byte_pos))*8 - int64(getAvailableBits(&r.br))
+	r.metablockEnds = append(r.metablockEnds, (bits+7)/8)
+}
+
+// passMetablockBytes collects the input taken by the decoder, and passes
+// the data of any metablocks that it completed to options.OnMetablockBytes.
+func (r *Reader) passMetablockBytes(taken []byte) {
+	r.inPos += int64(len(taken))
+	r.metablockBuf = append(r.metablockBuf, taken...)
+	for _, end := range r.metablockEnds {
+		n := int(end - r.metablockStart)
+		r.options.OnMetablockBytes(r.metablockIndex, r.metablockBuf[:n])
+		r.metablockIndex++
+		r.metablockBuf = append(r.metablockBuf[:0], r.metablockBuf[n:]...)
+		r.metablockStart = end
+	}
+	r.metablockEnds = r.metablockEnds[:0]
+}
+
+// resyncLookahead is how much compressed data after a candidate starting
+// point Resync decodes, if the stream doesn't end sooner, before accepting
+// it.
+const resyncLookahead = 64 << 10
+
+// Resync recovers from a decoding error by scanning forward through the
+// remaining input for the start of another brotli stream, and resuming
+// decoding there; set Multistream to keep decoding the streams after that
+// one. It returns the number of compressed bytes skipped, or io.EOF if the
+// input ends without another stream.
+//
+// Recovery is only possible at stream boundaries: within a stream, every
+// metablock (even after a Flush) may refer back to any earlier data in the
+// window and relies on state carried over from the metablocks before it.
+// So a damaged log can only be partially recovered if it is a sequence of
+// separate streams, such as one written by a Writer that is Reset
+// periodically, or with WriterOptions.GrowWindow. A candidate starting
+// point is accepted if the data from there decodes without error until the
+// end of a stream or for 64 KiB, so there is a small chance of accepting
+// garbage.
+func (r *Reader) Resync() (skipped int64, err error) {
+	data := append([]byte(nil), r.in...)
+	eof := false
+	trial := new(Reader)
+	trial.options = r.options
+	trial.options.Logger = nil
+	trial.options.OnMetablockBytes = nil
+	trial.staticDict = r.staticDict
+	out := make([]byte, readBufSize)
+
+	for i := 0; ; i++ {
+		for !eof && len(data)-i < resyncLookahead {
+			n, readErr := r.src.Read(r.buf)
+			data = append(data, r.buf[:n]...)
+			if readErr == io.EOF {
+				eof = true
+			} else if readErr != nil {
+				return int64(i), readErr
+			}
+		}
+		if i >= len(data) {
+			r.in = nil
+			return int64(i), io.EOF
+		}
+
+		candidate := data[i:]
+		if len(candidate) > resyncLookahead {
+			candidate = candidate[:resyncLookahead]
+		}
+		if trial.decodesCleanly(candidate, out, len(candidate) == resyncLookahead) {
+			decoderStateInit(r)
+			r.in = data[i:]
+			return int64(i), nil
+		}
+	}
+}
+
+// decodesCleanly reports whether data decodes as the start of a brotli
+// stream without error, either to the end of the stream, or, if partial is
+// set, to the end of data. It decodes into out, which it overwrites.
+func (r *Reader) decodesCleanly(data, out []byte, partial bool) bool {
+	decoderStateInit(r)
+	availableIn := uint(len(data))
+	for {
+		next := out
+		availableOut := uint(len(out))
+		switch decoderDecompressStream(r, &availableIn, &data, &availableOut, &next) {
+		case decoderResultSuccess:
+			return true
+		case decoderResultNeedsMoreOutput:
+			continue
+		case decoderResultNeedsMoreInput:
+			return partial
+		default:
+			return false
+		}
+	}
+}
+
+// SizeHint returns the uncompressed size of the stream, if it was recorded
+// with WriterOptions.EmitSizeHint and the Reader has read it. The size hint
+// is at the start of the stream, so it is available after the first Read.
+// It comes from the stream itself, so it must not be trusted blindly.
+func (r *Reader) SizeHint() (size int64, ok bool) {
+	return r.sizeHint, r.hasSizeHint
+}
+
+// maxReadAllHint is the largest size hint that ReadAll allocates for up
+// front; beyond that, the hint isn't trusted, and the buffer grows as the
+// output arrives.
+const maxReadAllHint = 1 << 30
+
+// ReadAll reads the rest of the output, like ioutil.ReadAll. If the stream
+// has a size hint (see WriterOptions.EmitSizeHint), the buffer is allocated
+// with exactly that size once the hint has been read, instead of growing
+// (and copying the output) repeatedly; hints over 1 GiB are ignored, and if
+// the output turns out to be larger, the buffer grows as usual.
+func (r *Reader) ReadAll() ([]byte, error) {
+	var dst []byte
+	checkedHint := false
+	for {
+		if !checkedHint && r.hasSizeHint {
+			checkedHint = true
+			if hint := r.sizeHint; hint <= maxReadAllHint && int64(cap(dst)) < hint {
+				grown := make([]byte, len(dst), hint)
+				copy(grown, dst)
+				dst = grown
+			}
+		}
+		var n int
+		var err error
+		if len(dst) == cap(dst) && checkedHint {
+			// Check for the end of the stream before growing the buffer.
+			n, err = r.Read(r.probe[:])
+			dst = append(dst, r.probe[:n]...)
+		} else {
+			if len(dst) == cap(dst) {
+				dst = append(dst, 0)[:len(dst)]
+			}
+			n, err = r.Read(dst[len(dst):cap(dst)])
+			dst = dst[:len(dst)+n]
+		}
+		if err == io.EOF {
+			if r.state != stateDone {
+				return dst, io.ErrUnexpectedEOF
+			}
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
+
+// ReaderStats summarizes the work done by a Reader since it was created or
+// Reset, such as for monitoring a decompression service. With
+// ReaderOptions.Multistream, they add up all the streams.
+type ReaderStats struct {
+	// BytesIn is the number of compressed bytes decoded.
+	BytesIn int64
+	// BytesOut is the number of decompressed bytes produced, before
+	// ReaderOptions.Postprocess, if any.
+	BytesOut int64
+	// Metablocks is the number of metablocks decoded, including empty and
+	// metadata ones.
+	Metablocks int
+	// WindowBits is the base 2 logarithm of the last stream's window size,
+	// from 10 to 24, or 0 if no stream header has been decoded. Streams with
+	// the large window extension (beyond 24 bits) are rejected by the
+	// Reader.
+	WindowBits int
+}
+
+// Stats returns the statistics so far; they are complete once Read has
+// returned io.EOF. Collecting them costs next to nothing.
+func (r *Reader) Stats() ReaderStats {
+	return r.stats
+}
+
+// maxSizeHintRatio limits how much DecodeInto preallocates for a size hint,
+// relative to the size of the compressed data, so that a tiny stream with
+// a bogus size hint can't make it allocate a huge buffer up front.
+const maxSizeHintRatio = 1024
+
+// DecodeInto decompresses src, appending the output to dst, and returns the
+// extended slice. The compressed data is decoded straight from src, and the
+// output is written straight into the spare capacity of dst, so if cap(dst)
+// is large enough (for example, because dst is a view of a memory-mapped
+// file pre-sized to the output length) the output is never copied or
+// reallocated. The decoder's own state, such as its ring buffer and Huffman
+// tables, is kept in a pool for the next call, so once it has grown to fit
+// the streams being decoded, DecodeInto doesn't allocate at all when
+// cap(dst) is sufficient.
+func DecodeInto(dst, src []byte) ([]byte, error) {
+	r, _ := decodeIntoReaders.Get().(*Reader)
+	if r == nil {
+		r = new(Reader)
+	}
+	defer func() {
+		r.in = nil
+		decodeIntoReaders.Put(r)
+	}()
+	decoderStateInit(r)
+	r.src = eofReader{}
+	r.in = src
+	start := len(dst)
+	checkedHint := false
+
+	for r.state != stateDone || decoderHasMoreOutput(r) {
+		if !checkedHint && r.hasSizeHint {
+			checkedHint = true
+			if hint := r.sizeHint; hint <= int64(len(src))*maxSizeHintRatio && int64(cap(dst)-start) < hint {
+				grown := make([]byte, len(dst), start+int(hint))
+				copy(grown, dst)
+				dst = grown
+			}
+		}
+		var n int
+		var err error
+		if len(dst) == cap(dst) {
+			// Check for the end of the stream before growing dst, so that
+			// a dst of exactly the output length isn't grown.
+			n, err = r.Read(r.probe[:])
+			dst = append(dst, r.probe[:n]...)
+		} else {
+			n, err = r.Read(dst[len(dst):cap(dst)])
+			dst = dst[:len(dst)+n]
+		}
+		if err == io.EOF {
+			if len(src) > 0 {
+				// The stream ended before its last metablock.
+				return dst, io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+	if len(r.in) > 0 {
+		return dst, errExcessiveInput
+	}
+	return dst, nil
+}
+
+// decodeIntoReaders holds the Readers of DecodeInto.
+var decodeIntoReaders sync.Pool
+
+// eofReader is an empty source.
+type eofReader struct{}
+
+func (eofReader) Read(p []byte) (int, error) { return 0, io.EOF }
+
+// A Decoder decompresses whole streams held in memory, reusing the
+// decoders' state, such as their ring buffers and input buffers, from one
+// call to the next. A Decoder is safe for concurrent use by multiple
+// goroutines, which makes it a good fit for a server that decodes many
+// requests. The zero Decoder uses the default ReaderOptions.
+type Decoder struct {
+	options ReaderOptions
+	readers sync.Pool
+}
+
+// NewDecoder returns a Decoder that decodes with the given options. Since
+// the decoders run concurrently, options.WindowBuffer is not used, and the
+// callbacks, such as options.Logger, must be safe for concurrent use.
+func NewDecoder(options ReaderOptions) *Decoder {
+	options.WindowBuffer = nil
+	return &Decoder{options: options}
+}
+
+// Decode decompresses src, which must be a complete stream.
+func (d *Decoder) Decode(src []byte) ([]byte, error) {
+	r, _ := d.readers.Get().(*Reader)
+	if r == nil {
+		r = NewReaderOptions(nil, d.options)
+	}
+	err := r.Reset(bytes.NewReader(nil))
+	r.in = src
+
+	var dst []byte
+	for err == nil {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		var n int
+		n, err = r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+	}
+	if err == io.EOF {
+		err = nil
+		if r.state != stateDone {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	// Don't keep src, or the output, alive in the pool.
+	r.in = nil
+	r.processedOut = nil
+	d.readers.Put(r)
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// A ReaderPool recycles Readers, with their ring buffers and input
+// buffers, for decoding many streams from io.Readers, such as request
+// bodies, with fewer allocations; for streams held in memory, a Decoder is
+// simpler. A ReaderPool is safe for concurrent use by multiple goroutines.
+type ReaderPool struct {
+	options ReaderOptions
+	readers sync.Pool
+}
+
+// NewReaderPool returns a ReaderPool of Readers with the given options,
+// which apply to every stream they decode, including the dictionaries.
+// Since the Readers run concurrently, options.WindowBuffer is not used, and
+// the callbacks, such as options.Logger, must be safe for concurrent use.
+func NewReaderPool(options ReaderOptions) *ReaderPool {
+	options.WindowBuffer = nil
+	return &ReaderPool{options: options}
+}
+
+// GetReader returns a Reader from the pool, or a new one, Reset to decode
+// src from the start.
+func (p *ReaderPool) GetReader(src io.Reader) *Reader {
+	r, _ := p.readers.Get().(*Reader)
+	if r == nil {
+		r = NewReaderOptions(nil, p.options)
+	}
+	r.Reset(src)
+	return r
+}
+
+// PutReader returns r, which must have come from GetReader, to the pool.
+// r must not be used afterwards. The pool keeps r's buffers, but not src
+// or any output, so data returned by r stays the caller's: with
+// options.Postprocess, the rest of the output is dropped.
+func (p *ReaderPool) PutReader(r *Reader) {
+	r.src = nil
+	r.in = nil
+	r.processedOut = nil
+	p.readers.Put(r)
+}
+
+// decodePrefixChunk is the amount of input DecodePrefix decodes at a time.
+const decodePrefixChunk = 4096
+
+// DecodePrefix decompresses just the first n bytes of output from src (or
+// all of it, if there is less), without decoding the rest of the stream,
+// for uses such as previews. Data beyond what is needed to produce them is
+// neither decoded nor checked, so a corrupt stream is only reported if the
+// corruption is within the prefix.
+func DecodePrefix(src []byte, n int) ([]byte, error) {
+	// The decoder only hands over its output early when it runs out of
+	// input, so feed it the input in small pieces.
+	r := new(Reader)
+	r.buf = make([]byte, decodePrefixChunk)
+	r.Reset(bytes.NewReader(src))
+
+	dst := make([]byte, 0, n)
+	for len(dst) < n && (r.state != stateDone || decoderHasMoreOutput(r)) {
+		m, err := r.Read(dst[len(dst):n])
+		dst = dst[:len(dst)+m]
+		if err == io.EOF {
+			if r.state != stateDone {
+				return dst, io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// The limits applied by SafeDecode.
+const (
+	SafeDecodeMaxSize = 64 << 20
+	SafeDecodeTimeout = 10 * time.Second
+)
+
+// ErrTooLarge is returned by SafeDecode if the decompressed data would be
+// larger than SafeDecodeMaxSize.
+var ErrTooLarge = errors.New("brotli: decompressed data too large")
+
+// SafeDecode decompresses src, which may come from an untrusted source,
+// within conservative limits: it fails with ErrTooLarge if the output would
+// be more than SafeDecodeMaxSize (64 MiB), with ErrTimeout if decoding
+// takes more than SafeDecodeTimeout (10 seconds), with io.ErrUnexpectedEOF
+// if src is truncated, and with an error if there is data after the end of
+// the stream. It returns no data if it fails.
+//
+// For other limits, use a Reader with ReaderOptions.Timeout, and stop
+// reading once its output exceeds the size limit. Without
+// ReaderOptions.Multistream, a Reader also rejects data after the end of
+// the stream.
+func SafeDecode(src []byte) ([]byte, error) {
+	r := new(Reader)
+	decoderStateInit(r)
+	r.src = bytes.NewReader(nil)
+	r.in = src
+	r.deadline = time.Now().Add(SafeDecodeTimeout)
+
+	var dst []byte
+	for r.state != stateDone || decoderHasMoreOutput(r) {
+		if len(dst) > SafeDecodeMaxSize {
+			return nil, ErrTooLarge
+		}
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		end := cap(dst)
+		if end > SafeDecodeMaxSize+1 {
+			end = SafeDecodeMaxSize + 1
+		}
+		n, err := r.Read(dst[len(dst):end])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			if r.state != stateDone {
+				return nil, io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(dst) > SafeDecodeMaxSize {
+		return nil, ErrTooLarge
+	}
+	if len(r.in) > 0 {
+		return nil, errExcessiveInput
+	}
+	return dst, nil
+}
+
+// IsEmptyStream reports whether src is a complete, valid brotli stream that
+// decodes to nothing, such as the output of a Writer that was closed without
+// anything being written to it; decoding such a stream yields no data and
+// no error. It decodes only the metablock headers, and stops at the first
+// metablock with any data, so it is cheap even for large streams.
+func IsEmptyStream(src []byte) bool {
+	r := new(Reader)
+	decoderStateInit(r)
+	var out [1]byte
+	// Feed the decoder a byte at a time, so that it stops to be checked
+	// right after each metablock header.
+	for i := range src {
+		in := src[i : i+1]
+		availableIn := uint(1)
+		next := out[:]
+		availableOut := uint(len(out))
+		result := decoderDecompressStream(r, &availableIn, &in, &availableOut, &next)
+		if availableOut == 0 {
+			return false
+		}
+		switch result {
+		case decoderResultSuccess:
+			return availableIn == 0 && i == len(src)-1
+		case decoderResultNeedsMoreInput:
+		default:
+			return false
+		}
+
+		switch r.state {
+		case stateUninited, stateLargeWindowBits, stateInitialize, stateMetablockBegin, stateMetablockHeader, stateMetadata, stateMetablockDone:
+		default:
+			// The stream has a metablock with data.
+			return false
+		}
+	}
+	return false
+}
@@ -49,6 +49,7 @@ func ringBufferInitBuffer(buflen uint32, rb *ringBuffer) {
 	size := 2 + int(buflen) + int(kSlackForEightByteHashingEverywhere)
 	if cap(rb.data_) < size {
 		new_data = make([]byte, size)
+		reportAlloc(size, "encoder window")
 	} else {
 		new_data = rb.data_[:size]
 	}
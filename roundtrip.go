@@ -0,0 +1,183 @@
+package brotli
+
+import (
+	"bytes"
+	"fmt"
+	gohash "hash" // hash is the static dictionary's hash function
+	"io"
+	"io/ioutil"
+)
+
+// RoundTrip compresses data with the given options, decompresses the result,
+// and returns a descriptive error if anything fails or the decompressed data
+// doesn't match the original. It is intended to be used as a fuzz target:
+//
+//	f.Fuzz(func(t *testing.T, data []byte) {
+//		if err := brotli.RoundTrip(data, brotli.WriterOptions{Quality: 5}); err != nil {
+//			t.Fatal(err)
+//		}
+//	})
+//
+// The data is decompressed with the dictionaries in options, and as several
+// streams with WriterOptions.GrowWindow or FramePerWrite. The inverse of
+// WriterOptions.Preprocess isn't known, so with Preprocess, the decompressed
+// data is compared with the preprocessed input instead.
+func RoundTrip(data []byte, options WriterOptions) error {
+	want := data
+	if options.Preprocess != nil {
+		want = options.Preprocess(append([]byte(nil), data...))
+	}
+
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, options)
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("brotli: compressing %d bytes: %v", len(data), err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("brotli: compressing %d bytes: %v", len(data), err)
+	}
+	compressedLen := buf.Len()
+
+	decoded, err := ioutil.ReadAll(newRoundTripDecoder(&buf, options))
+	if err != nil {
+		return fmt.Errorf("brotli: decompressing %d bytes (from %d bytes of input): %v", compressedLen, len(data), err)
+	}
+	if len(decoded) != len(want) {
+		return fmt.Errorf("brotli: round trip produced %d bytes, want %d", len(decoded), len(want))
+	}
+	for i := range want {
+		if decoded[i] != want[i] {
+			return fmt.Errorf("brotli: round trip mismatch at byte %d of %d: got %#02x, want %#02x", i, len(want), decoded[i], want[i])
+		}
+	}
+	return nil
+}
+
+// DecodeVerify decompresses src, then compresses the result again with the
+// given options, and returns an error unless that reproduces src exactly.
+// This guards against decoder bugs, at the cost of compressing everything
+// again. It only works if the original encoding is deterministic with the
+// same options: src must have been written by this version of the package,
+// with the same options, and without calling Flush. The dictionaries in
+// options are used for decoding, too.
+func DecodeVerify(src []byte, options WriterOptions) ([]byte, error) {
+	r := NewReaderOptions(bytes.NewReader(src), readerOptionsFor(options))
+	decoded, err := ioutil.ReadAll(r)
+	if err == nil && r.state != stateDone {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, options)
+	if _, err := w.Write(decoded); err != nil {
+		return nil, fmt.Errorf("brotli: recompressing %d bytes: %v", len(decoded), err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("brotli: recompressing %d bytes: %v", len(decoded), err)
+	}
+	recompressed := buf.Bytes()
+	for i := range src {
+		if i >= len(recompressed) || recompressed[i] != src[i] {
+			return nil, fmt.Errorf("brotli: recompressed stream differs from the original at byte %d of %d", i, len(src))
+		}
+	}
+	if len(recompressed) > len(src) {
+		return nil, fmt.Errorf("brotli: recompressed stream is %d bytes, want %d", len(recompressed), len(src))
+	}
+	return decoded, nil
+}
+
+// readerOptionsFor returns the ReaderOptions with the dictionaries needed
+// to decode a stream written with options.
+func readerOptionsFor(options WriterOptions) ReaderOptions {
+	ro := ReaderOptions{
+		Dictionary:               options.Dictionary,
+		ReplaceBuiltinDictionary: options.ReplaceBuiltinDictionary,
+	}
+	if options.PreparedDictionary != nil {
+		ro.Dictionary = options.PreparedDictionary.data
+	}
+	if len(options.Dictionaries) > 0 {
+		ro.Dictionary = stackDictionaries(options.Dictionaries).data
+	}
+	return ro
+}
+
+// newRoundTripDecoder returns a reader of the decompressed data from src,
+// the output of a Writer with the given options.
+func newRoundTripDecoder(src io.Reader, options WriterOptions) io.Reader {
+	ro := readerOptionsFor(options)
+	if options.FramePerWrite {
+		return &messagesReader{mr: NewMessageReader(src, ro)}
+	}
+	ro.Multistream = options.GrowWindow
+	return &roundTripReader{r: NewReaderOptions(src, ro)}
+}
+
+// RoundTripReader returns a Reader that compresses the data from r with the
+// given options and decompresses it again, so that it yields the same data
+// as r, having been through the whole encoding and decoding path. The data
+// is streamed, in a separate goroutine that compresses it; that goroutine
+// only finishes once all the data has been read, or r or the compression
+// fails. It decompresses like RoundTrip, so with WriterOptions.Preprocess,
+// it yields the preprocessed data.
+func RoundTripReader(r io.Reader, options WriterOptions) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := NewWriterOptions(pw, options)
+		_, err := io.Copy(w, r)
+		if err == nil {
+			err = w.Close()
+		} else {
+			w.Abort()
+		}
+		pw.CloseWithError(err)
+	}()
+	return newRoundTripDecoder(pr, options)
+}
+
+// roundTripReader reports a stream that ends early as io.ErrUnexpectedEOF.
+type roundTripReader struct {
+	r *Reader
+}
+
+func (rt *roundTripReader) Read(p []byte) (n int, err error) {
+	n, err = rt.r.Read(p)
+	if err == io.EOF && rt.r.state != stateDone {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// messagesReader reads the concatenated messages from a MessageReader, for
+// the output of WriterOptions.FramePerWrite.
+type messagesReader struct {
+	mr  *MessageReader
+	msg []byte
+}
+
+func (m *messagesReader) Read(p []byte) (n int, err error) {
+	for len(m.msg) == 0 {
+		if m.msg, err = m.mr.ReadMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, m.msg)
+	m.msg = m.msg[n:]
+	return n, nil
+}
+
+// DecodeToHash decompresses src and writes the output to h, returning its
+// length, to check the digest of a stream of any size in constant memory.
+// The output is streamed through a small buffer and not retained.
+func DecodeToHash(src []byte, h gohash.Hash) (int64, error) {
+	r := NewReader(bytes.NewReader(src))
+	n, err := io.Copy(h, r)
+	if err == nil && r.state != stateDone {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
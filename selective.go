@@ -0,0 +1,183 @@
+package brotli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// The selective format is a sequence of parts, each consisting of a kind
+// byte (partRaw or partCompressed), the length of the part's body (4 bytes,
+// big-endian), and the body: the part's data as is, or a complete brotli
+// stream.
+const partHeaderSize = 5
+
+const (
+	partRaw        = 0
+	partCompressed = 1
+)
+
+var (
+	errNoPart         = errors.New("brotli: no part in progress")
+	errPartInProgress = errors.New("brotli: part already in progress")
+	errInvalidPart    = errors.New("brotli: invalid part header")
+	errPartTooLarge   = errors.New("brotli: part is 4 GiB or larger")
+)
+
+// A SelectiveWriter writes a sequence of parts, compressing only those that
+// are marked for compression, so that data that is already compressed (such
+// as images or archives) can be passed through without wasting time on it.
+// A SelectiveReader recovers the parts.
+type SelectiveWriter struct {
+	dst      io.Writer
+	w        *Writer
+	inPart   bool
+	compress bool
+	body     bytes.Buffer
+	err      error
+}
+
+// NewSelectiveWriter returns a SelectiveWriter that writes to dst,
+// compressing parts with the given options.
+func NewSelectiveWriter(dst io.Writer, options WriterOptions) *SelectiveWriter {
+	sw := &SelectiveWriter{dst: dst}
+	sw.w = NewWriterOptions(&sw.body, options)
+	return sw
+}
+
+// BeginPart starts a new part, which is compressed if compress is true and
+// written as is otherwise. The part's data is buffered until EndPart, since
+// the part's header records its length.
+func (sw *SelectiveWriter) BeginPart(compress bool) error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.inPart {
+		return errPartInProgress
+	}
+	sw.inPart = true
+	sw.compress = compress
+	sw.body.Reset()
+	if compress {
+		sw.w.Reset(&sw.body)
+	}
+	return nil
+}
+
+// Write adds p to the current part.
+func (sw *SelectiveWriter) Write(p []byte) (n int, err error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	if !sw.inPart {
+		return 0, errNoPart
+	}
+	if !sw.compress {
+		return sw.body.Write(p)
+	}
+	n, sw.err = sw.w.Write(p)
+	return n, sw.err
+}
+
+// EndPart ends the current part and writes it to the underlying writer.
+// A part's body (compressed, if it is compressed) must be less than 4 GiB,
+// since the header records its length in 4 bytes.
+func (sw *SelectiveWriter) EndPart() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if !sw.inPart {
+		return errNoPart
+	}
+	sw.inPart = false
+
+	var header [partHeaderSize]byte
+	header[0] = partRaw
+	if sw.compress {
+		header[0] = partCompressed
+		if sw.err = sw.w.Close(); sw.err != nil {
+			return sw.err
+		}
+	}
+	if uint64(sw.body.Len()) > math.MaxUint32 {
+		sw.err = errPartTooLarge
+		return sw.err
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(sw.body.Len()))
+	if _, sw.err = writeFull(sw.dst, header[:]); sw.err != nil {
+		return sw.err
+	}
+	_, sw.err = writeFull(sw.dst, sw.body.Bytes())
+	return sw.err
+}
+
+// A SelectiveReader reads the parts written by a SelectiveWriter.
+type SelectiveReader struct {
+	src  io.Reader
+	part io.LimitedReader // the body of the current part
+	cur  io.Reader        // reads the current part's data
+	r    *Reader
+}
+
+// NewSelectiveReader returns a SelectiveReader that reads from src.
+func NewSelectiveReader(src io.Reader) *SelectiveReader {
+	return &SelectiveReader{src: src}
+}
+
+// NextPart skips the rest of the current part, if any, and starts reading
+// the next one, reporting whether it was compressed. It returns io.EOF if
+// there are no more parts.
+func (sr *SelectiveReader) NextPart() (compressed bool, err error) {
+	if sr.cur != nil {
+		if _, err := io.Copy(ioutil.Discard, &sr.part); err != nil {
+			return false, err
+		}
+		sr.cur = nil
+	}
+
+	var header [partHeaderSize]byte
+	if _, err := io.ReadFull(sr.src, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return false, errInvalidPart
+		}
+		return false, err
+	}
+	sr.part = io.LimitedReader{R: sr.src, N: int64(binary.BigEndian.Uint32(header[1:]))}
+	switch header[0] {
+	case partRaw:
+		sr.cur = &sr.part
+	case partCompressed:
+		if sr.r == nil {
+			sr.r = NewReader(&sr.part)
+		} else {
+			sr.r.Reset(&sr.part)
+		}
+		sr.cur = sr.r
+	default:
+		return false, errInvalidPart
+	}
+	return header[0] == partCompressed, nil
+}
+
+// Read reads (and, if necessary, decompresses) data from the current part.
+// It returns io.EOF at the end of the part.
+func (sr *SelectiveReader) Read(p []byte) (n int, err error) {
+	if sr.cur == nil {
+		return 0, errNoPart
+	}
+	n, err = sr.cur.Read(p)
+	if err == io.EOF {
+		if sr.part.N > 0 {
+			// The part was cut short.
+			return n, io.ErrUnexpectedEOF
+		}
+		if sr.cur == io.Reader(sr.r) && sr.r.state != stateDone {
+			// The brotli stream was cut short.
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
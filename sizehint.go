@@ -0,0 +1,26 @@
+package brotli
+
+import "encoding/binary"
+
+// A size hint, as written by a Writer with WriterOptions.EmitSizeHint, is
+// a metadata metablock at the start of the stream containing sizeHintMagic
+// followed by the uncompressed size of the stream as a 64-bit big-endian
+// integer. Decoders that don't know about it skip it like any metadata.
+const sizeHintMagic = "BrSz"
+
+const sizeHintLen = len(sizeHintMagic) + 8
+
+func appendSizeHint(buf []byte, size int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(size))
+	buf = append(buf, sizeHintMagic...)
+	return append(buf, b[:]...)
+}
+
+func parseSizeHint(b []byte) (size int64, ok bool) {
+	if len(b) != sizeHintLen || string(b[:len(sizeHintMagic)]) != sizeHintMagic {
+		return 0, false
+	}
+	size = int64(binary.BigEndian.Uint64(b[len(sizeHintMagic):]))
+	return size, size >= 0
+}
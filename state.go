@@ -1,6 +1,9 @@
 package brotli
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 /* Copyright 2015 Google Inc. All Rights Reserved.
 
@@ -91,6 +94,79 @@ type Reader struct {
 	buf []byte // scratch space for reading from src
 	in  []byte // current chunk to decode; usually aliases buf
 
+	options  ReaderOptions
+	deadline time.Time // from options.Timeout; zero if there is none
+
+	// With options.Postprocess, processedOut holds the rest of its output,
+	// once postprocessed is set.
+	postprocessed bool
+	processedOut  []byte
+
+	// staticDict is parsed from options.ReplaceBuiltinDictionary by
+	// NewReaderOptions; staticDictErr reports invalid data.
+	staticDict    *dictionary
+	staticDictErr error
+
+	// traceCopy, if not nil, is called with each copy that is decoded,
+	// traceDictionary with each valid reference to the static dictionary,
+	// and traceUncompressed with each uncompressed metablock, for
+	// AnalyzeStream, AnalyzeDictionaryUsage, and tests.
+	traceCopy         func(distance, length int, dictionary bool)
+	traceDictionary   func(wordLength int, transformed bool)
+	traceUncompressed func()
+
+	// stats is returned by Stats, and reset by Reset.
+	stats ReaderStats
+	probe [1]byte // for ReadAll to look for the end of the output
+
+	// produced counts the output of Read, for options.ExpectedSize.
+	produced int64
+
+	// For options.MaxTotalAlloc, the memory allocated for the window that
+	// the Reader holds, and for the tables of the current stream and
+	// metablock; allocLimitHit records that an allocation was refused.
+	windowAlloc   int
+	streamAlloc   int
+	tableAlloc    int
+	allocLimitHit bool
+
+	// The tables of each stream and metablock are carved out of these
+	// buffers (and those of the huffmanTreeGroups), which are kept across
+	// metablocks, streams and Reset, so that a reused Reader doesn't
+	// allocate them again.
+	blockTypeTreesBuf []huffmanCode
+	contextModesBuf   []byte
+	contextMapBuf     []byte
+	distContextMapBuf []byte
+
+	// The state of the search for options.ChunkBoundary: the gear hash, the
+	// output so far, and the offset of the last boundary.
+	chunkHash   uint64
+	chunkOffset int64
+	chunkStart  int64
+
+	// fixedWindow is set by NewBoundedReader: the ring buffer must fit in
+	// options.WindowBuffer.
+	fixedWindow bool
+
+	// A size hint written with WriterOptions.EmitSizeHint is collected in
+	// metadataBuf while decoding a metadata block that may contain one.
+	sizeHint        int64
+	hasSizeHint     bool
+	collectSizeHint bool
+	metadataBuf     [sizeHintLen]byte
+	metadataLen     int
+
+	// For options.OnMetablockBytes, the compressed input is collected in
+	// metablockBuf, which starts at offset metablockStart in the stream,
+	// until the end of each metablock, which markMetablockEnd records in
+	// metablockEnds. inPos is the offset of the input being decoded.
+	metablockBuf   []byte
+	metablockStart int64
+	metablockEnds  []int64
+	metablockIndex int
+	inPos          int64
+
 	state        int
 	loop_counter int
 	br           bitReader
@@ -102,6 +178,7 @@ type Reader struct {
 	pos                         int
 	max_backward_distance       int
 	max_distance                int
+	custom_dict_size            int
 	ringbuffer_size             int
 	ringbuffer_mask             int
 	dist_rb_idx                 int
@@ -200,6 +277,8 @@ func decoderStateInit(s *Reader) bool {
 
 	s.block_type_trees = nil
 	s.block_len_trees = nil
+	s.streamAlloc = 0
+	s.tableAlloc = 0
 	s.ringbuffer_size = 0
 	s.new_ringbuffer_size = 0
 	s.ringbuffer_mask = 0
@@ -226,7 +305,16 @@ func decoderStateInit(s *Reader) bool {
 	s.canny_ringbuffer_allocation = 1
 
 	s.window_bits = 0
+	s.sizeHint = 0
+	s.hasSizeHint = false
+	s.collectSizeHint = false
+	s.metablockBuf = s.metablockBuf[:0]
+	s.metablockStart = 0
+	s.metablockEnds = s.metablockEnds[:0]
+	s.metablockIndex = 0
+	s.inPos = 0
 	s.max_distance = 0
+	s.custom_dict_size = 0
 	s.dist_rb[0] = 16
 	s.dist_rb[1] = 15
 	s.dist_rb[2] = 11
@@ -239,6 +327,9 @@ func decoderStateInit(s *Reader) bool {
 	s.symbol_lists.offset = huffmanMaxCodeLength + 1
 
 	s.dictionary = getDictionary()
+	if s.staticDict != nil {
+		s.dictionary = s.staticDict
+	}
 	s.transforms = getTransforms()
 
 	return true
@@ -272,6 +363,7 @@ func decoderStateMetablockBegin(s *Reader) {
 	s.insert_copy_hgroup.htrees = nil
 	s.distance_hgroup.codes = nil
 	s.distance_hgroup.htrees = nil
+	s.tableAlloc = 0
 }
 
 func decoderStateCleanupAfterMetablock(s *Reader) {
@@ -285,10 +377,34 @@ func decoderStateCleanupAfterMetablock(s *Reader) {
 
 func decoderHuffmanTreeGroupInit(s *Reader, group *huffmanTreeGroup, alphabet_size uint32, max_symbol uint32, ntrees uint32) bool {
 	var max_table_size uint = uint(kMaxHuffmanTableSize[(alphabet_size+31)>>5])
+	if !s.allocate(&s.tableAlloc, int(ntrees)*(sliceHeaderSize+int(max_table_size)*huffmanCodeSize)) {
+		return false
+	}
 	group.alphabet_size = uint16(alphabet_size)
 	group.max_symbol = uint16(max_symbol)
 	group.num_htrees = uint16(ntrees)
-	group.htrees = make([][]huffmanCode, ntrees)
-	group.codes = make([]huffmanCode, (uint(ntrees) * max_table_size))
+	if cap(group.htreesBuf) < int(ntrees) {
+		group.htreesBuf = make([][]huffmanCode, ntrees)
+	}
+	group.htrees = group.htreesBuf[:ntrees]
+	group.codes = reuseCodes(&group.codesBuf, int(uint(ntrees)*max_table_size))
 	return !(group.codes == nil)
 }
+
+// reuseBytes returns a slice of n bytes from *buf, which is replaced by a
+// larger one if it is too small. Like the C decoder's malloc, it doesn't
+// clear reused memory; the decoder writes the tables before reading them.
+func reuseBytes(buf *[]byte, n int) []byte {
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	return (*buf)[:n]
+}
+
+// reuseCodes is reuseBytes for Huffman tables.
+func reuseCodes(buf *[]huffmanCode, n int) []huffmanCode {
+	if cap(*buf) < n {
+		*buf = make([]huffmanCode, n)
+	}
+	return (*buf)[:n]
+}
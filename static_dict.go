@@ -73,6 +73,9 @@ func isMatch(d *dictionary, w dictWord, data []byte, max_length uint) bool {
 
 func findAllStaticDictionaryMatches(dict *encoderDictionary, data []byte, min_length uint, max_length uint, matches []uint32) bool {
 	var has_found_match bool = false
+	if dict.words == nil {
+		return false
+	}
 	{
 		var offset uint = uint(dict.buckets[hash(data)])
 		var end bool = offset == 0
@@ -0,0 +1,92 @@
+package brotli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A SinkSpec describes one of the outputs of a TeeWriter.
+type SinkSpec struct {
+	W       io.Writer
+	Options WriterOptions
+}
+
+// A TeeWriter compresses the same data to several sinks at once, each with
+// its own options, such as a high quality encoding to cache and a fast one
+// to serve right away. A sink that fails is dropped, and the others carry
+// on.
+type TeeWriter struct {
+	writers []*Writer
+	errs    []error
+}
+
+// NewTeeWriter returns a TeeWriter that compresses to sinks.
+func NewTeeWriter(sinks []SinkSpec) *TeeWriter {
+	t := &TeeWriter{
+		writers: make([]*Writer, len(sinks)),
+		errs:    make([]error, len(sinks)),
+	}
+	for i, s := range sinks {
+		t.writers[i] = NewWriterOptions(s.W, s.Options)
+	}
+	return t
+}
+
+// A TeeError reports the errors from the sinks of a TeeWriter, indexed like
+// the sinks; the sinks that haven't failed have a nil error.
+type TeeError []error
+
+func (e TeeError) Error() string {
+	var msgs []string
+	for i, err := range e {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("sink %d: %v", i, err))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// err returns the errors so far, or nil if there were none.
+func (t *TeeWriter) err() error {
+	for _, err := range t.errs {
+		if err != nil {
+			return append(TeeError(nil), t.errs...)
+		}
+	}
+	return nil
+}
+
+// Write compresses p to each sink that hasn't failed. If any sink has
+// failed, it returns a TeeError, but there is no need to stop writing
+// unless all of them have.
+func (t *TeeWriter) Write(p []byte) (n int, err error) {
+	for i, w := range t.writers {
+		if t.errs[i] == nil {
+			_, t.errs[i] = w.Write(p)
+		}
+	}
+	return len(p), t.err()
+}
+
+// Flush flushes each sink that hasn't failed, like Writer.Flush. It returns
+// a TeeError if any sink has failed.
+func (t *TeeWriter) Flush() error {
+	for i, w := range t.writers {
+		if t.errs[i] == nil {
+			t.errs[i] = w.Flush()
+		}
+	}
+	return t.err()
+}
+
+// Close finishes the stream for each sink that hasn't failed, like
+// Writer.Close. It returns a TeeError if any sink has failed, at any point.
+func (t *TeeWriter) Close() error {
+	for i, w := range t.writers {
+		if t.errs[i] == nil {
+			t.errs[i] = w.Close()
+		}
+	}
+	return t.err()
+}
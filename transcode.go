@@ -0,0 +1,49 @@
+package brotli
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// A GzipError is returned by TranscodeGzip for a problem with its gzip
+// input, as opposed to compressing or writing the output.
+type GzipError struct {
+	Err error
+}
+
+func (e *GzipError) Error() string { return "brotli: reading gzip input: " + e.Err.Error() }
+
+func (e *GzipError) Unwrap() error { return e.Err }
+
+// TranscodeGzip decompresses the gzip data from src and writes it to dst
+// compressed with brotli, streaming rather than buffering the whole
+// payload. Errors from reading or decompressing src are returned as a
+// *GzipError; other errors come from compressing or writing to dst. The
+// brotli stream is not finished if an error occurs.
+func TranscodeGzip(dst io.Writer, src io.Reader, options WriterOptions) error {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return &GzipError{err}
+	}
+	w := NewWriterOptions(dst, options)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := zr.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return &GzipError{readErr}
+		}
+	}
+	if err := zr.Close(); err != nil {
+		return &GzipError{err}
+	}
+	return w.Close()
+}
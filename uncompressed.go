@@ -0,0 +1,39 @@
+package brotli
+
+// WrapUncompressed returns a brotli stream that stores data verbatim, in
+// uncompressed metablocks, for payloads too small for compression to help,
+// such as when an HTTP handler uses Content-Encoding: br for every
+// response. It is much cheaper than running the encoder, and the stream
+// decodes to exactly data. The overhead is 4 bytes for up to 64 KiB of
+// data, and 5 bytes up to 16 MiB; each further 16 MiB adds 4 bytes.
+func WrapUncompressed(data []byte) []byte {
+	const maxMetablock = 1 << 24
+	chunks := (len(data) + maxMetablock - 1) / maxMetablock
+	// Each metablock header takes up to 4 bytes. writeBits also needs 8
+	// bytes of room after the position it writes to.
+	storage := make([]byte, len(data)+4*chunks+2+8)
+
+	// A 64 KiB window takes the shortest stream header, 1 bit.
+	var storage_ix uint
+	var header uint16
+	var headerBits byte
+	encodeWindowBits(16, false, &header, &headerBits)
+	writeBits(uint(headerBits), uint64(header), &storage_ix, storage)
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxMetablock {
+			n = maxMetablock
+		}
+		storeUncompressedMetaBlockHeader(uint(n), &storage_ix, storage)
+		jumpToByteBoundary(&storage_ix, storage)
+		copy(storage[storage_ix>>3:], data[:n])
+		storage_ix += uint(n) << 3
+		data = data[n:]
+	}
+
+	// An uncompressed metablock can't be the last one, so end with an
+	// empty one: ISLAST and ISLASTEMPTY.
+	writeBits(2, 3, &storage_ix, storage)
+	return storage[:(storage_ix+7)>>3]
+}
@@ -1,8 +1,11 @@
 package brotli
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"math"
 )
 
 const (
@@ -16,16 +19,433 @@ type WriterOptions struct {
 	// Quality controls the compression-speed vs compression-density trade-offs.
 	// The higher the quality, the slower the compression. Range is 0 to 11.
 	Quality int
+	// LargeInputSize, if positive, caps the quality for streams larger than
+	// that many bytes at LargeInputQuality, so that large inputs don't take
+	// too long, while small ones still get the full Quality. By default
+	// there is no cap. Since the quality must be chosen before compression
+	// starts, the Writer holds back up to LargeInputSize bytes of input to
+	// find out whether the stream is larger; if it is flushed before then,
+	// the stream counts as small. It has no effect with GrowWindow.
+	LargeInputSize    int
+	LargeInputQuality int
 	// LGWin is the base 2 logarithm of the sliding window size.
-	// Range is 10 to 24. 0 indicates automatic configuration based on Quality.
+	// Range is 10 to 24. 0 indicates automatic configuration based on Quality
+	// (see also AutoWindow and NewWriterSize). Qualities 0 and 1 always use
+	// at least LGWin 18.
 	LGWin int
+	// AutoWindow, if LGWin is 0, makes the Writer choose the window from the
+	// size of the stream: if the whole stream is shorter than 1 MiB and is
+	// written before Close, the Writer uses the smallest window that covers
+	// it (and the Dictionary), which reduces the memory needed to decode it;
+	// otherwise, including when Flush is called first, it uses a 4 MiB
+	// window (LGWin 22). To make this possible, the Writer holds back up to
+	// 1 MiB of input before it starts compressing, which delays the output
+	// and costs that much memory. It has no effect with AutoFlushBytes,
+	// GrowWindow, or LowLatency. If the size is known in advance,
+	// NewWriterSize chooses the window without holding back input.
+	AutoWindow bool
+	// Mode is a hint about the kind of data being compressed. Currently only
+	// ModeFont changes how it is compressed.
+	Mode Mode
+	// GrowWindow makes the Writer start with a small window (64 KiB) and,
+	// each time the input exceeds the current window, end the stream and
+	// start a new one with a window four times as large, up to LGWin (or
+	// 4 MiB if LGWin is 0). This keeps memory use small for short streams
+	// whose length isn't known in advance, but each new stream loses the
+	// history of the previous ones, and the output is a concatenation of
+	// brotli streams, which only a Reader with ReaderOptions.Multistream
+	// (or another decoder that supports concatenated streams) can decode.
+	GrowWindow bool
+	// EmitSizeHint makes the Writer start the stream with a metadata block
+	// recording the uncompressed size, which Reader.SizeHint reports and
+	// DecodeInto uses to allocate its output at once. Since the size must be
+	// known before any output is written, the Writer holds all input in
+	// memory until Close, so this is meant for data that is compressed in
+	// one go. If Flush is called first, no size hint is written. Decoders
+	// that don't know about size hints ignore the metadata block.
+	EmitSizeHint bool
+	// AbortIfLarger makes the Writer fail with ErrNotCompressible as soon as
+	// the compressed output would be larger than the input consumed so far,
+	// so that the caller can store the data uncompressed instead. (This
+	// includes the case of empty input, whose encoding is one byte long.)
+	// Output already passed to the underlying writer is not retracted.
+	AbortIfLarger bool
+	// CompactEnd makes the final data metablock also mark the end of the
+	// stream, instead of following it with a separate empty metablock, for
+	// decoders that can't handle the latter. Since an uncompressed metablock
+	// can't end the stream, the final metablock is always compressed, which
+	// may make the output slightly larger for incompressible or tiny inputs.
+	// A separate empty metablock is still needed if nothing was written
+	// after the last Flush, and at qualities 0 and 1, which always use one.
+	CompactEnd bool
+	// ExtraOptimize makes Quality 11 search even harder for a compact
+	// encoding: it uses the largest window (unless LGWin is set), evaluates
+	// more match candidates, and refines the cost model and the block splits
+	// with more passes. This makes compression about twice as slow for a gain
+	// of typically well under one percent, so it is only intended for
+	// offline compression of static assets. It has no effect at lower
+	// qualities.
+	ExtraOptimize bool
+	// BlockSplitPasses, if positive, sets the number of passes that refine
+	// the split of each metablock into blocks with their own entropy codes,
+	// instead of the default of 3 (or 10 at Quality 11, 20 with
+	// ExtraOptimize). The range is 1 to 100. The time spent on block
+	// splitting grows linearly with the number of passes; it is a small part
+	// of the total at Quality 11, but can dominate at lower qualities. More
+	// passes rarely gain more than a fraction of a percent, so this is meant
+	// for offline compression of static assets. Block splitting is only done
+	// at qualities 4 and above.
+	BlockSplitPasses int
+	// MaxMetablockSize, if positive, limits the amount of uncompressed data
+	// in each metablock, for decoders on the other side that buffer whole
+	// metablocks and have little memory. The format allows up to 16 MiB
+	// (1 << 24), which is the largest valid value. Small limits cost
+	// compression ratio, since each metablock has its own entropy codes.
+	MaxMetablockSize int
+	// AutoFlushBytes, if positive, makes the Writer flush automatically each
+	// time that many bytes have been written since the last flush, which
+	// bounds how much input can be held back from the reader at the other
+	// end. Like any flush, this costs compression ratio, especially when
+	// AutoFlushBytes is small.
+	AutoFlushBytes int
+	// ReuseEntropyCodes makes Reset keep the prefix code for commands that
+	// the Writer has adapted to the previous stream, and start the next
+	// stream with it instead of the built-in default. This helps when
+	// compressing many small, similar messages. Each stream still carries
+	// its code and decodes independently, but the output for a message then
+	// depends on the messages compressed before it. It only has an effect
+	// at Quality 0; the other qualities build new codes for each metablock.
+	ReuseEntropyCodes bool
+	// IOBufferSize, if positive, makes the Writer collect its output and
+	// write it to the underlying writer in chunks of exactly that many
+	// bytes (except for the last chunk at each Flush or Close), such as the
+	// block size of a storage system. By default, each piece of output,
+	// typically a compressed metablock, is written as soon as it is ready,
+	// which means writes of anything from a few bytes to several megabytes.
+	IOBufferSize int
+	// OnFlushChunk, if not nil, receives the output instead of the
+	// underlying writer (which can be ioutil.Discard), in one call for
+	// each Flush and one for Close, such as for sending each flush as a
+	// message of a framed transport like WebSocket. The chunk is only valid
+	// during the call. Since the output is collected until then, a long
+	// stream without flushes takes a lot of memory. If OnFlushChunk returns
+	// an error, the Writer fails with it. IOBufferSize is ignored.
+	OnFlushChunk func(chunk []byte) error
+	// FlushAlignment, if greater than 1, makes each Flush pad the output to
+	// the next multiple of that many bytes (counted from the start of the
+	// stream), such as the sector size of a block device. The padding
+	// consists of metadata blocks, which decoders ignore. It counts as
+	// output for AbortIfLarger and Ratio. Close doesn't pad.
+	FlushAlignment int
+	// OnBlockHash, if not nil, is called with a 64-bit FNV-1a hash of each
+	// block of output, numbered from 0 in each stream, as the encoder emits
+	// it. A block is normally a compressed metablock (at the lowest
+	// qualities, a group of them); the stream header, flush padding, and
+	// metadata are reported as blocks of their own. Since the blocks are
+	// cut at the same points for the same input and options, a
+	// deduplicating store can use the hashes to recognize output it has
+	// already stored. Metablocks don't start on byte boundaries, so a block
+	// also depends on the last few bits of the block before it.
+	OnBlockHash func(blockIndex int, blockHash uint64)
+	// OutputSizeHint, if positive, is the expected size of the compressed
+	// stream, such as the size of a similar earlier message. The Writer uses
+	// it to presize its staging buffer for compressed metablocks, and, if
+	// the destination is a *bytes.Buffer, the destination. An inaccurate
+	// hint only costs memory or extra allocations.
+	OutputSizeHint int
+	// Dictionary, if not empty, is data that the stream can refer back to as
+	// if it had been compressed just before it, such as a previous message
+	// similar to the one being compressed. Only the last window's worth of
+	// it (the window size minus 16 bytes) is used. The stream can then only
+	// be decoded by a Reader with the same ReaderOptions.Dictionary.
+	// Qualities 0 and 1 can't refer to it, so they are raised to 2 when a
+	// dictionary is set, here or with PreparedDictionary or Dictionaries.
+	Dictionary []byte
+	// DisableBuiltinDictionary stops the Writer from searching brotli's
+	// built-in static dictionary, a collection of words and phrases common in
+	// text and web content, for matches. Such matches are rare in binary
+	// data, so disabling them there costs (almost) nothing in compression
+	// ratio and saves the lookups. The saving is usually small, though, since
+	// qualities below 10 already stop looking when few lookups succeed. The
+	// output is still a standard brotli stream. Qualities 0 and 1 never use
+	// the dictionary. (The option is negated so that the zero WriterOptions
+	// keeps the dictionary enabled.)
+	DisableBuiltinDictionary bool
+	// PreparedDictionary, if not nil, is used instead of Dictionary, with
+	// the hash table size chosen by PrepareDictionary, and the hash table
+	// built by PreparedDictionary.Warm, if any.
+	PreparedDictionary *PreparedDictionary
+	// Dictionaries, if not empty, are used together instead of
+	// PreparedDictionary or Dictionary, such as a global dictionary and a
+	// more specific one. They act as a single dictionary, concatenated in
+	// order, so put the most specific one last: it is closest to the data,
+	// which makes references to it the cheapest, and if the dictionaries
+	// add up to more than the window, the first ones are cut off first. The
+	// hash table is the largest that any of them was prepared with, or, if
+	// none set HashBits, chosen from their total size. The stream can only be
+	// decoded by a Reader with the same data, in the same order, as
+	// ReaderOptions.Dictionaries.
+	Dictionaries []*PreparedDictionary
+	// ReplaceBuiltinDictionary, if not nil, replaces the built-in static
+	// dictionary (unless DisableBuiltinDictionary is set) with a
+	// domain-specific one. It starts with 21 bytes giving, for each word
+	// length from 4 to 24, the base-2 logarithm of the number of words of
+	// that length (at most 11, or 0 for none), followed by the words,
+	// grouped by length in increasing order. The words are used with the
+	// standard transforms, such as adding a space or uppercasing the first
+	// letter.
+	//
+	// The output is NOT a standard brotli stream: other decoders will report
+	// an error or, worse, silently produce the wrong data. It can only be
+	// decoded by a Reader with the same ReaderOptions.ReplaceBuiltinDictionary.
+	// If the dictionary is invalid, the Writer fails with an error.
+	ReplaceBuiltinDictionary []byte
+	// CollectStats enables collection of the statistics returned by
+	// Writer.MatchStats. It adds a little overhead, so it is off by default.
+	CollectStats bool
+	// Preprocess, if not nil, transforms the input before it is compressed,
+	// such as delta-encoding a column of numbers, which can make it much
+	// more compressible. The stream can then only be decoded by a Reader
+	// with the inverse transform as its ReaderOptions.Postprocess; it is not
+	// a standard brotli stream as far as other decoders are concerned,
+	// since they produce the transformed data. Since the transform gets the
+	// whole input at once, the Writer collects it until Close; Flush does
+	// nothing.
+	Preprocess func([]byte) []byte
+	// MaxMatchDistance, if positive, limits how far back a copy may refer,
+	// for decoders with restricted support for distances. The window is
+	// reduced to the smallest that covers it, and references to the
+	// built-in dictionary, which count as further back than the window, are
+	// not used. It can be at most 16777200, the largest distance in a
+	// standard window.
+	//
+	// MaxMatchLength, if positive, limits the length of a copy; it must be
+	// at least 2, the shortest that the format allows.
+	//
+	// Copies that are too long are split, and those that can't be kept are
+	// written as literals, so the limits cost some compression. Qualities 0
+	// and 1, which can't apply them, are raised to 2.
+	MaxMatchDistance int
+	MaxMatchLength   int
+	// FormatCompat, if not zero, pins the encoder's heuristics to those of
+	// an earlier version of this package, identified by a compat level, so
+	// that the same input and options keep producing the same bytes after
+	// an upgrade, such as for a build cache keyed by the compressed output.
+	// Zero means the latest heuristics, which may change from one version to
+	// the next. Level 1 is the encoder as of the introduction of
+	// FormatCompat, which chose the window as with AutoWindow when LGWin is
+	// 0; level 2 uses the default window instead. LatestFormatCompat is the
+	// level of this version; versions that change the output add a level
+	// and keep supporting at least the previous few. With an unsupported
+	// level, the Writer fails with an error.
+	FormatCompat int
+	// FramePerWrite makes each Write (even an empty one) produce a complete,
+	// independent brotli stream of its own, preceded by its length, in the
+	// format of MessageWriter, so that a MessageReader reads back the data
+	// of each Write as one message, such as for a message queue producer.
+	// Unlike
+	// flushing after each Write, which still makes a single stream that has
+	// to be decoded from the start, any message decodes on its own. Flush
+	// does nothing, and Close writes nothing more.
+	FramePerWrite bool
+	// LongRangeMatching adds a search for long repeats anywhere in the
+	// window, such as blocks of log lines that recur megabytes apart, to
+	// the Writer's usual search, which at the lower qualities only
+	// remembers a few recent positions for each hash. It samples the
+	// positions with a rolling hash of 32 bytes, so it only finds repeats
+	// of at least 32 bytes, and mostly much longer ones. It costs a 64 MiB
+	// table and some speed, and pays off with a large window (LGWin) on
+	// highly repetitive data. It applies to qualities 2 to 9; qualities 0
+	// and 1 are raised to 2, and qualities 10 and 11 already search the
+	// whole window.
+	LongRangeMatching bool
+	// CostModel, if not nil, replaces brotli's estimates of the cost of
+	// literals and copies in the search for the cheapest sequence of them
+	// at qualities 10 and 11, such as for research into other cost
+	// functions. It is EXPERIMENTAL: the interface may change or go away in
+	// any release. The output is always a valid stream, however poor the
+	// model.
+	CostModel CostModel
+	// MemoryBudget, if positive, is the most memory, in bytes, that the
+	// Writer should allocate for its window, hash table and buffers. If the
+	// window (LGWin, or the default) would need more, it is reduced until
+	// the estimate fits, down to the smallest window, 1 KiB, at the cost of
+	// compression; AdjustedWindow reports the result. The other options,
+	// such as Quality, are kept, so a small budget may still be exceeded.
+	MemoryBudget int
+	// LowLatency makes the Writer emit compressed data sooner after it is
+	// written, such as for an interactive session where the time to the
+	// first byte matters more than throughput: metablocks hold at most
+	// 16 KiB of input (unless MaxMetablockSize is smaller), and the Writer
+	// doesn't hold back input to choose the window (see AutoWindow). Unlike
+	// AutoFlushBytes, it doesn't flush, so the output of the last metablock
+	// may still lag behind. The smaller metablocks cost some compression.
+	LowLatency bool
+	// StoredPreferred makes the Writer store all data uncompressed, in
+	// metablocks of 16 KiB, without searching it for matches, for servers
+	// that must answer with Content-Encoding: br but can't spend CPU time
+	// on compression. The output is a valid brotli stream, about 0.02%
+	// larger than the input (the ratio is just above 1.0), and it is
+	// written at close to the speed of copying memory. The stream declares
+	// the smallest window, 1 KiB, so decoders need little memory for it.
+	// Quality and LGWin are ignored.
+	StoredPreferred bool
 }
 
+// LatestFormatCompat is the WriterOptions.FormatCompat level that this
+// version of the package produces by default.
+const LatestFormatCompat = 2
+
+// formatCompatLevels lists, for each WriterOptions.FormatCompat level, the
+// heuristics that it pins, where they differ from the latest ones. Level 0
+// is the latest.
+var formatCompatLevels = [LatestFormatCompat + 1]struct {
+	// autoWindow chooses the window as with AutoWindow when LGWin is 0.
+	autoWindow bool
+}{
+	1: {autoWindow: true},
+}
+
+// A Mode describes the kind of data being compressed.
+type Mode int
+
+const (
+	// ModeGeneric is for data whose kind is unknown.
+	ModeGeneric Mode = modeGeneric
+	// ModeText is for UTF-8 text.
+	ModeText Mode = modeText
+	// ModeFont is for WOFF 2.0 font data.
+	ModeFont Mode = modeFont
+)
+
+// MatchStats summarizes the LZ77 commands produced by a Writer.
+// Statistics are not collected at qualities 0 and 1, which emit their
+// commands directly instead of buffering them.
+type MatchStats struct {
+	// Literals is the number of bytes encoded as literals.
+	Literals int
+	// Copies is the number of backward references.
+	Copies int
+	// CopiedBytes is the total number of bytes encoded as backward references.
+	CopiedBytes int
+	// RepeatDistances is the number of copies that reuse one of the recently
+	// used distances.
+	RepeatDistances int
+	// DistanceHistogram[n] is the number of other copies whose distance
+	// is n bits long.
+	DistanceHistogram [32]int
+}
+
+// AverageMatchLength returns the mean length of the backward references.
+func (st MatchStats) AverageMatchLength() float64 {
+	if st.Copies == 0 {
+		return 0
+	}
+	return float64(st.CopiedBytes) / float64(st.Copies)
+}
+
+// EncodeInfo describes how a Writer encoded its input.
+type EncodeInfo struct {
+	// LGWin is the base 2 logarithm of the window size declared in the
+	// stream header, as chosen by automatic window selection (see
+	// WriterOptions.AutoWindow and NewWriterSize) or raised to 18 at qualities 0 and 1. With
+	// GrowWindow, it is the window of the last stream.
+	LGWin int
+	// Metablocks is the number of metablocks holding data, not counting
+	// empty and metadata ones.
+	Metablocks int
+	// Stored reports whether the encoder fell back to storing any metablock
+	// uncompressed.
+	Stored bool
+}
+
+func (st *MatchStats) addCommands(cmds []command, dist *distanceParams) {
+	for i := range cmds {
+		cmd := &cmds[i]
+		st.Literals += int(cmd.insert_len_)
+		copyLen := commandCopyLen(cmd)
+		if copyLen == 0 {
+			continue
+		}
+		st.Copies++
+		st.CopiedBytes += int(copyLen)
+		distanceCode := commandRestoreDistanceCode(cmd, dist)
+		if distanceCode < numDistanceShortCodes {
+			st.RepeatDistances++
+		} else {
+			st.DistanceHistogram[log2FloorNonZero(uint(distanceCode-numDistanceShortCodes+1))+1]++
+		}
+	}
+}
+
+// ErrNotCompressible is returned by a Writer with AbortIfLarger set when the
+// compressed data would be larger than the original.
+var ErrNotCompressible = errors.New("brotli: data is not compressible")
+
+// ErrOutputFull is returned by a Writer from NewWriterLimit when the
+// compressed output would exceed its limit.
+var ErrOutputFull = errors.New("brotli: output limit reached")
+
 var (
-	errEncode       = errors.New("brotli: encode error")
-	errWriterClosed = errors.New("brotli: Writer is closed")
+	errEncode                  = errors.New("brotli: encode error")
+	errWriterClosed            = errors.New("brotli: Writer is closed")
+	errInvalidQuality          = errors.New("brotli: invalid Quality")
+	errInvalidLGWin            = errors.New("brotli: invalid LGWin")
+	errInvalidMode             = errors.New("brotli: invalid Mode")
+	errInvalidBlockSplitPasses = errors.New("brotli: invalid BlockSplitPasses")
+	errInvalidMaxMetablockSize = errors.New("brotli: invalid MaxMetablockSize")
+	errInvalidFormatCompat     = errors.New("brotli: unsupported FormatCompat")
+	errInvalidMemoryBudget     = errors.New("brotli: invalid MemoryBudget")
+	errInvalidMaxMatchDistance = errors.New("brotli: invalid MaxMatchDistance")
+	errInvalidMaxMatchLength   = errors.New("brotli: invalid MaxMatchLength")
 )
 
+// maxBlockSplitPasses is the largest valid WriterOptions.BlockSplitPasses.
+const maxBlockSplitPasses = 100
+
+// maxMetablockLen is the most uncompressed data a metablock can hold.
+const maxMetablockLen = 1 << 24
+
+// lowLatencyMetablockSize is the metablock size limit for
+// WriterOptions.LowLatency.
+const lowLatencyMetablockSize = 1 << 14
+
+// checkOptions reports whether options are within the documented ranges.
+// (NewWriterOptions itself silently clamps out-of-range values.)
+func checkOptions(options WriterOptions) error {
+	if options.Quality < BestSpeed || options.Quality > BestCompression {
+		return errInvalidQuality
+	}
+	if options.LGWin != 0 && (options.LGWin < minWindowBits || options.LGWin > maxWindowBits) {
+		return errInvalidLGWin
+	}
+	if options.Mode < ModeGeneric || options.Mode > ModeFont {
+		return errInvalidMode
+	}
+	if options.BlockSplitPasses < 0 || options.BlockSplitPasses > maxBlockSplitPasses {
+		return errInvalidBlockSplitPasses
+	}
+	if options.LargeInputSize > 0 && (options.LargeInputQuality < BestSpeed || options.LargeInputQuality > BestCompression) {
+		return errInvalidQuality
+	}
+	if options.MaxMetablockSize < 0 || options.MaxMetablockSize > maxMetablockLen {
+		return errInvalidMaxMetablockSize
+	}
+	if options.MaxMatchDistance < 0 || options.MaxMatchDistance > int(maxBackwardLimit(maxWindowBits)) {
+		return errInvalidMaxMatchDistance
+	}
+	if options.MaxMatchLength < 0 || options.MaxMatchLength > 0 && options.MaxMatchLength < minMatchLengthLimit {
+		return errInvalidMaxMatchLength
+	}
+	if options.FormatCompat < 0 || options.FormatCompat > LatestFormatCompat {
+		return errInvalidFormatCompat
+	}
+	if options.MemoryBudget < 0 {
+		return errInvalidMemoryBudget
+	}
+	return nil
+}
+
 // Writes to the returned writer are compressed and written to dst.
 // It is the caller's responsibility to call Close on the Writer when done.
 // Writes may be buffered and not flushed until Close.
@@ -43,10 +463,67 @@ func NewWriterLevel(dst io.Writer, level int) *Writer {
 	})
 }
 
+// NewWriterLevelDict is like NewWriterLevel but compresses the stream as a
+// continuation of dict, like flate.NewWriterDict; it is the same as
+// NewWriterOptions with WriterOptions{Quality: level, Dictionary: dict}.
+// The stream can only be decoded by a Reader with dict as its
+// ReaderOptions.Dictionary. Levels 0 and 1 are raised to 2 if dict is not
+// empty (see WriterOptions.Dictionary).
+func NewWriterLevelDict(dst io.Writer, level int, dict []byte) *Writer {
+	return NewWriterOptions(dst, WriterOptions{
+		Quality:    level,
+		Dictionary: dict,
+	})
+}
+
+// NewWriterSize is like NewWriterOptions, for a stream of totalSize bytes,
+// such as a file of known size. Unless options.LGWin is set, the window is
+// the smallest that covers the stream (and the dictionary, if any), up to
+// the default of 4 MiB, which saves memory in both the Writer and the
+// Reader, without holding back input to find out how much there is. The
+// window is kept across Reset. A stream that turns out to be larger is
+// still valid, but compresses less well.
+func NewWriterSize(dst io.Writer, options WriterOptions, totalSize int64) *Writer {
+	w := NewWriterOptions(dst, options)
+	if options.LGWin == 0 && totalSize >= 0 {
+		w.options.LGWin = int(smallestWindow(totalSize + int64(len(w.customDictionary()))))
+		w.Reset(dst)
+	}
+	return w
+}
+
+// NewWriterLimit is like NewWriterOptions, but the Writer writes at most
+// maxOutput bytes of compressed data to dst, such as for a record of fixed
+// capacity. Once a piece of output (typically a compressed metablock) would
+// exceed the limit, the Writer fails with ErrOutputFull, without writing
+// any of it, so that the caller can store the data elsewhere; what was
+// written before is an incomplete stream, which decodes to a prefix of the
+// data. The limit applies to each stream after Reset as well.
+func NewWriterLimit(dst io.Writer, options WriterOptions, maxOutput int) *Writer {
+	w := NewWriterOptions(dst, options)
+	w.maxOutput = int64(maxOutput)
+	return w
+}
+
 // NewWriterOptions is like NewWriter but specifies WriterOptions
 func NewWriterOptions(dst io.Writer, options WriterOptions) *Writer {
 	w := new(Writer)
 	w.options = options
+	w.preparedDict = options.PreparedDictionary
+	if len(options.Dictionaries) > 0 {
+		w.preparedDict = stackDictionaries(options.Dictionaries)
+	}
+	if options.ReplaceBuiltinDictionary != nil {
+		var words *dictionary
+		if words, w.staticDictErr = parseCustomDictionary(options.ReplaceBuiltinDictionary); words != nil {
+			w.staticDict = newCustomEncoderDictionary(words)
+		}
+	}
+	if options.FramePerWrite {
+		inner := options
+		inner.FramePerWrite = false
+		w.frames = NewMessageWriter(dst, inner)
+	}
 	w.Reset(dst)
 	return w
 }
@@ -54,14 +531,313 @@ func NewWriterOptions(dst io.Writer, options WriterOptions) *Writer {
 // Reset discards the Writer's state and makes it equivalent to the result of
 // its original state from NewWriter or NewWriterLevel, but writing to dst
 // instead. This permits reusing a Writer rather than allocating a new one.
+// The options are kept, including the dictionaries (such as
+// WriterOptions.PreparedDictionary), so a pooled Writer can be moved to a
+// new sink and still compress with them. (The Writer reuses its hash table,
+// but fills it from the dictionary again for each stream, by copying the
+// table kept by PreparedDictionary.Warm if there is one, or else by hashing
+// the dictionary.)
+//
+// If dst is a *bytes.Buffer, Reset grows it up front by OutputSizeHint or
+// else the compressed size of the previous stream, so that repeatedly compressing similar-sized
+// inputs doesn't repeatedly grow the buffer.
 func (w *Writer) Reset(dst io.Writer) {
+	if w.bytesOut > 0 {
+		w.sizeEstimate = w.bytesOut
+	}
+	w.bytesIn = 0
+	w.bytesOut = 0
+	if w.options.OutputSizeHint > 0 {
+		w.sizeEstimate = int64(w.options.OutputSizeHint)
+	}
+	if buf, ok := dst.(*bytes.Buffer); ok && w.sizeEstimate > 0 {
+		buf.Grow(int(w.sizeEstimate))
+	}
+
+	w.initEncoder()
+	if w.options.GrowWindow {
+		w.params.lgwin = growWindowStart
+	}
+	if hint := w.options.OutputSizeHint; hint > 0 {
+		// Metablocks never hold more than a window's worth of input.
+		if max := 1 << w.params.lgwin; hint > max {
+			hint = max
+		}
+		w.getStorage(2*hint + 503)
+	}
+	w.dst = dst
+	w.err = w.staticDictErr
+	compat := formatCompatLevels[0]
+	if c := w.options.FormatCompat; c < 0 || c > LatestFormatCompat {
+		w.err = errInvalidFormatCompat
+	} else {
+		compat = formatCompatLevels[c]
+	}
+	w.stats = MatchStats{}
+	w.info = EncodeInfo{}
+	w.sinceFlush = 0
+	w.streamIn = 0
+	w.written = 0
+	w.accepted = 0
+	w.flushedIn = 0
+	w.autoWindow = (w.options.AutoWindow || compat.autoWindow) && w.options.LGWin == 0 && !w.params.extra_optimize && w.options.AutoFlushBytes <= 0 && !w.options.GrowWindow && !w.options.LowLatency
+	w.holding = w.autoWindow || w.options.EmitSizeHint || w.mayCapQuality()
+	w.held = w.held[:0]
+	w.unprocessed = w.unprocessed[:0]
+	w.outBuf = w.outBuf[:0]
+	w.blockIndex = 0
+	if w.frames != nil {
+		w.frames.dst = dst
+		w.frames.err = nil
+	}
+	if size := w.options.IOBufferSize; size > 0 && cap(w.outBuf) < size {
+		w.outBuf = make([]byte, 0, size)
+		reportAlloc(size, "output buffer")
+	}
+}
+
+// initEncoder resets the encoder to the start of a stream with the
+// parameters from w.options.
+func (w *Writer) initEncoder() {
+	cmdCodeNumbits := w.cmd_code_numbits_
 	encoderInitState(w)
+	if w.options.ReuseEntropyCodes && w.options.Quality == BestSpeed {
+		w.cmd_code_numbits_ = cmdCodeNumbits
+	}
 	w.params.quality = w.options.Quality
 	if w.options.LGWin > 0 {
 		w.params.lgwin = uint(w.options.LGWin)
 	}
-	w.dst = dst
-	w.err = nil
+	if w.options.Mode >= ModeGeneric && w.options.Mode <= ModeFont {
+		w.params.mode = int(w.options.Mode)
+	}
+	w.params.compact_end = w.options.CompactEnd
+	if passes := w.options.BlockSplitPasses; passes > 0 {
+		if passes > maxBlockSplitPasses {
+			passes = maxBlockSplitPasses
+		}
+		w.params.block_split_passes = uint(passes)
+	}
+	if size := w.options.MaxMetablockSize; size > 0 {
+		if size > maxMetablockLen {
+			size = maxMetablockLen
+		}
+		w.params.max_metablock_size = uint(size)
+	}
+	if w.options.LowLatency && (w.params.max_metablock_size == 0 || w.params.max_metablock_size > lowLatencyMetablockSize) {
+		w.params.max_metablock_size = lowLatencyMetablockSize
+	}
+	if d := w.options.MaxMatchDistance; d > 0 {
+		if max := int(maxBackwardLimit(maxWindowBits)); d > max {
+			d = max
+		}
+		w.params.max_match_distance = uint(d)
+	}
+	if l := w.options.MaxMatchLength; l > 0 {
+		if l < minMatchLengthLimit {
+			l = minMatchLengthLimit
+		}
+		w.params.max_match_length = uint(l)
+	}
+	w.params.long_range_matching = w.options.LongRangeMatching
+	w.params.stored_preferred = w.options.StoredPreferred
+	w.params.cost_model = w.options.CostModel
+	w.params.prepared_dictionary = w.preparedDict
+	w.params.custom_dictionary = len(w.customDictionary()) > 0
+	if w.options.DisableBuiltinDictionary {
+		w.params.dictionary = encoderDictionary{}
+	} else if w.staticDict != nil {
+		w.params.dictionary = *w.staticDict
+	}
+	if w.options.ExtraOptimize && w.options.Quality == BestCompression {
+		w.params.extra_optimize = true
+		if w.options.LGWin == 0 {
+			w.params.lgwin = maxWindowBits
+		}
+	}
+}
+
+// growWindowStart and growWindowStep control the sequence of windows used
+// with GrowWindow: 64 KiB, then 256 KiB, 1 MiB, and so on.
+const (
+	growWindowStart = 16
+	growWindowStep  = 2
+)
+
+// maxGrowWindow returns the largest window that GrowWindow grows to.
+func (w *Writer) maxGrowWindow() uint {
+	if w.options.LGWin > 0 {
+		return uint(w.options.LGWin)
+	}
+	return defaultWindow
+}
+
+// growWindow ends the current stream and starts a new one with a larger
+// window.
+func (w *Writer) growWindow() error {
+	if _, err := w.writeChunk(nil, operationFinish); err != nil {
+		return err
+	}
+	lgwin := w.params.lgwin + growWindowStep
+	if max := w.maxGrowWindow(); lgwin > max {
+		lgwin = max
+	}
+	w.initEncoder()
+	w.params.lgwin = lgwin
+	w.streamIn = 0
+	return nil
+}
+
+// smallestWindow returns the smallest window that covers size bytes, up to
+// the default window.
+func smallestWindow(size int64) uint {
+	lgwin := uint(minWindowBits)
+	for lgwin < defaultWindow && 1<<lgwin-16 < size {
+		lgwin++
+	}
+	return lgwin
+}
+
+// autoWindowHoldMax is the most input that a Writer with automatic window
+// selection holds back to see whether the whole stream fits a small window.
+const autoWindowHoldMax = 1 << 20
+
+// holdMax returns the most input that w holds back.
+func (w *Writer) holdMax() int {
+	if w.options.EmitSizeHint {
+		return math.MaxInt32
+	}
+	max := 0
+	if w.autoWindow {
+		max = autoWindowHoldMax
+	}
+	if w.mayCapQuality() && w.options.LargeInputSize > max {
+		max = w.options.LargeInputSize
+	}
+	return max
+}
+
+// mayCapQuality reports whether LargeInputQuality may apply.
+func (w *Writer) mayCapQuality() bool {
+	return w.options.LargeInputSize > 0 && w.options.Quality > w.options.LargeInputQuality && !w.options.GrowWindow
+}
+
+// capQuality applies LargeInputQuality.
+func (w *Writer) capQuality() {
+	if w.mayCapQuality() {
+		w.params.quality = w.options.LargeInputQuality
+	}
+}
+
+// release stops holding back input and compresses the input held so far.
+// If final is set, the held input is the whole stream, so the smallest window
+// that covers it can be chosen and its size hint written.
+func (w *Writer) release(final bool) error {
+	if !w.holding {
+		return nil
+	}
+	w.holding = false
+	if final && len(w.held) > w.options.LargeInputSize {
+		w.capQuality()
+	}
+	if final && w.autoWindow {
+		w.params.lgwin = smallestWindow(int64(len(w.held) + len(w.customDictionary())))
+	}
+	w.autoWindow = false
+	if final && w.options.EmitSizeHint {
+		var hint [sizeHintLen]byte
+		w.emittingMetadata = true
+		_, err := w.writeChunk(appendSizeHint(hint[:0], int64(len(w.held))), operationEmitMetadata)
+		w.emittingMetadata = false
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.writeChunk(w.held, operationProcess)
+	w.held = w.held[:0]
+	return err
+}
+
+// Ratio returns the number of compressed bytes written to the underlying
+// writer so far divided by the number of uncompressed bytes written to w.
+// Since the Writer buffers input, the value lags behind until the next
+// metablock is emitted, and is only final after Close. It returns 0 before
+// any input has been written. Like the Writer's other methods, Ratio must not
+// be called concurrently with them.
+func (w *Writer) Ratio() float64 {
+	if w.bytesIn == 0 {
+		return 0
+	}
+	return float64(w.bytesOut) / float64(w.bytesIn)
+}
+
+// Pending returns the number of bytes written to w that haven't been
+// compressed and written to the underlying writer yet, which a Flush would
+// write. Qualities 0 and 1 compress data as soon as it is written, so they
+// only hold data while choosing the window size (see LGWin).
+func (w *Writer) Pending() int {
+	return len(w.held) + int(w.input_pos_-w.last_flush_pos_)
+}
+
+// FlushedInputOffset returns the number of input bytes that the output
+// handed to the underlying writer fully represents, that is, that a Reader
+// can recover from it: the input written before the last successful Flush
+// (including those done for WriterOptions.AutoFlushBytes) or Close. A
+// pipeline that persists the output can resume from that offset after a
+// restart. The Writer also writes output between flushes, but it is not
+// counted, since the last metablock in it is generally incomplete.
+func (w *Writer) FlushedInputOffset() int64 {
+	return w.flushedIn
+}
+
+// AdjustedWindow returns the base 2 logarithm of the window size of the
+// current stream, after any reduction for WriterOptions.MemoryBudget (or
+// MaxMatchDistance). Until the stream has started, which may be delayed
+// while the Writer chooses a window for the input, it reports the window
+// for the options alone. It never changes once the stream has started.
+func (w *Writer) AdjustedWindow() int {
+	if w.is_initialized_ {
+		return int(w.params.lgwin)
+	}
+	params := w.params
+	sanitizeParams(&params)
+	if budget := w.options.MemoryBudget; budget > 0 {
+		fitMemoryBudget(&params, budget)
+	}
+	return int(params.lgwin)
+}
+
+// MatchStats returns statistics about the backward references found so far
+// in the current stream, if WriterOptions.CollectStats is set. They are
+// complete after Close.
+func (w *Writer) MatchStats() MatchStats {
+	return w.stats
+}
+
+// EncodeWithInfo compresses content with the given options, like a Writer
+// from NewWriterSize that is written content and closed, and also reports
+// how the stream was encoded, such as for sizing the decoders of a
+// re-encoding pipeline.
+func EncodeWithInfo(content []byte, opts WriterOptions) ([]byte, EncodeInfo, error) {
+	var buf bytes.Buffer
+	w := NewWriterSize(&buf, opts, int64(len(content)))
+	_, err := w.Write(content)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, EncodeInfo{}, err
+	}
+	return buf.Bytes(), w.info, nil
+}
+
+// customDictionary returns the data to compress the stream as a
+// continuation of, if any.
+func (w *Writer) customDictionary() []byte {
+	if w.preparedDict != nil {
+		return w.preparedDict.data
+	}
+	return w.options.Dictionary
 }
 
 func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
@@ -71,6 +847,10 @@ func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
 	if w.err != nil {
 		return 0, w.err
 	}
+	if dict := w.customDictionary(); !w.is_initialized_ && len(dict) > 0 {
+		ensureInitialized(w)
+		encoderSetCustomDictionary(w, dict)
+	}
 
 	for {
 		availableIn := uint(len(p))
@@ -94,24 +874,302 @@ func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
 // not yet complete until after Close.
 // Flush has a negative impact on compression.
 func (w *Writer) Flush() error {
-	_, err := w.writeChunk(nil, operationFlush)
+	if w.dst == nil {
+		return errWriterClosed
+	}
+	if w.options.Preprocess != nil || w.frames != nil {
+		return nil
+	}
+	w.sinceFlush = 0
+	if err := w.release(false); err != nil {
+		return err
+	}
+	if _, err := w.writeChunk(nil, operationFlush); err != nil {
+		return err
+	}
+	if err := w.padToAlignment(); err != nil {
+		return err
+	}
+	if err := w.flushOutput(); err != nil {
+		return err
+	}
+	w.flushedIn = w.accepted
+	return nil
+}
+
+// zeroPadding is the content of the metadata blocks written by
+// padToAlignment.
+var zeroPadding [1 << 16]byte
+
+// padToAlignment pads the output with metadata blocks, which decoders skip,
+// to the next multiple of WriterOptions.FlushAlignment. The output must be at
+// a byte boundary, as it is after a flush, so that each metadata block takes
+// a predictable number of bytes: 1 if it is empty, or else 2, 3, or 4 bytes
+// of header (depending on the length of the content) plus the content.
+func (w *Writer) padToAlignment() error {
+	align := int64(w.options.FlushAlignment)
+	if align <= 1 {
+		return nil
+	}
+	pad := int((align - (w.bytesOut+int64(len(w.outBuf)))%align) % align)
+	w.emittingMetadata = true
+	defer func() { w.emittingMetadata = false }()
+	for pad > 0 {
+		var n int
+		switch {
+		case pad < 3:
+			n = 0
+		case pad <= 2+256:
+			n = pad - 2
+		case pad < 3+257:
+			// Too short for a 2-byte length, too long for a 1-byte one.
+			n = 256
+		default:
+			n = pad - 3
+			if n > len(zeroPadding) {
+				n = len(zeroPadding)
+			}
+		}
+		if _, err := w.writeChunk(zeroPadding[:n], operationEmitMetadata); err != nil {
+			return err
+		}
+		pad -= metadataBlockSize(n)
+	}
+	return nil
+}
+
+// metadataBlockSize returns the size of a byte-aligned metadata block with n
+// bytes of content.
+func metadataBlockSize(n int) int {
+	switch {
+	case n == 0:
+		return 1
+	case n <= 1<<8:
+		return 2 + n
+	case n <= 1<<16:
+		return 3 + n
+	}
+	return 4 + n
+}
+
+// FinishMetablock ends the current metablock, emitting all data provided to
+// Write so far. If isLast is false, the metablock is followed by padding to a
+// byte boundary, so that the output so far can be spliced into a custom
+// multiplexed stream; this is equivalent to Flush. If isLast is true, the
+// metablock is marked ISLAST, which ends the stream: no more data may be
+// written, and the Writer must still be closed (or Reset) afterwards.
+func (w *Writer) FinishMetablock(isLast bool) error {
+	if !isLast {
+		return w.Flush()
+	}
+	if err := w.release(true); err != nil {
+		return err
+	}
+	_, err := w.writeChunk(nil, operationFinish)
 	return err
 }
 
-// Close flushes remaining data to the decorated writer.
+// Close flushes remaining data to the decorated writer. If an earlier call
+// failed, Close returns the same error without writing anything more.
 func (w *Writer) Close() error {
+	if w.frames != nil {
+		return w.closeFrames()
+	}
+	if w.options.Preprocess != nil && w.dst != nil && w.err == nil {
+		input := w.options.Preprocess(w.unprocessed)
+		w.unprocessed = w.unprocessed[:0]
+		if _, err := w.writeInput(input); err != nil {
+			return err
+		}
+	}
+
 	// If stream is already closed, it is reported by `writeChunk`.
-	_, err := w.writeChunk(nil, operationFinish)
+	err := w.release(true)
+	if err == nil {
+		_, err = w.writeChunk(nil, operationFinish)
+	}
+	if err == nil {
+		err = w.flushOutput()
+	}
+	if err == nil && w.dst != nil {
+		w.flushedIn = w.written
+	}
 	w.dst = nil
 	return err
 }
 
+// Rotate ends the current stream, writing everything buffered to the
+// underlying writer as Close does, and starts a new stream on dst, as Reset
+// does, such as for rotating log files: each file then holds a complete
+// stream of the data written between rotations. (The old writer is not
+// closed.) If ending the stream fails, Rotate returns the error and the
+// Writer stays closed, with the data it had not written lost.
+func (w *Writer) Rotate(dst io.Writer) error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	w.Reset(dst)
+	return nil
+}
+
+// Abort discards the input and output that w has buffered, without
+// finishing the stream or writing anything more to the underlying writer,
+// such as when a transaction is cancelled; what was already written is an
+// incomplete stream. It also releases the Writer's large buffers. The
+// Writer is then closed, until it is Reset.
+func (w *Writer) Abort() {
+	w.dst = nil
+	w.holding = false
+	w.held = nil
+	w.unprocessed = nil
+	w.outBuf = nil
+	w.storage = nil
+	w.commands = nil
+	w.spare_commands = nil
+	w.ringbuffer_ = ringBuffer{}
+	w.hasher_ = nil
+	w.large_table_ = nil
+	w.large_table_size_ = 0
+}
+
+// Closed reports whether w has been closed (and not Reset since), so that
+// writing to it would fail.
+func (w *Writer) Closed() bool {
+	return w.dst == nil
+}
+
+// WriteContext is like Write, but gives up once ctx is done, such as when
+// its deadline passes while the underlying writer is slow to accept the
+// output, and returns ctx.Err(), such as context.DeadlineExceeded. The
+// output is passed to the underlying writer in pieces of at most 32 KiB,
+// and ctx is checked before each one; a Write of the underlying writer that
+// has started isn't interrupted, so for a network connection, also set a
+// write deadline on it. The Writer can't be used any further after giving
+// up, except to Reset it.
+func (w *Writer) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	w.ctx = ctx
+	defer func() { w.ctx = nil }()
+	return w.Write(p)
+}
+
+// FlushContext is like Flush, but gives up once ctx is done, like
+// WriteContext.
+func (w *Writer) FlushContext(ctx context.Context) error {
+	w.ctx = ctx
+	defer func() { w.ctx = nil }()
+	return w.Flush()
+}
+
+// CloseContext is like Close, but gives up once ctx is done, like
+// WriteContext.
+func (w *Writer) CloseContext(ctx context.Context) error {
+	w.ctx = ctx
+	defer func() { w.ctx = nil }()
+	return w.Close()
+}
+
 // Write implements io.Writer. Flush or Close must be called to ensure that the
 // encoded bytes are actually flushed to the underlying Writer.
 func (w *Writer) Write(p []byte) (n int, err error) {
-	return w.writeChunk(p, operationProcess)
+	if w.frames != nil {
+		return w.writeFrame(p)
+	}
+	if w.options.Preprocess != nil {
+		if w.dst == nil {
+			return 0, errWriterClosed
+		}
+		w.unprocessed = append(w.unprocessed, p...)
+		w.written += int64(len(p))
+		return len(p), nil
+	}
+	n, err = w.writeInput(p)
+	w.written += int64(n)
+	return n, err
 }
 
+// writeInput compresses p (after any preprocessing).
+func (w *Writer) writeInput(p []byte) (n int, err error) {
+	if w.holding && w.dst != nil && w.err == nil {
+		if len(w.held)+len(p) <= w.holdMax() {
+			w.held = append(w.held, p...)
+			w.accepted += int64(len(p))
+			return len(p), nil
+		}
+		if len(w.held)+len(p) > w.options.LargeInputSize {
+			w.capQuality()
+		}
+		if err := w.release(false); err != nil {
+			return 0, err
+		}
+	}
+
+	if !w.options.GrowWindow {
+		return w.write(p)
+	}
+	for len(p) > 0 {
+		if w.params.lgwin < w.maxGrowWindow() && w.streamIn >= 1<<w.params.lgwin {
+			if err := w.growWindow(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if w.params.lgwin < w.maxGrowWindow() {
+			if room := 1<<w.params.lgwin - w.streamIn; len(chunk) > room {
+				chunk = chunk[:room]
+			}
+		}
+		m, err := w.write(chunk)
+		n += m
+		w.streamIn += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// write is Write without the window growth.
+func (w *Writer) write(p []byte) (n int, err error) {
+	if w.options.AutoFlushBytes <= 0 {
+		n, err = w.writeChunk(p, operationProcess)
+		w.accepted += int64(n)
+		return n, err
+	}
+
+	for len(p) > 0 {
+		chunk := p
+		if room := w.options.AutoFlushBytes - w.sinceFlush; len(chunk) > room {
+			chunk = chunk[:room]
+		}
+		m, err := w.writeChunk(chunk, operationProcess)
+		n += m
+		w.sinceFlush += m
+		w.accepted += int64(m)
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		if w.sinceFlush >= w.options.AutoFlushBytes {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Compressor is the interface implemented by *Writer. Code that doesn't need
+// the concrete type can accept a Compressor instead, so that tests can
+// substitute a fake.
+type Compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(dst io.Writer)
+}
+
+var _ Compressor = (*Writer)(nil)
+
 type nopCloser struct {
 	io.Writer
 }